@@ -0,0 +1,247 @@
+package mqtt
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A ClientInfo describes a client, as it identified itself in its
+// CONNECT message. An Authenticator may also set the Backpressure
+// policy for the client, in place of the Server's.
+type ClientInfo struct {
+	ClientId     string
+	Username     string
+	Password     string
+	RemoteAddr   net.Addr
+	Cert         *x509.Certificate // The client's TLS certificate, if it sent one.
+	Listener     string            // The Name of the listener the client connected to, if any.
+	Backpressure Backpressure      // What to do when the client cannot keep up; BackpressureDefault for the Server's policy.
+}
+
+// Find the certificate the client presented, if any. The TLS handshake
+// is done by the time the first message has been read.
+func peerCert(conn net.Conn) *x509.Certificate {
+	if wc, ok := conn.(*wsConn); ok {
+		conn = wc.Conn
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		if certs := tc.ConnectionState().PeerCertificates; len(certs) > 0 {
+			return certs[0]
+		}
+	}
+	return nil
+}
+
+// An Authenticator decides who may connect to a Server.
+type Authenticator interface {
+	// Authenticate returns proto.RetCodeAccepted to let the client
+	// connect, or the return code to refuse it with, typically
+	// proto.RetCodeBadUsernameOrPassword or proto.RetCodeNotAuthorized.
+	Authenticate(ci *ClientInfo) proto.ReturnCode
+}
+
+// Access is the kind of access to a topic that a client wants.
+type Access int
+
+const (
+	AccessRead  Access = 1 << iota // subscribe to a topic
+	AccessWrite                    // publish to a topic
+)
+
+// An Authorizer decides which topics a client may use. It is consulted
+// for each topic in a SUBSCRIBE (which may contain wildcards), and for
+// each PUBLISH.
+type Authorizer interface {
+	Authorize(ci *ClientInfo, topic string, acc Access) bool
+}
+
+// A FileAuth is an Authenticator and Authorizer which takes its users
+// and access control lists from a text file like this:
+//
+//	# Lines starting with # are comments.
+//	# Topic rules before the first user apply to everyone.
+//	topic read $SYS/#
+//
+//	user alice s3cret
+//	topic readwrite sensors/alice/#
+//	topic read sensors/#
+//
+//	# A user without a password must connect with a TLS client
+//	# certificate with this common name, and no username.
+//	user sensor-17
+//	topic write sensors/17/#
+//
+//	# Let clients connect without a username, using only the
+//	# rules for everyone.
+//	allow_anonymous
+//
+// Topic rules use + and # like subscriptions. A rule allows a
+// subscription only if everything the subscription could match is
+// allowed. Certificates are taken at face value: the listener must
+// verify them (for instance, with tls.RequireAndVerifyClientCert).
+type FileAuth struct {
+	anonymous bool
+	users     map[string]*authUser
+	all       []aclRule
+}
+
+type authUser struct {
+	password string
+	hasPass  bool
+	rules    []aclRule
+}
+
+type aclRule struct {
+	w   wild
+	acc Access
+}
+
+// LoadAuthFile reads the named file; see FileAuth for its format.
+func LoadAuthFile(name string) (*FileAuth, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadAuth(f)
+}
+
+// ReadAuth reads users and topic rules; see FileAuth for the format.
+func ReadAuth(r io.Reader) (*FileAuth, error) {
+	fa := &FileAuth{users: make(map[string]*authUser)}
+	var user *authUser
+
+	s := bufio.NewScanner(r)
+	line := 0
+	for s.Scan() {
+		line++
+		f := strings.Fields(s.Text())
+		if len(f) == 0 || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+
+		switch {
+		case f[0] == "allow_anonymous" && len(f) == 1:
+			fa.anonymous = true
+		case f[0] == "user" && (len(f) == 2 || len(f) == 3):
+			user = &authUser{}
+			if len(f) == 3 {
+				user.password = f[2]
+				user.hasPass = true
+			}
+			fa.users[f[1]] = user
+		case f[0] == "topic" && len(f) == 3:
+			var acc Access
+			switch f[1] {
+			case "read":
+				acc = AccessRead
+			case "write":
+				acc = AccessWrite
+			case "readwrite":
+				acc = AccessRead | AccessWrite
+			default:
+				return nil, fmt.Errorf("line %v: unknown access %q", line, f[1])
+			}
+			w := newWild(f[2])
+			if !w.valid() {
+				return nil, fmt.Errorf("line %v: invalid topic %q", line, f[2])
+			}
+			rule := aclRule{w: w, acc: acc}
+			if user == nil {
+				fa.all = append(fa.all, rule)
+			} else {
+				user.rules = append(user.rules, rule)
+			}
+		default:
+			return nil, fmt.Errorf("line %v: cannot parse %q", line, s.Text())
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return fa, nil
+}
+
+// The name the client is known by: its username, or, if it connected
+// without one, the common name from its certificate.
+func (fa *FileAuth) name(ci *ClientInfo) string {
+	if ci.Username == "" && ci.Cert != nil {
+		return ci.Cert.Subject.CommonName
+	}
+	return ci.Username
+}
+
+// Authenticate implements Authenticator.
+func (fa *FileAuth) Authenticate(ci *ClientInfo) proto.ReturnCode {
+	if ci.Username == "" && ci.Cert == nil {
+		if fa.anonymous {
+			return proto.RetCodeAccepted
+		}
+		return proto.RetCodeNotAuthorized
+	}
+
+	u, ok := fa.users[fa.name(ci)]
+	if !ok {
+		return proto.RetCodeBadUsernameOrPassword
+	}
+	if !u.hasPass {
+		// only a certificate will do
+		if ci.Username != "" || ci.Cert == nil {
+			return proto.RetCodeBadUsernameOrPassword
+		}
+		return proto.RetCodeAccepted
+	}
+	if ci.Username == "" ||
+		subtle.ConstantTimeCompare([]byte(ci.Password), []byte(u.password)) != 1 {
+		return proto.RetCodeBadUsernameOrPassword
+	}
+	return proto.RetCodeAccepted
+}
+
+// Authorize implements Authorizer.
+func (fa *FileAuth) Authorize(ci *ClientInfo, topic string, acc Access) bool {
+	parts := strings.Split(topic, "/")
+	rules := fa.all
+	if u, ok := fa.users[fa.name(ci)]; ok {
+		rules = append(rules[:len(rules):len(rules)], u.rules...)
+	}
+	for _, r := range rules {
+		if r.acc&acc == acc && r.w.covers(parts) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check that everything matched by topic (which may itself contain
+// wildcards) is also matched by w.
+func (w wild) covers(parts []string) bool {
+	for i, part := range parts {
+		if i >= len(w.wild) {
+			return false
+		}
+		switch w.wild[i] {
+		case "#":
+			return true
+		case "+":
+			// + can stand in for + but not for #
+			if part == "#" {
+				return false
+			}
+		default:
+			if part != w.wild[i] {
+				return false
+			}
+		}
+	}
+	return w.matches(parts)
+}
@@ -0,0 +1,131 @@
+package mqtt
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"strings"
+	"testing"
+
+	proto "github.com/huin/mqtt"
+)
+
+const testAuth = `
+# everyone
+topic read $SYS/#
+
+user alice s3cret
+topic readwrite sensors/alice/#
+topic read sensors/+/temp
+
+user sensor-17
+topic write sensors/17/#
+`
+
+func TestFileAuth(t *testing.T) {
+	fa, err := ReadAuth(strings.NewReader(testAuth))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "sensor-17"}}
+	alice := &ClientInfo{Username: "alice", Password: "s3cret"}
+	sensor := &ClientInfo{Cert: cert}
+
+	var connects = []struct {
+		ci   *ClientInfo
+		want proto.ReturnCode
+	}{
+		{alice, proto.RetCodeAccepted},
+		{&ClientInfo{Username: "alice", Password: "wrong"}, proto.RetCodeBadUsernameOrPassword},
+		{&ClientInfo{Username: "bob", Password: "s3cret"}, proto.RetCodeBadUsernameOrPassword},
+		{&ClientInfo{}, proto.RetCodeNotAuthorized},
+		{sensor, proto.RetCodeAccepted},
+		{&ClientInfo{Username: "sensor-17"}, proto.RetCodeBadUsernameOrPassword},
+	}
+	for _, x := range connects {
+		if got := fa.Authenticate(x.ci); got != x.want {
+			t.Errorf("Authenticate(%+v): got %v, want %v", x.ci, got, x.want)
+		}
+	}
+
+	var topics = []struct {
+		ci    *ClientInfo
+		topic string
+		acc   Access
+		want  bool
+	}{
+		{alice, "$SYS/broker/clients/active", AccessRead, true},
+		{alice, "$SYS/#", AccessRead, true},
+		{alice, "$SYS/broker", AccessWrite, false},
+		{alice, "sensors/alice", AccessWrite, true},
+		{alice, "sensors/alice/x/y", AccessRead | AccessWrite, true},
+		{alice, "sensors/bob", AccessWrite, false},
+		{alice, "sensors/bob/temp", AccessRead, true},
+		{alice, "sensors/+/temp", AccessRead, true},
+		{alice, "sensors/#", AccessRead, false},
+		{alice, "sensors/+", AccessRead, false},
+		{alice, "sensors/bob/temp", AccessWrite, false},
+		{sensor, "sensors/17/temp", AccessWrite, true},
+		{sensor, "sensors/17/temp", AccessRead, false},
+		{sensor, "$SYS/broker/uptime", AccessRead, true},
+	}
+	for _, x := range topics {
+		if got := fa.Authorize(x.ci, x.topic, x.acc); got != x.want {
+			t.Errorf("Authorize(%v, %v, %v): got %v", x.ci.Username, x.topic, x.acc, got)
+		}
+	}
+}
+
+func TestAuthServer(t *testing.T) {
+	fa, err := ReadAuth(strings.NewReader(testAuth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr := NewServer(nil)
+	svr.Authenticator = fa
+	svr.Authorizer = fa
+
+	tc := dialTest(t, svr)
+	tc.send(&proto.Connect{
+		ProtocolName:    "MQIsdp",
+		ProtocolVersion: 3,
+		ClientId:        "bad",
+		UsernameFlag:    true,
+		PasswordFlag:    true,
+		Username:        "alice",
+		Password:        "guess",
+	})
+	if ack, ok := tc.recv().(*proto.ConnAck); !ok || ack.ReturnCode != proto.RetCodeBadUsernameOrPassword {
+		t.Fatalf("expected refusal, got %v", ack)
+	}
+
+	tc = dialTest(t, svr)
+	tc.send(&proto.Connect{
+		ProtocolName:    "MQIsdp",
+		ProtocolVersion: 3,
+		ClientId:        "alice",
+		CleanSession:    true,
+		UsernameFlag:    true,
+		PasswordFlag:    true,
+		Username:        "alice",
+		Password:        "s3cret",
+	})
+	if ack, ok := tc.recv().(*proto.ConnAck); !ok || ack.ReturnCode != proto.RetCodeAccepted {
+		t.Fatalf("expected accept, got %v", ack)
+	}
+	tc.subscribe("sensors/#", proto.QosAtMostOnce)
+	tc.subscribe("sensors/alice/#", proto.QosAtMostOnce)
+
+	// The first is not published, and the second is not sent to us,
+	// because the first subscription was not made.
+	for _, topic := range []string{"sensors/bob", "sensors/alice/temp"} {
+		tc.send(&proto.Publish{
+			TopicName: topic,
+			Payload:   proto.BytesPayload(topic),
+		})
+	}
+	m, ok := tc.recv().(*proto.Publish)
+	if !ok || m.TopicName != "sensors/alice/temp" {
+		t.Fatalf("expected sensors/alice/temp, got %v", m)
+	}
+}
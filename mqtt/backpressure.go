@@ -0,0 +1,153 @@
+package mqtt
+
+import (
+	"sync/atomic"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A Backpressure policy says what to do when a client cannot keep up
+// with the messages sent to it, so that its queue of messages waiting
+// to be sent is full. Messages the client publishes are subject to the
+// same policy when the server as a whole is not keeping up, except that
+// QoS 1 and 2 messages always wait (and so do their acks), and the
+// oldest messages are never dropped to make room, since those belong to
+// other clients.
+//
+// Each message dropped is counted, for the client and for the server.
+// The counts appear in $SYS/broker/clients/dropped/<client id> and
+// $SYS/broker/publish/messages/dropped.
+type Backpressure int
+
+const (
+	BackpressureDefault    Backpressure = iota // for a client, the Server's policy; for the Server, BackpressureDropNewest
+	BackpressureDropNewest                     // drop the message which does not fit
+	BackpressureDropOldest                     // drop the oldest message waiting, to make room
+	BackpressureDisconnect                     // drop the message, and disconnect the client
+	BackpressureBlock                          // wait for room, for up to the Server's BlockTimeout, and then drop the message
+)
+
+// Count a message to or from the client as dropped.
+func (c *incomingConn) drop() {
+	atomic.AddInt64(&c.dropped, 1)
+	c.svr.stats.messageDropped()
+}
+
+// Hang up on a client which cannot keep up.
+func (c *incomingConn) disconnectSlow() {
+	c.svr.logger().Printf("%v: cannot keep up, disconnecting", c)
+	c.conn.Close()
+}
+
+// Queue a published message for the client, according to its policy.
+func (c *incomingConn) submitPublish(m *proto.Publish) {
+	c.qmu.Lock()
+	defer c.qmu.Unlock()
+
+	j := job{m: m}
+	if c.policy == BackpressureDropOldest {
+		// The published messages have a queue of their own, so
+		// that the replies keep their places. Only the writer
+		// takes from it while we hold qmu, so the room we make
+		// is ours.
+		for {
+			select {
+			case c.pubs <- j:
+				return
+			default:
+			}
+			select {
+			case <-c.pubs:
+				c.drop()
+			default:
+			}
+		}
+	}
+	select {
+	case c.jobs <- j:
+		return
+	default:
+	}
+
+	switch c.policy {
+	case BackpressureDisconnect:
+		c.drop()
+		c.disconnectSlow()
+
+	case BackpressureBlock:
+		t := time.NewTimer(c.svr.BlockTimeout)
+		defer t.Stop()
+		select {
+		case c.jobs <- j:
+		case <-t.C:
+			c.svr.logger().Print(c, ": queue full, dropping message")
+			c.drop()
+		}
+
+	default:
+		c.svr.logger().Print(c, ": queue full, dropping message")
+		c.drop()
+	}
+}
+
+// Pass a message the client published to the subscription workers,
+// according to its policy if they are not keeping up.
+func (c *incomingConn) post(m *proto.Publish) {
+	p := post{c: c, m: m}
+	if m.Header.QosLevel != proto.QosAtMostOnce {
+		c.svr.subs.posts <- p
+		return
+	}
+	select {
+	case c.svr.subs.posts <- p:
+		return
+	default:
+	}
+
+	switch c.policy {
+	case BackpressureDisconnect:
+		c.drop()
+		c.disconnectSlow()
+
+	case BackpressureBlock:
+		t := time.NewTimer(c.svr.BlockTimeout)
+		defer t.Stop()
+		select {
+		case c.svr.subs.posts <- p:
+		case <-t.C:
+			c.svr.logger().Print(c, ": server busy, dropping message")
+			c.drop()
+		}
+
+	default:
+		c.svr.logger().Print(c, ": server busy, dropping message")
+		c.drop()
+	}
+}
+
+// Publish the number of messages dropped for each connected client
+// which has had any dropped. Unlike the other statistics, these are not
+// retained, since there would be one left behind for every client that
+// ever had a message dropped.
+func (s *Server) publishDropped() {
+	type count struct {
+		id string
+		n  int64
+	}
+	var counts []count
+	s.clientsMu.Lock()
+	for id, c := range s.clients {
+		// Client ids with wildcards cannot go in a topic.
+		if n := atomic.LoadInt64(&c.dropped); n > 0 && !isWildcard(id) {
+			counts = append(counts, count{id, n})
+		}
+	}
+	s.clientsMu.Unlock()
+
+	for _, c := range counts {
+		m := statsMessage("$SYS/broker/clients/dropped/"+c.id, c.n)
+		m.Header.Retain = false
+		s.subs.submit(nil, m)
+	}
+}
@@ -0,0 +1,151 @@
+package mqtt
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestBackpressure(t *testing.T) {
+	msg := func(s string) *proto.Publish {
+		return &proto.Publish{TopicName: "bp", Payload: proto.BytesPayload(s)}
+	}
+	tests := []struct {
+		policy  Backpressure
+		queued  []message // already queued, in queues with room for two
+		want    string    // the messages queued afterwards, with replies as "-"
+		dropped int64
+	}{
+		{BackpressureDefault, []message{msg("1"), msg("2")}, "12", 1},
+		{BackpressureDropNewest, []message{msg("1"), msg("2")}, "12", 1},
+		{BackpressureDropOldest, []message{msg("1"), msg("2")}, "23", 1},
+		{BackpressureDropOldest, []message{&proto.PingResp{}, msg("2")}, "-23", 0},
+		{BackpressureDropOldest, []message{&proto.PingResp{}, &proto.PingResp{}}, "--3", 0},
+		{BackpressureBlock, []message{msg("1"), msg("2")}, "12", 1},
+		{BackpressureDisconnect, []message{msg("1"), msg("2")}, "12", 1},
+	}
+	for _, test := range tests {
+		svr := NewServer(nil)
+		svr.BlockTimeout = 10 * time.Millisecond
+		cli, srv := net.Pipe()
+		c := svr.newIncomingConn(srv)
+		c.jobs = make(chan job, 2)
+		c.pubs = make(chan job, 2)
+		c.policy = test.policy
+		for _, m := range test.queued {
+			if _, ok := m.(*proto.Publish); ok && test.policy == BackpressureDropOldest {
+				c.pubs <- job{m: m}
+			} else {
+				c.jobs <- job{m: m}
+			}
+		}
+
+		c.submit(msg("3"))
+		got := ""
+		for _, q := range []chan job{c.jobs, c.pubs} {
+			for len(q) > 0 {
+				if m, ok := (<-q).m.(*proto.Publish); ok {
+					got += string(m.Payload.(proto.BytesPayload))
+				} else {
+					got += "-"
+				}
+			}
+		}
+		if got != test.want || c.dropped != test.dropped || svr.stats.dropped != test.dropped {
+			t.Errorf("policy %v: got %q with %v dropped, want %q with %v",
+				test.policy, got, c.dropped, test.want, test.dropped)
+		}
+
+		// Only the slow client is disconnected.
+		cli.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		_, err := cli.Read(make([]byte, 1))
+		if (err == io.EOF) != (test.policy == BackpressureDisconnect) {
+			t.Errorf("policy %v: read got %v", test.policy, err)
+		}
+		cli.Close()
+	}
+}
+
+func TestBackpressureBlock(t *testing.T) {
+	svr := NewServer(nil)
+	c := svr.newIncomingConn(nil)
+	c.jobs = make(chan job, 1)
+	c.policy = BackpressureBlock
+	c.submit(&proto.Publish{TopicName: "1"})
+
+	// Room is made in time.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-c.jobs
+	}()
+	c.submit(&proto.Publish{TopicName: "2"})
+	if m := (<-c.jobs).m.(*proto.Publish); m.TopicName != "2" || c.dropped != 0 {
+		t.Errorf("got %v with %v dropped", m.TopicName, c.dropped)
+	}
+}
+
+func TestBackpressureDropOldestConnAck(t *testing.T) {
+	svr := NewServer(nil)
+	cli, srv := net.Pipe()
+	c := svr.newIncomingConn(srv)
+	c.policy = BackpressureDropOldest
+	c.sess, _ = svr.session("bp", true, 0)
+
+	// A message published to the client waits for its CONNACK,
+	// even if it gets into the queue first.
+	c.submit(&proto.Publish{
+		Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+		TopicName: "bp",
+		Payload:   proto.BytesPayload("x"),
+	})
+	c.submit(&proto.ConnAck{ReturnCode: proto.RetCodeAccepted})
+	svr.running.Add(1)
+	go c.writer()
+
+	tc := &testClient{t: t, conn: cli}
+	if m, ok := tc.recv().(*proto.ConnAck); !ok {
+		t.Fatalf("expected CONNACK, got %v", m)
+	}
+	if m, ok := tc.recv().(*proto.Publish); !ok || m.MessageId == 0 {
+		t.Fatalf("expected QoS 1 PUBLISH, got %v", m)
+	}
+	cli.Close()
+	close(c.jobs)
+	<-c.Done
+}
+
+func TestDroppedStats(t *testing.T) {
+	svr := NewServer(nil)
+	sub := newTestClient(t, svr, "sub")
+	sub.subscribe("$SYS/broker/clients/dropped/+", proto.QosAtMostOnce)
+	// Retain As Published shows whether the count is retained.
+	sub5 := dialTest(t, svr)
+	sub5.connect5("sub5", true)
+	sub5.send5(&packet5{
+		m: &proto.Subscribe{
+			Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+			MessageId: 1,
+			Topics:    []proto.TopicQos{{Topic: "$SYS/broker/clients/dropped/+", Qos: proto.QosAtMostOnce}},
+		},
+		opts: []byte{0x08},
+	})
+	sub5.recv5()
+	newTestClient(t, svr, "slow")
+
+	svr.clientsMu.Lock()
+	atomic.StoreInt64(&svr.clients["slow"].dropped, 3)
+	svr.clientsMu.Unlock()
+	svr.publishDropped()
+
+	m, ok := sub.recv().(*proto.Publish)
+	if !ok || m.TopicName != "$SYS/broker/clients/dropped/slow" || string(m.Payload.(proto.BytesPayload)) != "3" {
+		t.Fatalf("expected dropped count, got %v", m)
+	}
+	if p := sub5.recv5(); p.m.(*proto.Publish).Header.Retain {
+		t.Error("dropped count retained")
+	}
+}
@@ -0,0 +1,405 @@
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A BridgeDirection says which way the messages on a bridged topic go.
+type BridgeDirection int
+
+const (
+	BridgeIn   BridgeDirection = 1 << iota // from the remote broker to the Server
+	BridgeOut                              // from the Server to the remote broker
+	BridgeBoth = BridgeIn | BridgeOut
+)
+
+// A BridgeTopic is a topic pattern (which may contain wildcards) to
+// pass across a Bridge. The pattern is relative to the prefixes: the
+// messages on LocalPrefix+Pattern in the Server correspond to those on
+// RemotePrefix+Pattern in the remote broker. The messages keep their
+// QoS level as they cross, up to Qos.
+type BridgeTopic struct {
+	Pattern      string
+	Direction    BridgeDirection
+	Qos          proto.QosLevel
+	LocalPrefix  string
+	RemotePrefix string
+}
+
+// ParseBridgeTopic parses a bridge topic in the form used by the topic
+// lines of a mosquitto bridge configuration:
+//
+//	pattern [in|out|both [qos [local-prefix [remote-prefix]]]]
+//
+// The direction defaults to out, the QoS level, which may be left out,
+// to 0, and "" stands for an empty prefix.
+func ParseBridgeTopic(s string) (BridgeTopic, error) {
+	f := strings.Fields(s)
+	for i := range f {
+		if f[i] == `""` {
+			f[i] = ""
+		}
+	}
+	if len(f) == 0 || len(f) > 5 {
+		return BridgeTopic{}, fmt.Errorf("mqtt: bad bridge topic %q", s)
+	}
+	t := BridgeTopic{Pattern: f[0], Direction: BridgeOut}
+	if len(f) > 1 {
+		switch f[1] {
+		case "in":
+			t.Direction = BridgeIn
+		case "out":
+			t.Direction = BridgeOut
+		case "both":
+			t.Direction = BridgeBoth
+		default:
+			return BridgeTopic{}, fmt.Errorf("mqtt: bad bridge direction %q", f[1])
+		}
+	}
+	if len(f) > 2 {
+		switch f[2] {
+		case "0", "1", "2":
+			t.Qos = proto.QosLevel(f[2][0] - '0')
+			f = append(f[:2], f[3:]...)
+		}
+	}
+	if len(f) > 4 {
+		return BridgeTopic{}, fmt.Errorf("mqtt: bad bridge topic %q", s)
+	}
+	if len(f) > 2 {
+		t.LocalPrefix = f[2]
+	}
+	if len(f) > 3 {
+		t.RemotePrefix = f[3]
+	}
+	return t, nil
+}
+
+// A Bridge connects a Server to a remote broker, passing the messages
+// on the bridged topics between them. It talks to the Server through a
+// connection of its own, which is not subject to the Server's
+// Authenticator and Authorizer, and to the remote broker with a
+// ClientConn, reconnecting whenever that connection is lost. Messages
+// published locally while the remote broker is unreachable are dropped.
+//
+// Messages are passed on with their own QoS level, up to that of the
+// bridged topic, keeping their retain flag.
+//
+// A message passed across the bridge is not passed back again, even if
+// it is on a topic bridged in both directions. With MQTT 5 this is done
+// using the No Local subscription option. Older brokers have no such
+// thing, so the Bridge instead drops a message from the remote broker
+// which is the same as one it has just sent there.
+type Bridge struct {
+	ClientId          string                   // The client id to use with the remote broker. Defaults to a random one.
+	Username          string                   // The user name to give the remote broker, if any.
+	Password          string                   // The password to give the remote broker.
+	Version           uint8                    // The protocol version to speak to the remote broker, as for ClientConn.
+	Topics            []BridgeTopic            // The topics to bridge.
+	Dial              func() (net.Conn, error) // Connects to the remote broker. Defaults to a TCP connection to the address given to NewBridge.
+	ReconnectDelay    time.Duration            // How long to wait before reconnecting after a failure. Defaults to 1 second, doubling with each further failure.
+	MaxReconnectDelay time.Duration            // The longest to wait before reconnecting. Defaults to 1 minute.
+	KeepAlive         time.Duration            // How often to check that the remote broker is still there, as for ClientConn. Defaults to 1 minute.
+	Dump              bool                     // When true, dump the messages to and from the remote broker.
+
+	svr   *Server
+	addr  string
+	local *ClientConn
+
+	// Messages recently sent to an MQTT 3 remote broker which we
+	// expect to hear about again; only touched by run.
+	echoes map[string]int
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{} // closed when run exits
+
+	mu      sync.Mutex // guards started
+	started bool       // set when Start starts run
+}
+
+// How long the remote broker has to answer a CONNECT or SUBSCRIBE.
+const bridgeConnectTimeout = 30 * time.Second
+
+// The most messages to remember when looking out for echoes.
+const maxEchoes = 1000
+
+// NewBridge makes a new Bridge between svr and the remote broker at
+// addr. The Bridge is configured using its fields, and then started
+// with Start.
+func NewBridge(svr *Server, addr string) *Bridge {
+	b := &Bridge{
+		svr:               svr,
+		addr:              addr,
+		ReconnectDelay:    time.Second,
+		MaxReconnectDelay: time.Minute,
+		KeepAlive:         time.Minute,
+		stop:              make(chan struct{}),
+		done:              make(chan struct{}),
+	}
+	b.Dial = func() (net.Conn, error) {
+		return net.DialTimeout("tcp", b.addr, bridgeConnectTimeout)
+	}
+	return b
+}
+
+// Start connects the Bridge to the Server, and starts connecting to the
+// remote broker in the background.
+func (b *Bridge) Start() error {
+	for _, t := range b.Topics {
+		if !validFilter(t.LocalPrefix+t.Pattern) || !validFilter(t.RemotePrefix+t.Pattern) {
+			return fmt.Errorf("mqtt: bad bridge topic %q", t.Pattern)
+		}
+	}
+
+	cli, srv := net.Pipe()
+	c := b.svr.newIncomingConn(srv)
+	c.trusted = true
+	b.svr.stats.clientConnect()
+	c.start()
+
+	b.local = NewClientConn(cli)
+	b.local.ClientId = "bridge/" + b.addr
+	b.local.Version = Version5
+	if err := b.local.Connect("", ""); err != nil {
+		cli.Close()
+		return err
+	}
+	if len(b.subscriptions(BridgeOut)) > 0 {
+		if _, err := b.local.subscribe(context.Background(), b.subscribe(b.local, BridgeOut)); err != nil {
+			b.local.Disconnect()
+			return err
+		}
+	}
+
+	b.mu.Lock()
+	b.started = true
+	b.mu.Unlock()
+	go b.run()
+	return nil
+}
+
+// Stop disconnects the Bridge from the remote broker and the Server.
+// It does nothing if the Bridge was never started.
+func (b *Bridge) Stop() {
+	b.stopOnce.Do(func() { close(b.stop) })
+	b.mu.Lock()
+	started := b.started
+	b.mu.Unlock()
+	if started {
+		<-b.done
+	}
+}
+
+// The topic filters to subscribe to at the end of the bridge that the
+// messages going in direction dir come from.
+func (b *Bridge) subscriptions(dir BridgeDirection) []proto.TopicQos {
+	var res []proto.TopicQos
+	for _, t := range b.Topics {
+		if t.Direction&dir == 0 {
+			continue
+		}
+		if dir == BridgeOut {
+			res = append(res, proto.TopicQos{Topic: t.LocalPrefix + t.Pattern, Qos: t.Qos})
+		} else {
+			res = append(res, proto.TopicQos{Topic: t.RemotePrefix + t.Pattern, Qos: t.Qos})
+		}
+	}
+	return res
+}
+
+// Make the SUBSCRIBE for the messages going in direction dir, to send
+// on cc. With MQTT 5, we do not want our own messages back, and we do
+// want to know which ones were retained.
+func (b *Bridge) subscribe(cc *ClientConn, dir BridgeDirection) message {
+	m := &proto.Subscribe{Header: header(dupFalse, proto.QosAtLeastOnce, retainFalse)}
+	var opts []byte
+	for _, tq := range b.subscriptions(dir) {
+		m.Topics = append(m.Topics, tq)
+		opts = append(opts, byte(tq.Qos)|0x04|0x08)
+	}
+	if cc.Version == Version5 {
+		return &packet5{m: m, opts: opts}
+	}
+	return m
+}
+
+// Map a topic from one end of the bridge to the other, for a message
+// going in direction dir, using the first of the bridged topics which
+// matches it, and return its QoS level too. Returns false if none do.
+func (b *Bridge) mapTopic(topic string, dir BridgeDirection) (string, proto.QosLevel, bool) {
+	for _, t := range b.Topics {
+		if t.Direction&dir == 0 {
+			continue
+		}
+		from, to := t.LocalPrefix, t.RemotePrefix
+		if dir == BridgeIn {
+			from, to = to, from
+		}
+		if !strings.HasPrefix(topic, from) {
+			continue
+		}
+		rest := topic[len(from):]
+		if newWild(t.Pattern).matches(strings.Split(rest, "/")) {
+			return to + rest, t.Qos, true
+		}
+	}
+	return "", 0, false
+}
+
+// Make a copy of m to pass across the bridge on topic, with a QoS level
+// of at most qos.
+func bridged(m *proto.Publish, topic string, qos proto.QosLevel) *proto.Publish {
+	msg := *m
+	msg.Header.DupFlag = false
+	if msg.Header.QosLevel > qos {
+		msg.Header.QosLevel = qos
+	}
+	msg.MessageId = 0
+	msg.TopicName = topic
+	return &msg
+}
+
+// The key under which we remember a message, to spot its echo.
+func echoKey(m *proto.Publish) string {
+	var buf bytes.Buffer
+	buf.WriteString(m.TopicName)
+	buf.WriteByte(0)
+	m.Payload.WritePayload(&buf)
+	return buf.String()
+}
+
+// Keep connecting to the remote broker, and passing messages both ways
+// while connected, until the Bridge is stopped or the Server goes away.
+func (b *Bridge) run() {
+	defer func() {
+		b.local.Disconnect()
+		close(b.done)
+	}()
+
+	delay := b.ReconnectDelay
+	for {
+		remote, err := b.connect()
+		if err != nil {
+			b.svr.logger().Printf("bridge %v: %v", b.addr, err)
+		} else {
+			b.svr.logger().Printf("bridge %v: connected", b.addr)
+			delay = b.ReconnectDelay
+			if !b.forward(remote) {
+				return
+			}
+			b.svr.logger().Printf("bridge %v: connection lost", b.addr)
+		}
+
+		// Wait before trying again, throwing away what is published
+		// locally meanwhile.
+		retry := time.After(delay)
+	wait:
+		for {
+			select {
+			case _, ok := <-b.local.Incoming:
+				if !ok {
+					return
+				}
+			case <-retry:
+				break wait
+			case <-b.stop:
+				return
+			}
+		}
+		if delay *= 2; delay > b.MaxReconnectDelay {
+			delay = b.MaxReconnectDelay
+		}
+	}
+}
+
+// Connect to the remote broker, and subscribe to the topics bridged in.
+func (b *Bridge) connect() (*ClientConn, error) {
+	conn, err := b.Dial()
+	if err != nil {
+		return nil, err
+	}
+	remote := NewClientConn(conn)
+	remote.ClientId = b.ClientId
+	remote.Version = b.Version
+	remote.KeepAlive = b.KeepAlive
+	remote.Dump = b.Dump
+	remote.Logger = b.svr.logger()
+
+	// Do not wait forever for the acks.
+	ctx, cancel := context.WithTimeout(context.Background(), bridgeConnectTimeout)
+	defer cancel()
+	if err := remote.ConnectContext(ctx, b.Username, b.Password); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if len(b.subscriptions(BridgeIn)) > 0 {
+		if _, err := remote.subscribe(ctx, b.subscribe(remote, BridgeIn)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	b.echoes = make(map[string]int)
+	return remote, nil
+}
+
+// Pass messages across the bridge until the connection to the remote
+// broker is lost, and return true, or until the Bridge should stop,
+// and return false.
+func (b *Bridge) forward(remote *ClientConn) bool {
+	for {
+		select {
+		case m, ok := <-b.local.Incoming:
+			if !ok {
+				remote.Disconnect()
+				return false
+			}
+			topic, qos, ok := b.mapTopic(m.TopicName, BridgeOut)
+			if !ok {
+				continue
+			}
+			msg := bridged(m, topic, qos)
+			if remote.Version != Version5 {
+				if _, _, ok := b.mapTopic(topic, BridgeIn); ok {
+					if len(b.echoes) >= maxEchoes {
+						b.echoes = make(map[string]int)
+					}
+					b.echoes[echoKey(msg)]++
+				}
+			}
+			remote.Publish(msg)
+
+		case m, ok := <-remote.Incoming:
+			if !ok {
+				return true
+			}
+			if remote.Version != Version5 {
+				key := echoKey(m)
+				if n := b.echoes[key]; n > 0 {
+					if n == 1 {
+						delete(b.echoes, key)
+					} else {
+						b.echoes[key] = n - 1
+					}
+					continue
+				}
+			}
+			if topic, qos, ok := b.mapTopic(m.TopicName, BridgeIn); ok {
+				b.local.Publish(bridged(m, topic, qos))
+			}
+
+		case <-b.stop:
+			remote.Disconnect()
+			return false
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package mqtt
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestParseBridgeTopic(t *testing.T) {
+	tests := []struct {
+		in   string
+		want BridgeTopic
+		ok   bool
+	}{
+		{"a/#", BridgeTopic{Pattern: "a/#", Direction: BridgeOut}, true},
+		{"a/# in", BridgeTopic{Pattern: "a/#", Direction: BridgeIn}, true},
+		{"a/# both local/", BridgeTopic{Pattern: "a/#", Direction: BridgeBoth, LocalPrefix: "local/"}, true},
+		{`a/# out "" edge/`, BridgeTopic{Pattern: "a/#", Direction: BridgeOut, RemotePrefix: "edge/"}, true},
+		{"", BridgeTopic{}, false},
+		{"a/# sideways", BridgeTopic{}, false},
+		{"a/# in 1", BridgeTopic{Pattern: "a/#", Direction: BridgeIn, Qos: proto.QosAtLeastOnce}, true},
+		{`a/# out 2 "" edge/`, BridgeTopic{Pattern: "a/#", Direction: BridgeOut, Qos: proto.QosExactlyOnce, RemotePrefix: "edge/"}, true},
+		{"a b c d e", BridgeTopic{}, false},
+		{"a b 1 c d e", BridgeTopic{}, false},
+	}
+	for _, test := range tests {
+		got, err := ParseBridgeTopic(test.in)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("%q: got %v, %v", test.in, got, err)
+		}
+	}
+}
+
+func TestMapTopic(t *testing.T) {
+	b := &Bridge{Topics: []BridgeTopic{
+		{Pattern: "sensors/#", Direction: BridgeOut, RemotePrefix: "edge/"},
+		{Pattern: "cmd/+", Direction: BridgeIn, LocalPrefix: "local/", RemotePrefix: "edge/"},
+		{Pattern: "both", Direction: BridgeBoth},
+	}}
+	tests := []struct {
+		topic string
+		dir   BridgeDirection
+		want  string
+	}{
+		{"sensors/a/b", BridgeOut, "edge/sensors/a/b"},
+		{"edge/sensors/a", BridgeIn, ""},
+		{"edge/cmd/x", BridgeIn, "local/cmd/x"},
+		{"edge/cmd/x/y", BridgeIn, ""},
+		{"local/cmd/x", BridgeOut, ""},
+		{"both", BridgeOut, "both"},
+		{"both", BridgeIn, "both"},
+	}
+	for _, test := range tests {
+		got, _, _ := b.mapTopic(test.topic, test.dir)
+		if got != test.want {
+			t.Errorf("%v %v: got %q, want %q", test.topic, test.dir, got, test.want)
+		}
+	}
+}
+
+// A dialer which connects to a Server through a net.Pipe, and which can
+// break the connection.
+type pipeDialer struct {
+	svr   *Server
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (d *pipeDialer) dial() (net.Conn, error) {
+	cli, srv := net.Pipe()
+	c := d.svr.newIncomingConn(srv)
+	d.svr.stats.clientConnect()
+	c.start()
+	d.mu.Lock()
+	d.conns = append(d.conns, cli)
+	d.mu.Unlock()
+	return cli, nil
+}
+
+func (d *pipeDialer) hangUp() {
+	d.mu.Lock()
+	d.conns[len(d.conns)-1].Close()
+	d.mu.Unlock()
+}
+
+// Wait until something is subscribed to topic.
+func waitSubscribed(t *testing.T, svr *Server, topic string) {
+	for start := time.Now(); len(svr.subs.subscribers(topic)) == 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("no subscription to ", topic)
+		}
+	}
+}
+
+func TestBridgeStop(t *testing.T) {
+	stopped := func(b *Bridge) {
+		done := make(chan struct{})
+		go func() {
+			b.Stop()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Stop did not return")
+		}
+	}
+
+	// Never started.
+	svr := NewServer(nil)
+	stopped(NewBridge(svr, "remote"))
+
+	// Failed to start.
+	b := NewBridge(svr, "remote")
+	b.Topics = []BridgeTopic{{Pattern: "a/#/b"}}
+	if err := b.Start(); err == nil {
+		t.Fatal("bad topic accepted")
+	}
+	stopped(b)
+}
+
+func TestBridge(t *testing.T) {
+	for _, version := range []uint8{Version31, Version5} {
+		local, remote := NewServer(nil), NewServer(nil)
+		d := &pipeDialer{svr: remote}
+		b := NewBridge(local, "remote")
+		b.ClientId = "edge"
+		b.Version = version
+		b.Dial = d.dial
+		b.ReconnectDelay = 10 * time.Millisecond
+		b.Topics = []BridgeTopic{
+			{Pattern: "sensors/#", Direction: BridgeOut, RemotePrefix: "edge/"},
+			{Pattern: "cmd/#", Direction: BridgeIn, RemotePrefix: "edge/"},
+			{Pattern: "both/#", Direction: BridgeBoth},
+			{Pattern: "alarm/#", Direction: BridgeOut, Qos: proto.QosAtLeastOnce},
+		}
+		if err := b.Start(); err != nil {
+			t.Fatal(err)
+		}
+		waitSubscribed(t, remote, "edge/cmd/x")
+
+		lc := newTestClient(t, local, "lc")
+		lc.subscribe("cmd/#", proto.QosAtMostOnce)
+		lc.subscribe("both/#", proto.QosAtMostOnce)
+		rc := newTestClient(t, remote, "rc")
+		rc.subscribe("edge/#", proto.QosAtMostOnce)
+		rc.subscribe("both/#", proto.QosAtMostOnce)
+		rc.subscribe("alarm/#", proto.QosExactlyOnce)
+
+		expect := func(tc *testClient, topic, payload string) {
+			m, ok := tc.recv().(*proto.Publish)
+			if !ok || m.TopicName != topic || string(m.Payload.(proto.BytesPayload)) != payload {
+				t.Fatalf("version %v: expected %v on %v, got %v", version, payload, topic, m)
+			}
+		}
+		publish := func(tc *testClient, topic, payload string) {
+			tc.send(&proto.Publish{TopicName: topic, Payload: proto.BytesPayload(payload)})
+		}
+
+		// Out, with a prefix added...
+		publish(lc, "sensors/t", "20")
+		expect(rc, "edge/sensors/t", "20")
+
+		// ...and in, with it taken away.
+		publish(rc, "edge/cmd/x", "go")
+		expect(rc, "edge/cmd/x", "go")
+		expect(lc, "cmd/x", "go")
+
+		// Messages on topics bridged both ways do not come back.
+		publish(lc, "both/a", "1")
+		expect(lc, "both/a", "1")
+		expect(rc, "both/a", "1")
+		publish(rc, "both/b", "2")
+		expect(rc, "both/b", "2")
+		expect(lc, "both/b", "2")
+		publish(lc, "both/c", "3")
+		expect(lc, "both/c", "3")
+		expect(rc, "both/c", "3")
+
+		// Messages keep their QoS level, up to that of the bridged topic.
+		lc.send(&proto.Publish{Header: header(dupFalse, proto.QosExactlyOnce, retainFalse), MessageId: 1, TopicName: "alarm/fire", Payload: proto.BytesPayload("!")})
+		if m, ok := lc.recv().(*proto.PubRec); !ok {
+			t.Fatalf("version %v: expected PUBREC, got %v", version, m)
+		}
+		lc.send(&proto.PubRel{MessageId: 1})
+		if m, ok := lc.recv().(*proto.PubComp); !ok {
+			t.Fatalf("version %v: expected PUBCOMP, got %v", version, m)
+		}
+		m, ok := rc.recv().(*proto.Publish)
+		if !ok || m.TopicName != "alarm/fire" || m.QosLevel != proto.QosAtLeastOnce {
+			t.Fatalf("version %v: expected QoS 1 PUBLISH on alarm/fire, got %v", version, m)
+		}
+		rc.send(&proto.PubAck{MessageId: m.MessageId})
+		lc.send(&proto.Publish{Header: header(dupFalse, proto.QosAtLeastOnce, retainFalse), MessageId: 2, TopicName: "sensors/t", Payload: proto.BytesPayload("19")})
+		if m, ok := lc.recv().(*proto.PubAck); !ok {
+			t.Fatalf("version %v: expected PUBACK, got %v", version, m)
+		}
+		if m, ok := rc.recv().(*proto.Publish); !ok || m.TopicName != "edge/sensors/t" || m.QosLevel != proto.QosAtMostOnce {
+			t.Fatalf("version %v: expected QoS 0 PUBLISH on edge/sensors/t, got %v", version, m)
+		}
+
+		// The bridge comes back after losing its connection.
+		d.hangUp()
+		time.Sleep(50 * time.Millisecond)
+		waitSubscribed(t, remote, "edge/cmd/x")
+		publish(lc, "sensors/t", "21")
+		expect(rc, "edge/sensors/t", "21")
+
+		b.Stop()
+		lc.disconnect()
+		rc.disconnect()
+	}
+}
+
+func TestBridgeKeepAlive(t *testing.T) {
+	svr := NewServer(nil)
+	b := NewBridge(svr, "remote")
+	dialed := make(chan *testClient, 1)
+	b.Dial = func() (net.Conn, error) {
+		cli, srv := net.Pipe()
+		dialed <- &testClient{t: t, conn: srv}
+		return cli, nil
+	}
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop()
+
+	tc := <-dialed
+	defer tc.conn.Close()
+	if m, ok := tc.recv().(*proto.Connect); !ok || m.KeepAliveTimer != 60 {
+		t.Fatalf("expected CONNECT with a keepalive of 60, got %v", m)
+	}
+}
@@ -0,0 +1,112 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A Capture writes the messages a Server or ClientConn sends and
+// receives to a file (or any io.Writer), for looking at, or replaying,
+// later. Each message is one line of JSON, holding a CaptureRecord.
+// One Capture may be shared by many Servers and ClientConns.
+type Capture struct {
+	mu  sync.Mutex // guards access to enc, and the writer under it
+	enc *json.Encoder
+	err error // the first error writing, after which nothing more is written
+}
+
+// NewCapture returns a Capture which writes to w.
+func NewCapture(w io.Writer) *Capture {
+	return &Capture{enc: json.NewEncoder(w)}
+}
+
+// Err returns the first error there was writing the capture, if any.
+func (cp *Capture) Err() error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return cp.err
+}
+
+// A CaptureRecord is one message in a capture.
+type CaptureRecord struct {
+	Time     time.Time
+	Dir      string // "in" or "out", from the point of view of the Server or ClientConn
+	ClientId string
+	Version  uint8  // the protocol version the message is in, Version31, Version311 or Version5
+	Message  string // the message, as Dump shows it
+	Packet   []byte // the message, as it went over the wire
+}
+
+// Decode returns the message in the record.
+func (r *CaptureRecord) Decode() (proto.Message, error) {
+	if r.Version == Version5 {
+		p, err := read5(bytes.NewReader(r.Packet), maxRemaining)
+		if err != nil {
+			return nil, err
+		}
+		return p.m, nil
+	}
+	return proto.DecodeOneMessage(bytes.NewReader(r.Packet), nil)
+}
+
+func (cp *Capture) record(dir, clientId string, version uint8, m message) {
+	m = redact(m)
+	var buf bytes.Buffer
+	if err := m.Encode(&buf); err != nil {
+		return
+	}
+	r := CaptureRecord{
+		Time:     time.Now(),
+		Dir:      dir,
+		ClientId: clientId,
+		Version:  version,
+		Message:  dumpString(m),
+		Packet:   buf.Bytes(),
+	}
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.err == nil {
+		cp.err = cp.enc.Encode(r)
+	}
+}
+
+// A copy of m without the password, if it is a CONNECT with one, so
+// that dumps and captures do not give away passwords.
+func redact(m message) message {
+	c, ok := unwrap(m).(*proto.Connect)
+	if !ok || c.Password == "" {
+		return m
+	}
+	res := *c
+	res.Password = ""
+	if p, ok := m.(*packet5); ok {
+		p5 := *p
+		p5.m = &res
+		return &p5
+	}
+	return &res
+}
+
+// ReadCapture reads the records of a capture written by a Capture.
+func ReadCapture(r io.Reader) ([]CaptureRecord, error) {
+	var records []CaptureRecord
+	dec := json.NewDecoder(r)
+	for {
+		var rec CaptureRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, fmt.Errorf("capture: record %v: %v", len(records)+1, err)
+		}
+		records = append(records, rec)
+	}
+}
@@ -0,0 +1,131 @@
+package mqtt
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestCapture(t *testing.T) {
+	svr := NewServer(nil)
+	var svrBuf, cliBuf, dumpBuf syncBuffer
+	svr.Capture = NewCapture(&svrBuf)
+	cliCapture := NewCapture(&cliBuf)
+
+	for _, v := range []uint8{Version31, Version5} {
+		cli, srv := net.Pipe()
+		c := svr.newIncomingConn(srv)
+		svr.stats.clientConnect()
+		c.start()
+
+		cc := NewClientConn(cli)
+		cc.ClientId = fmt.Sprint("cap", v)
+		cc.Version = v
+		cc.Capture = cliCapture
+		cc.Dump = true
+		cc.Logger = log.New(&dumpBuf, "", 0)
+		if err := cc.Connect("user", "secret"); err != nil {
+			t.Fatalf("version %v: %v", v, err)
+		}
+		cc.Subscribe([]proto.TopicQos{{Topic: "cap", Qos: proto.QosAtMostOnce}})
+		cc.Publish(&proto.Publish{TopicName: "cap", Payload: proto.BytesPayload("x")})
+		select {
+		case <-cc.Incoming:
+		case <-time.After(time.Second):
+			t.Fatalf("version %v: message did not arrive", v)
+		}
+		cc.Disconnect()
+	}
+
+	// The messages can be decoded again from the capture, whichever
+	// version they were in.
+	type rec struct {
+		dir, id, msg string
+	}
+	read := func(buf *syncBuffer) map[rec]bool {
+		records, err := ReadCapture(strings.NewReader(buf.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[rec]bool)
+		for _, r := range records {
+			m, err := r.Decode()
+			if err != nil {
+				t.Fatalf("%v: %v", r.Message, err)
+			}
+			if r.Time.IsZero() {
+				t.Errorf("%v: no time", r.Message)
+			}
+			if c, ok := m.(*proto.Connect); ok && c.Password != "" || strings.Contains(r.Message, "secret") {
+				t.Errorf("%v: password captured", r.Message)
+			}
+			msg := fmt.Sprintf("%T", m)
+			if p, ok := m.(*proto.Publish); ok {
+				msg += " " + p.TopicName
+			}
+			got[rec{r.Dir, r.ClientId, msg}] = true
+		}
+		return got
+	}
+	if got := dumpBuf.String(); !strings.Contains(got, "*mqtt.Connect") || strings.Contains(got, "secret") {
+		t.Errorf("bad CONNECT dump in %q", got)
+	}
+	svrRecs, cliRecs := read(&svrBuf), read(&cliBuf)
+	for _, id := range []string{"cap3", "cap5"} {
+		for _, want := range []rec{
+			{"in", id, "*mqtt.Connect"},
+			{"in", id, "*mqtt.Publish cap"},
+			{"out", id, "*mqtt.Publish cap"},
+		} {
+			if !svrRecs[want] {
+				t.Errorf("server capture missing %v", want)
+			}
+		}
+		for _, want := range []rec{
+			{"out", id, "*mqtt.Connect"},
+			{"out", id, "*mqtt.Publish cap"},
+			{"in", id, "*mqtt.Publish cap"},
+		} {
+			if !cliRecs[want] {
+				t.Errorf("client capture missing %v", want)
+			}
+		}
+	}
+}
+
+// A client id given by an MQTT 5 server is taken up while the reader may
+// be capturing the messages which follow the CONNACK.
+func TestCaptureAssignedId(t *testing.T) {
+	cli, s := net.Pipe()
+	cc := NewClientConn(cli)
+	cc.Version = Version5
+	var buf syncBuffer
+	cc.Capture = NewCapture(&buf)
+	srv := &testClient{t: t, conn: s}
+	done := make(chan error)
+	go func() { done <- cc.Connect("", "") }()
+	srv.recv5()
+	srv.send5(&packet5{
+		m:     &proto.ConnAck{ReturnCode: proto.RetCodeAccepted},
+		props: properties{{id: propAssignedClientId, s: "auto-1"}},
+	})
+	srv.send5(&packet5{m: &proto.Publish{TopicName: "a", Payload: proto.BytesPayload("x")}})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	<-cc.Incoming
+
+	cc.mu.Lock()
+	id := cc.ClientId
+	cc.mu.Unlock()
+	if id != "auto-1" {
+		t.Errorf("client id %q, want auto-1", id)
+	}
+	s.Close()
+	<-cc.done
+}
@@ -0,0 +1,189 @@
+package mqtt
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func shortContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 50*time.Millisecond)
+}
+
+func TestClientContext(t *testing.T) {
+	// No CONNACK.
+	cli, s := net.Pipe()
+	cc := NewClientConn(cli)
+	srv := &testClient{t: t, conn: s}
+	go srv.recv()
+	ctx, cancel := shortContext()
+	defer cancel()
+	if err := cc.ConnectContext(ctx, "", ""); err != context.DeadlineExceeded {
+		t.Errorf("Connect: got %v", err)
+	}
+	// Nobody reads the DISCONNECT.
+	ctx, cancel = shortContext()
+	defer cancel()
+	if err := cc.DisconnectContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Disconnect: got %v", err)
+	}
+	s.Close()
+	<-cc.done
+
+	// No SUBACK, UNSUBACK or PUBACK.
+	cc, srv = fakeServer(t)
+	ctx, cancel = shortContext()
+	defer cancel()
+	go srv.recv()
+	if _, err := cc.SubscribeContext(ctx, []proto.TopicQos{{Topic: "a", Qos: proto.QosAtMostOnce}}); err != context.DeadlineExceeded {
+		t.Errorf("Subscribe: got %v", err)
+	}
+	ctx, cancel = shortContext()
+	defer cancel()
+	go srv.recv()
+	if _, err := cc.UnsubscribeContext(ctx, []string{"a"}); err != context.DeadlineExceeded {
+		t.Errorf("Unsubscribe: got %v", err)
+	}
+	ctx, cancel = shortContext()
+	defer cancel()
+	go srv.recv()
+	m := &proto.Publish{
+		Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+		TopicName: "a",
+		Payload:   proto.BytesPayload("x"),
+	}
+	if err := cc.PublishContext(ctx, m); err != context.DeadlineExceeded {
+		t.Errorf("Publish: got %v", err)
+	}
+	disconnectFake(cc, srv)
+
+	if _, err := cc.SubscribeContext(context.Background(), nil); err != ErrClientClosed {
+		t.Errorf("Subscribe after Disconnect: got %v", err)
+	}
+}
+
+func TestClientAckIds(t *testing.T) {
+	cc, srv := fakeServer(t)
+
+	// Two SUBSCRIBEs at once, acked the other way round.
+	type result struct {
+		topic string
+		ack   *proto.SubAck
+	}
+	results := make(chan result)
+	for _, topic := range []string{"a", "b"} {
+		go func(topic string) {
+			ack, err := cc.SubscribeContext(context.Background(), []proto.TopicQos{{Topic: topic, Qos: proto.QosAtLeastOnce}})
+			if err != nil {
+				t.Error(err)
+			}
+			results <- result{topic, ack}
+		}(topic)
+	}
+	var subs []*proto.Subscribe
+	for i := 0; i < 2; i++ {
+		m, ok := srv.recv().(*proto.Subscribe)
+		if !ok || m.MessageId == 0 {
+			t.Fatalf("bad SUBSCRIBE %v", m)
+		}
+		subs = append(subs, m)
+	}
+	if subs[0].MessageId == subs[1].MessageId {
+		t.Fatalf("both SUBSCRIBEs have message id %v", subs[0].MessageId)
+	}
+	qos := map[string]proto.QosLevel{"a": proto.QosAtMostOnce, "b": proto.QosExactlyOnce}
+	for i := 1; i >= 0; i-- {
+		srv.send(&proto.SubAck{
+			MessageId: subs[i].MessageId,
+			TopicsQos: []proto.QosLevel{qos[subs[i].Topics[0].Topic]},
+		})
+	}
+	for i := 0; i < 2; i++ {
+		r := <-results
+		if r.ack == nil || len(r.ack.TopicsQos) != 1 || r.ack.TopicsQos[0] != qos[r.topic] {
+			t.Errorf("%v: got %v", r.topic, r.ack)
+		}
+	}
+
+	// An ack for nothing is ignored.
+	srv.send(&proto.UnsubAck{MessageId: 999})
+	done := make(chan *proto.UnsubAck)
+	go func() {
+		done <- cc.Unsubscribe([]string{"a"})
+	}()
+	m, ok := srv.recv().(*proto.Unsubscribe)
+	if !ok {
+		t.Fatalf("expected UNSUBSCRIBE, got %v", m)
+	}
+	srv.send(&proto.UnsubAck{MessageId: m.MessageId})
+	if ack := <-done; ack == nil || ack.MessageId != m.MessageId {
+		t.Errorf("got %v", ack)
+	}
+
+	disconnectFake(cc, srv)
+}
+
+func TestClientRequestLost(t *testing.T) {
+	cc, srv := fakeServer(t)
+	cc.ReconnectDelay = 10 * time.Millisecond
+	dialed := make(chan *testClient, 1)
+	cc.Dial = func() (net.Conn, error) {
+		cli, s := net.Pipe()
+		dialed <- &testClient{t: t, conn: s}
+		return cli, nil
+	}
+
+	// The connection is lost between the SUBSCRIBE and the SUBACK.
+	done := make(chan error)
+	go func() {
+		_, err := cc.SubscribeContext(context.Background(), []proto.TopicQos{{Topic: "a", Qos: proto.QosAtMostOnce}})
+		done <- err
+	}()
+	if m, ok := srv.recv().(*proto.Subscribe); !ok {
+		t.Fatalf("expected SUBSCRIBE, got %v", m)
+	}
+	srv.conn.Close()
+	select {
+	case err := <-done:
+		if err != ErrConnectionLost {
+			t.Errorf("Subscribe: got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Subscribe still waiting")
+	}
+
+	// Nothing is subscribed to again on reconnecting.
+	srv = <-dialed
+	if _, ok := srv.recv().(*proto.Connect); !ok {
+		t.Fatal("expected CONNECT")
+	}
+	srv.send(&proto.ConnAck{ReturnCode: proto.RetCodeAccepted})
+
+	// And the same for UNSUBSCRIBE.
+	go func() {
+		_, err := cc.UnsubscribeContext(context.Background(), []string{"a"})
+		done <- err
+	}()
+	if m, ok := srv.recv().(*proto.Unsubscribe); !ok {
+		t.Fatalf("expected UNSUBSCRIBE, got %v", m)
+	}
+	srv.conn.Close()
+	select {
+	case err := <-done:
+		if err != ErrConnectionLost {
+			t.Errorf("Unsubscribe: got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Unsubscribe still waiting")
+	}
+
+	srv = <-dialed
+	if _, ok := srv.recv().(*proto.Connect); !ok {
+		t.Fatal("expected CONNECT")
+	}
+	srv.send(&proto.ConnAck{ReturnCode: proto.RetCodeAccepted})
+	disconnectFake(cc, srv)
+}
@@ -0,0 +1,142 @@
+package mqtt
+
+import (
+	"errors"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A Hook is called by a Server as clients connect, subscribe,
+// unsubscribe, publish and disconnect, so that it can rewrite, enrich
+// or refuse what they do. A Hook which only cares about some of them
+// can embed HookBase for the rest.
+//
+// The hooks added to a Server are called in the order they were
+// added, each with what the one before returned, until one returns an
+// error, which vetoes the operation. The ClientInfo is the one the
+// client connected with, after the Authenticator has seen it; it is
+// nil for messages the server publishes itself, such as the $SYS
+// stats. Hooks are called from many goroutines at once.
+type Hook interface {
+	// OnConnect is called when a client connects, after the
+	// Authenticator (if any) has accepted it. It may change the
+	// Backpressure policy of the client, as an Authenticator may. An
+	// error refuses the connection as not authorized.
+	OnConnect(ci *ClientInfo) error
+
+	// OnSubscribe is called for each topic filter in a SUBSCRIBE, and
+	// returns the filter and QoS level to subscribe with, which are
+	// then checked by the Authorizer (if any). An error refuses the
+	// subscription as not authorized.
+	OnSubscribe(ci *ClientInfo, tq proto.TopicQos) (proto.TopicQos, error)
+
+	// OnUnsubscribe is called for each topic filter in an UNSUBSCRIBE,
+	// and returns the filter to unsubscribe from. An error leaves the
+	// subscription in place.
+	OnUnsubscribe(ci *ClientInfo, filter string) (string, error)
+
+	// OnPublish is called for each message published, by clients
+	// (including their wills) and by the server, just before it is
+	// sent to the subscribers and retained. It returns the message to
+	// send in its place, which may be m itself. An error, or a nil
+	// message, means the message is dropped. The client has already
+	// been sent its acks by then.
+	OnPublish(ci *ClientInfo, m *proto.Publish) (*proto.Publish, error)
+
+	// OnDisconnect is called when a client that connected goes away;
+	// graceful is true if it sent a DISCONNECT. It cannot be vetoed,
+	// but the will, if any, goes through OnPublish as usual.
+	OnDisconnect(ci *ClientInfo, graceful bool)
+}
+
+// HookBase implements Hook, letting everything through as it is.
+type HookBase struct{}
+
+func (HookBase) OnConnect(ci *ClientInfo) error { return nil }
+func (HookBase) OnSubscribe(ci *ClientInfo, tq proto.TopicQos) (proto.TopicQos, error) {
+	return tq, nil
+}
+func (HookBase) OnUnsubscribe(ci *ClientInfo, filter string) (string, error) { return filter, nil }
+func (HookBase) OnPublish(ci *ClientInfo, m *proto.Publish) (*proto.Publish, error) {
+	return m, nil
+}
+func (HookBase) OnDisconnect(ci *ClientInfo, graceful bool) {}
+
+var errHookTopic = errors.New("hook gave a topic with wildcards")
+
+// AddHook adds a Hook to the end of the Server's chain of hooks. It
+// may be called while the Server is running, and takes effect for
+// whatever happens next.
+func (s *Server) AddHook(h Hook) {
+	s.subs.mu.Lock()
+	defer s.subs.mu.Unlock()
+	// The chain is replaced rather than appended to in place, so that
+	// it can be used without holding mu.
+	s.subs.hooks = append(s.subs.hooks[:len(s.subs.hooks):len(s.subs.hooks)], h)
+}
+
+// The hooks as they are now.
+func (s *subscriptions) hookChain() []Hook {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hooks
+}
+
+func (s *subscriptions) onConnect(ci *ClientInfo) error {
+	for _, h := range s.hookChain() {
+		if err := h.OnConnect(ci); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *subscriptions) onSubscribe(ci *ClientInfo, tq proto.TopicQos) (proto.TopicQos, error) {
+	var err error
+	for _, h := range s.hookChain() {
+		if tq, err = h.OnSubscribe(ci, tq); err != nil {
+			return tq, err
+		}
+	}
+	return tq, nil
+}
+
+func (s *subscriptions) onUnsubscribe(ci *ClientInfo, filter string) (string, error) {
+	var err error
+	for _, h := range s.hookChain() {
+		if filter, err = h.OnUnsubscribe(ci, filter); err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
+}
+
+// Run the message in a post through the hooks, returning nil if it is
+// to be dropped.
+func (s *subscriptions) onPublish(tag string, post post) *proto.Publish {
+	var ci *ClientInfo
+	if post.c != nil {
+		ci = &post.c.info
+	}
+	m := post.m
+	var err error
+	for _, h := range s.hookChain() {
+		if m, err = h.OnPublish(ci, m); err != nil || m == nil {
+			break
+		}
+	}
+	if err == nil && m != nil && isWildcard(m.TopicName) {
+		err = errHookTopic
+	}
+	if err != nil {
+		s.svr.logger().Printf("%vhook: dropping message to %q: %v", tag, post.m.TopicName, err)
+		return nil
+	}
+	return m
+}
+
+func (s *subscriptions) onDisconnect(ci *ClientInfo, graceful bool) {
+	for _, h := range s.hookChain() {
+		h.OnDisconnect(ci, graceful)
+	}
+}
@@ -0,0 +1,135 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A hook which keeps clients to a namespace.
+type nsHook struct {
+	HookBase
+
+	mu   sync.Mutex
+	gone []string
+}
+
+func (h *nsHook) OnConnect(ci *ClientInfo) error {
+	if ci.ClientId == "bad" {
+		return errors.New("bad client")
+	}
+	return nil
+}
+
+func (h *nsHook) OnSubscribe(ci *ClientInfo, tq proto.TopicQos) (proto.TopicQos, error) {
+	if tq.Topic == "forbidden" {
+		return tq, errors.New("forbidden")
+	}
+	tq.Topic = "ns/" + tq.Topic
+	return tq, nil
+}
+
+func (h *nsHook) OnUnsubscribe(ci *ClientInfo, filter string) (string, error) {
+	if filter == "locked" {
+		return filter, errors.New("locked")
+	}
+	return "ns/" + filter, nil
+}
+
+func (h *nsHook) OnPublish(ci *ClientInfo, m *proto.Publish) (*proto.Publish, error) {
+	if m.TopicName == "ns/secret" {
+		return nil, errors.New("secret")
+	}
+	return m, nil
+}
+
+func (h *nsHook) OnDisconnect(ci *ClientInfo, graceful bool) {
+	h.mu.Lock()
+	h.gone = append(h.gone, fmt.Sprint(ci.ClientId, " ", graceful))
+	h.mu.Unlock()
+}
+
+// A hook which adds a stamp to the messages.
+type stampHook struct {
+	HookBase
+	stamp string
+}
+
+func (h stampHook) OnPublish(ci *ClientInfo, m *proto.Publish) (*proto.Publish, error) {
+	// The $SYS stats have payloads of their own.
+	b, ok := m.Payload.(proto.BytesPayload)
+	if !ok {
+		return m, nil
+	}
+	msg := *m
+	msg.Payload = proto.BytesPayload(string(b) + h.stamp)
+	return &msg, nil
+}
+
+func TestHooks(t *testing.T) {
+	svr := NewServer(nil)
+	h := &nsHook{}
+	svr.AddHook(h)
+	svr.AddHook(stampHook{stamp: "!"})
+	svr.AddHook(HookBase{})
+	svr.AddHook(stampHook{stamp: "?"})
+
+	bad := dialTest(t, svr)
+	bad.send(&proto.Connect{ProtocolName: "MQIsdp", ProtocolVersion: 3, ClientId: "bad"})
+	if ack, ok := bad.recv().(*proto.ConnAck); !ok || ack.ReturnCode != proto.RetCodeNotAuthorized {
+		t.Fatalf("expected refusal, got %v", ack)
+	}
+
+	sub := newTestClient(t, svr, "sub")
+	sub.subscribe("a", proto.QosAtMostOnce)
+	sub.subscribe("forbidden", proto.QosAtMostOnce) // MQTT 3.1 cannot say no
+	if n, _ := svr.subs.count(); n != 1 {
+		t.Errorf("got %v subscriptions, want 1", n)
+	}
+
+	// Each hook sees what the one before returned.
+	pub := newTestClient(t, svr, "pub")
+	pub.send(&proto.Publish{TopicName: "ns/secret", Payload: proto.BytesPayload("no")})
+	pub.send(&proto.Publish{TopicName: "ns/a", Payload: proto.BytesPayload("hi")})
+	m, ok := sub.recv().(*proto.Publish)
+	if !ok || m.TopicName != "ns/a" || string(m.Payload.(proto.BytesPayload)) != "hi!?" {
+		t.Fatalf("expected stamped message, got %v", m)
+	}
+
+	for _, topic := range []string{"locked", "a"} {
+		sub.send(&proto.Unsubscribe{
+			Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+			MessageId: 2,
+			Topics:    []string{topic},
+		})
+		if _, ok := sub.recv().(*proto.UnsubAck); !ok {
+			t.Fatal("expected UNSUBACK")
+		}
+	}
+	if n, _ := svr.subs.count(); n != 0 {
+		t.Errorf("got %v subscriptions, want 0", n)
+	}
+
+	// Only clients which connected are seen to disconnect.
+	sub.disconnect()
+	pub.conn.Close()
+	want := []string{"pub false", "sub true"}
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		h.mu.Lock()
+		gone := append([]string(nil), h.gone...)
+		h.mu.Unlock()
+		sort.Strings(gone)
+		if reflect.DeepEqual(gone, want) {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatalf("got disconnects %q, want %q", gone, want)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package mqtt
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// ErrPingTimeout is the error a connection is lost with when the server
+// does not answer a PINGREQ in time.
+var ErrPingTimeout = errors.New("mqtt: no PINGRESP from server")
+
+// The longest keepalive the CONNECT has room for.
+const maxKeepAlive = 0xffff * time.Second
+
+// The keepalive interval to put in the CONNECT, in seconds, rounded up.
+func keepAliveTimer(d time.Duration) uint16 {
+	if d <= 0 {
+		return 0
+	}
+	if d > maxKeepAlive {
+		d = maxKeepAlive
+	}
+	return uint16((d + time.Second - 1) / time.Second)
+}
+
+// A keepalive follows one connection of a ClientConn, to tell when it
+// has been idle for too long, and when the server answers a ping.
+type keepalive struct {
+	sent int64 // when the writer last wrote, in UnixNano, using sync/atomic
+	pong chan struct{}
+}
+
+func newKeepalive() *keepalive {
+	return &keepalive{sent: time.Now().UnixNano(), pong: make(chan struct{}, 1)}
+}
+
+// Called by the writer after each message it writes.
+func (k *keepalive) wrote() {
+	atomic.StoreInt64(&k.sent, time.Now().UnixNano())
+}
+
+// Called by the reader for each PINGRESP.
+func (k *keepalive) ponged() {
+	select {
+	case k.pong <- struct{}{}:
+	default:
+	}
+}
+
+func (k *keepalive) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&k.sent)))
+}
+
+// Once Connect has succeeded, send a PINGREQ whenever nothing has been
+// sent to the server for KeepAlive, and close the connection if the
+// PINGRESP does not come back within PingTimeout. Returns when gone is
+// closed, with ErrPingTimeout if it was the one to close the
+// connection.
+func (c *ClientConn) ping(conn net.Conn, k *keepalive, gone chan struct{}) error {
+	select {
+	case <-c.connected:
+	case <-gone:
+		return nil
+	}
+	if c.KeepAlive <= 0 {
+		return nil
+	}
+	timeout := c.PingTimeout
+	if timeout <= 0 {
+		timeout = c.KeepAlive
+	}
+
+	t := time.NewTimer(c.KeepAlive)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-gone:
+			return nil
+		}
+		if idle := k.idle(); idle < c.KeepAlive {
+			t.Reset(c.KeepAlive - idle)
+			continue
+		}
+
+		select {
+		case <-k.pong:
+		default:
+		}
+		// If the server has stopped reading, there may not even be
+		// room to queue the PINGREQ, which counts against the
+		// timeout too.
+		expired := time.After(timeout)
+		select {
+		case c.out <- job{m: c.packet(&proto.PingReq{})}:
+		case <-expired:
+			return c.pingTimedOut(conn)
+		case <-gone:
+			return nil
+		}
+		select {
+		case <-k.pong:
+			t.Reset(c.KeepAlive)
+		case <-expired:
+			return c.pingTimedOut(conn)
+		case <-gone:
+			return nil
+		}
+	}
+}
+
+// Give up on a connection the server has stopped answering.
+func (c *ClientConn) pingTimedOut(conn net.Conn) error {
+	c.logger().Print("cli keepalive: ", ErrPingTimeout)
+	conn.Close()
+	return ErrPingTimeout
+}
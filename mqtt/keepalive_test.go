@@ -0,0 +1,122 @@
+package mqtt
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestKeepAliveTimer(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want uint16
+	}{
+		{0, 0},
+		{-time.Second, 0},
+		{time.Millisecond, 1},
+		{30 * time.Second, 30},
+		{1500 * time.Millisecond, 2},
+		{24 * time.Hour, 0xffff},
+	}
+	for _, test := range tests {
+		if got := keepAliveTimer(test.d); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.d, got, test.want)
+		}
+	}
+}
+
+func TestClientKeepAlive(t *testing.T) {
+	cli, s := net.Pipe()
+	cc := NewClientConn(cli)
+	cc.KeepAlive = 50 * time.Millisecond
+	type change struct {
+		state ConnState
+		err   error
+	}
+	changes := make(chan change, 10)
+	cc.StateChanged = func(state ConnState, err error) {
+		changes <- change{state, err}
+	}
+	srv := &testClient{t: t, conn: s}
+	done := make(chan error)
+	go func() { done <- cc.Connect("", "") }()
+	m, ok := srv.recv().(*proto.Connect)
+	if !ok || m.KeepAliveTimer != 1 {
+		t.Fatalf("bad CONNECT %v", m)
+	}
+	srv.send(&proto.ConnAck{ReturnCode: proto.RetCodeAccepted})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Pinged while idle, for as long as the server answers.
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		if m, ok := srv.recv().(*proto.PingReq); !ok {
+			t.Fatalf("expected PINGREQ, got %v", m)
+		}
+		if d := time.Since(start); d < 25*time.Millisecond {
+			t.Errorf("pinged after %v", d)
+		}
+		srv.send(&proto.PingResp{})
+	}
+
+	// And then it does not.
+	if m, ok := srv.recv().(*proto.PingReq); !ok {
+		t.Fatalf("expected PINGREQ, got %v", m)
+	}
+	want := []change{{StateConnected, nil}, {StateDisconnected, ErrPingTimeout}, {StateClosed, nil}}
+	for _, w := range want {
+		select {
+		case got := <-changes:
+			if got != w {
+				t.Errorf("got %v, want %v", got, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no state change, want %v", w)
+		}
+	}
+	if _, ok := <-cc.Incoming; ok {
+		t.Error("Incoming not closed")
+	}
+}
+
+// A server which stops reading is given up on, even though the PINGREQ
+// cannot be queued, let alone sent.
+func TestClientKeepAliveStuck(t *testing.T) {
+	cli, s := net.Pipe()
+	cc := NewClientConn(cli)
+	cc.KeepAlive = 50 * time.Millisecond
+	lost := make(chan error, 10)
+	cc.StateChanged = func(state ConnState, err error) {
+		if state == StateDisconnected {
+			lost <- err
+		}
+	}
+	srv := &testClient{t: t, conn: s}
+	done := make(chan error)
+	go func() { done <- cc.Connect("", "") }()
+	srv.recv()
+	srv.send(&proto.ConnAck{ReturnCode: proto.RetCodeAccepted})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Fill the queue, with nothing read from the other end.
+	go func() {
+		for i := 0; i < clientQueueLength+10; i++ {
+			cc.Publish(&proto.Publish{TopicName: "a", Payload: proto.BytesPayload("x")})
+		}
+	}()
+	select {
+	case err := <-lost:
+		if err != ErrPingTimeout {
+			t.Errorf("lost with %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection not given up on")
+	}
+	<-cc.done
+}
@@ -0,0 +1,113 @@
+package mqtt
+
+import (
+	"errors"
+	"net"
+)
+
+// A ListenerConfig holds the settings for one of the listeners of a
+// Server. The zero value is a listener like any other, which uses the
+// Server's settings.
+type ListenerConfig struct {
+	// The name of the listener, which the Authenticator and hooks can
+	// see in ClientInfo.Listener. Defaults to the listener's address.
+	Name string
+
+	// When true, clients must present a TLS client certificate, or be
+	// refused as not authorized. For this to work, the listener's
+	// tls.Config should ask for certificates, with ClientAuth set to
+	// tls.VerifyClientCertIfGiven or stricter.
+	RequireCert bool
+
+	// When set, these are used for the clients on this listener in
+	// place of the Server's Authenticator and Authorizer.
+	Authenticator Authenticator
+	Authorizer    Authorizer
+}
+
+// A listener is a net.Listener a Server accepts connections from.
+type listener struct {
+	l   net.Listener
+	cfg ListenerConfig
+}
+
+// ErrServerClosed is returned by AddListener once Shutdown has been
+// called.
+var ErrServerClosed = errors.New("mqtt: server closed")
+
+// AddListener makes the Server accept connections from l too, with the
+// given settings. One Server can listen for plain TCP, TLS, unix socket
+// and WebSocket (see ServeWebSocket) connections at once. Listeners may
+// be added before or after Start; those added before are started by
+// Start.
+func (s *Server) AddListener(l net.Listener, cfg ListenerConfig) error {
+	if cfg.Name == "" {
+		cfg.Name = l.Addr().String()
+	}
+	ln := &listener{l: l, cfg: cfg}
+
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	select {
+	case <-s.quit:
+		return ErrServerClosed
+	default:
+	}
+	if wl, ok := l.(*WebSocketListener); ok {
+		wl.svr.Store(s)
+	}
+	s.listeners = append(s.listeners, ln)
+	if s.started {
+		s.serve(ln)
+	}
+	return nil
+}
+
+// Start accepting connections from a listener. Called with listenersMu
+// held.
+func (s *Server) serve(ln *listener) {
+	s.accepting++
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		for {
+			conn, err := ln.l.Accept()
+			if err != nil {
+				select {
+				case <-s.quit:
+				default:
+					s.logger().Printf("Accept on %v: %v", ln.cfg.Name, err)
+				}
+				break
+			}
+
+			cli := s.newIncomingConn(conn)
+			cli.ln = ln
+			s.stats.clientConnect()
+			cli.start()
+		}
+
+		// Done is closed when there is nothing left to accept from.
+		s.listenersMu.Lock()
+		defer s.listenersMu.Unlock()
+		if s.accepting--; s.accepting == 0 {
+			s.doneOnce.Do(func() { close(s.Done) })
+		}
+	}()
+}
+
+// The Authenticator for a client, which may be the listener's.
+func (c *incomingConn) authenticator() Authenticator {
+	if c.ln != nil && c.ln.cfg.Authenticator != nil {
+		return c.ln.cfg.Authenticator
+	}
+	return c.svr.Authenticator
+}
+
+// The Authorizer for a client, which may be the listener's.
+func (c *incomingConn) authorizer() Authorizer {
+	if c.ln != nil && c.ln.cfg.Authorizer != nil {
+		return c.ln.cfg.Authorizer
+	}
+	return c.svr.Authorizer
+}
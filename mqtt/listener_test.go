@@ -0,0 +1,101 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// An Authenticator which lets everyone in, noting which listener they
+// came in on.
+type listenerAuth struct {
+	mu   sync.Mutex
+	seen map[string]string // listener name by client id
+}
+
+func (la *listenerAuth) Authenticate(ci *ClientInfo) proto.ReturnCode {
+	la.mu.Lock()
+	defer la.mu.Unlock()
+	la.seen[ci.ClientId] = ci.Listener
+	return proto.RetCodeAccepted
+}
+
+func TestListeners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqtt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	listen := func(network, addr string) net.Listener {
+		l, err := net.Listen(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	auth := &listenerAuth{seen: make(map[string]string)}
+	svr := NewServer(listen("tcp", "127.0.0.1:0"))
+	svr.Authenticator = auth
+	certs := listen("tcp", "127.0.0.1:0")
+	svr.AddListener(certs, ListenerConfig{Name: "certs", RequireCert: true})
+	svr.Start()
+	// Listeners can be added once the server has started, too.
+	sock := filepath.Join(dir, "sock")
+	unixAuth := &listenerAuth{seen: make(map[string]string)}
+	svr.AddListener(listen("unix", sock), ListenerConfig{Name: "unix", Authenticator: unixAuth})
+
+	tests := []struct {
+		network, addr string
+		err           error
+		auth          *listenerAuth
+		listener      string
+	}{
+		{"tcp", svr.listeners[0].l.Addr().String(), nil, auth, svr.listeners[0].l.Addr().String()},
+		{"tcp", certs.Addr().String(), ConnectionErrors[proto.RetCodeNotAuthorized], auth, ""},
+		{"unix", sock, nil, unixAuth, "unix"},
+	}
+	for i, test := range tests {
+		conn, err := net.Dial(test.network, test.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cc := NewClientConn(conn)
+		cc.ClientId = fmt.Sprint("c", i)
+		if err := cc.Connect("", ""); err != test.err {
+			t.Errorf("%v %v: got %v, want %v", test.network, test.addr, err, test.err)
+		}
+		test.auth.mu.Lock()
+		if got := test.auth.seen[cc.ClientId]; got != test.listener {
+			t.Errorf("%v %v: authenticated on %q, want %q", test.network, test.addr, got, test.listener)
+		}
+		test.auth.mu.Unlock()
+		if test.err == nil {
+			cc.Disconnect()
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := svr.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-svr.Done:
+	default:
+		t.Error("Done not closed")
+	}
+	l := listen("tcp", "127.0.0.1:0")
+	defer l.Close()
+	if err := svr.AddListener(l, ListenerConfig{}); err != ErrServerClosed {
+		t.Errorf("AddListener after Shutdown: got %v", err)
+	}
+}
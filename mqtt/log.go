@@ -0,0 +1,130 @@
+package mqtt
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A Logger is where a Server or ClientConn sends what it logs. A
+// *log.Logger is a Logger. The default is the standard logger of
+// package log.
+type Logger interface {
+	Print(v ...interface{})
+	Printf(format string, v ...interface{})
+}
+
+// The standard logger, found each time, so that log.SetOutput and
+// friends still work.
+type stdLogger struct{}
+
+func (stdLogger) Print(v ...interface{}) { log.Output(2, fmt.Sprint(v...)) }
+func (stdLogger) Printf(format string, v ...interface{}) {
+	log.Output(2, fmt.Sprintf(format, v...))
+}
+
+// The Logger in an atomic.Value, which needs the same concrete type
+// every time.
+type loggerValue struct{ Logger }
+
+// SetLogger sets where the Server logs to. It may be called while the
+// Server is running; nil means the standard logger of package log.
+func (s *Server) SetLogger(l Logger) {
+	s.logTo.Store(loggerValue{l})
+}
+
+// The Logger to use. The server may be nil, for the bits of a Server
+// which are used on their own in tests.
+func (s *Server) logger() Logger {
+	if s != nil {
+		if l, ok := s.logTo.Load().(loggerValue); ok && l.Logger != nil {
+			return l.Logger
+		}
+	}
+	return stdLogger{}
+}
+
+// Trace turns dumping the messages in and out on or off for one
+// client, as Dump does for all of them. It applies to the client if
+// it is connected, and whenever it connects later.
+func (s *Server) Trace(clientId string, on bool) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	if on {
+		if s.traced == nil {
+			s.traced = make(map[string]bool)
+		}
+		s.traced[clientId] = true
+	} else {
+		delete(s.traced, clientId)
+	}
+	if c := s.clients[clientId]; c != nil {
+		c.setTrace(on)
+	}
+}
+
+// Whether a client id is being traced.
+func (s *Server) tracing(clientId string) bool {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	return s.traced[clientId]
+}
+
+func (c *incomingConn) setTrace(on bool) {
+	var n int32
+	if on {
+		n = 1
+	}
+	atomic.StoreInt32(&c.trace, n)
+}
+
+// Dump a message in or out, if the server or this client is being
+// traced, and capture it, if the server is capturing.
+func (c *incomingConn) dump(dir string, m message) {
+	if c.svr.Dump || atomic.LoadInt32(&c.trace) != 0 {
+		c.svr.logger().Printf("dump %3v: %v %v", dir, c.clientid, dumpString(redact(m)))
+	}
+	if c.svr.Capture != nil {
+		// The version is not known until the CONNECT has been read.
+		version := c.version
+		if m, ok := unwrap(m).(*proto.Connect); ok && version == 0 {
+			version = m.ProtocolVersion
+		}
+		c.svr.Capture.record(dir, c.clientid, version, m)
+	}
+}
+
+// Dump a message in or out, if the client is being traced, and capture
+// it, if the client is capturing.
+func (c *ClientConn) dump(dir string, m message) {
+	if c.Dump {
+		c.logger().Printf("dump %3v: %v", dir, dumpString(redact(m)))
+	}
+	if c.Capture != nil {
+		version := c.Version
+		if version == 0 {
+			version = Version31
+		}
+		c.mu.Lock()
+		id := c.ClientId
+		c.mu.Unlock()
+		c.Capture.record(dir, id, version, m)
+	}
+}
+
+func (c *ClientConn) logger() Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return stdLogger{}
+}
+
+// How a message looks in a dump.
+func dumpString(m message) string {
+	if p, ok := m.(*packet5); ok {
+		return p.String()
+	}
+	return fmt.Sprintf("%T %v", m, m)
+}
@@ -0,0 +1,88 @@
+package mqtt
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A bytes.Buffer which can be written by one goroutine while another
+// reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestTrace(t *testing.T) {
+	svr := NewServer(nil)
+	var buf syncBuffer
+	svr.SetLogger(log.New(&buf, "", 0))
+	svr.Trace("traced", true)
+
+	traced := newTestClient(t, svr, "traced")
+	quiet := newTestClient(t, svr, "quiet")
+	ping := func(tc *testClient) {
+		tc.send(&proto.PingReq{})
+		if _, ok := tc.recv().(*proto.PingResp); !ok {
+			t.Fatal("expected PINGRESP")
+		}
+	}
+	ping(traced)
+	ping(quiet)
+	svr.Trace("traced", false)
+	ping(traced)
+
+	got := buf.String()
+	for _, want := range []string{
+		"New client connected from pipe as traced",
+		"dump  in: traced *mqtt.Connect",
+		"dump out: traced *mqtt.ConnAck",
+		"dump  in: traced *mqtt.PingReq",
+		"dump out: traced *mqtt.PingResp",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("log missing %q", want)
+		}
+	}
+	if strings.Contains(got, "dump  in: quiet") {
+		t.Error("untraced client was dumped")
+	}
+	if n := strings.Count(got, "PingReq"); n != 1 {
+		t.Errorf("got %v PINGREQs dumped, want 1", n)
+	}
+
+	// Passwords are not dumped.
+	svr.Trace("pw", true)
+	pw := dialTest(t, svr)
+	pw.send(&proto.Connect{
+		ProtocolName:    "MQIsdp",
+		ProtocolVersion: 3,
+		ClientId:        "pw",
+		CleanSession:    true,
+		UsernameFlag:    true,
+		PasswordFlag:    true,
+		Username:        "user",
+		Password:        "secret",
+	})
+	pw.recv()
+	got = buf.String()
+	if !strings.Contains(got, "dump  in: pw *mqtt.Connect") || strings.Contains(got, "secret") {
+		t.Errorf("bad CONNECT dump in %q", got)
+	}
+}
@@ -0,0 +1,232 @@
+package mqtt
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The upper bounds of the buckets of the latency histograms.
+var latencyBuckets = [...]time.Duration{
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// A histogram counts durations by which of the latencyBuckets they
+// fall in. The fields are updated using sync/atomic.
+type histogram struct {
+	counts [len(latencyBuckets) + 1]int64 // the last is for the ones longer than all the buckets
+	sum    int64                          // in nanoseconds
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return d <= latencyBuckets[i] })
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+// A metric is one of the stats, as it is exported over HTTP.
+type metric struct {
+	name, help string
+	kind       string // counter, gauge or histogram
+	label      string // the name of the label of the samples, if they have one
+	samples    []sample
+}
+
+type sample struct {
+	label string // the value of the label
+	value float64
+
+	// For histograms, the counts in each of the latencyBuckets and
+	// the ones beyond, which add up as they go, as Prometheus wants.
+	buckets [len(latencyBuckets) + 1]int64
+}
+
+func (s *sample) count() int64 { return s.buckets[len(s.buckets)-1] }
+
+func (h *histogram) sample(label string) sample {
+	sm := sample{label: label, value: time.Duration(atomic.LoadInt64(&h.sum)).Seconds()}
+	var n int64
+	for i := range h.counts {
+		n += atomic.LoadInt64(&h.counts[i])
+		sm.buckets[i] = n
+	}
+	return sm
+}
+
+// Gather the stats, as they are now. They are the same as the ones
+// published under $SYS, along with the lengths of the queues and how
+// long the subscription workers are taking.
+func (s *Server) metrics() []metric {
+	st := s.stats
+	one := func(name, kind, help string, n int64) metric {
+		return metric{name: name, kind: kind, help: help, samples: []sample{{value: float64(n)}}}
+	}
+
+	clients := atomic.LoadInt64(&st.clients)
+	clientsMax := atomic.LoadInt64(&st.clientsMax)
+	if clients > clientsMax {
+		clientsMax = clients
+	}
+	connected, disconnected := s.countClients()
+	subscriptions, retained := s.subs.count()
+
+	packets := func(types *[16]int64) (samples []sample) {
+		for i, name := range messageTypeNames {
+			if name != "" {
+				samples = append(samples, sample{label: name, value: float64(atomic.LoadInt64(&types[i]))})
+			}
+		}
+		return
+	}
+
+	// The queue of posts for the workers, and the queues of messages
+	// waiting to be sent to the clients.
+	var queued, queuedMax int64
+	s.clientsMu.Lock()
+	for _, c := range s.clients {
+		n := int64(c.queued())
+		queued += n
+		if n > queuedMax {
+			queuedMax = n
+		}
+	}
+	s.clientsMu.Unlock()
+
+	var latency []sample
+	for i := range s.subs.latency {
+		latency = append(latency, s.subs.latency[i].sample(strconv.Itoa(i)))
+	}
+
+	return []metric{
+		one("mqtt_clients_active", "gauge", "Clients with a connection open.", clients),
+		one("mqtt_clients_maximum", "gauge", "The most clients there have been at once.", clientsMax),
+		one("mqtt_clients_connected", "gauge", "Clients which are connected.", connected),
+		one("mqtt_clients_disconnected", "gauge", "Clients with a session kept while they are not connected.", disconnected),
+		one("mqtt_connections_total", "counter", "Connections ever made.", atomic.LoadInt64(&st.connections)),
+		one("mqtt_messages_received_total", "counter", "Packets received.", atomic.LoadInt64(&st.recv)),
+		one("mqtt_messages_sent_total", "counter", "Packets sent.", atomic.LoadInt64(&st.sent)),
+		{name: "mqtt_packets_received_total", kind: "counter", help: "Packets received, by type.", label: "type", samples: packets(&st.recvTypes)},
+		{name: "mqtt_packets_sent_total", kind: "counter", help: "Packets sent, by type.", label: "type", samples: packets(&st.sentTypes)},
+		one("mqtt_publish_dropped_total", "counter", "Messages dropped because a client or the server could not keep up.", atomic.LoadInt64(&st.dropped)),
+		one("mqtt_bytes_received_total", "counter", "Bytes received.", atomic.LoadInt64(&st.bytesRecv)),
+		one("mqtt_bytes_sent_total", "counter", "Bytes sent.", atomic.LoadInt64(&st.bytesSent)),
+		one("mqtt_subscriptions", "gauge", "Subscriptions.", int64(subscriptions)),
+		one("mqtt_retained_messages", "gauge", "Retained messages.", int64(retained)),
+		one("mqtt_uptime_seconds", "gauge", "Seconds since the server started.", int64(time.Since(st.start)/time.Second)),
+		{name: "mqtt_queue_length", kind: "gauge", help: "Messages waiting in the queue for the subscription workers, and in all the queues for the clients.", label: "queue",
+			samples: []sample{{label: "posts", value: float64(len(s.subs.posts))}, {label: "clients", value: float64(queued)}}},
+		one("mqtt_client_queue_length_max", "gauge", "Messages waiting in the longest queue for a client.", queuedMax),
+		{name: "mqtt_worker_latency_seconds", kind: "histogram", help: "How long the subscription workers take to send out a message.", label: "worker", samples: latency},
+	}
+}
+
+// MetricsHandler returns an http.Handler which serves the stats of
+// the server in the Prometheus text format. The same stats are
+// available from Vars, for expvar.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, s.metrics())
+	})
+}
+
+func writeMetrics(w io.Writer, metrics []metric) {
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %v %v\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %v %v\n", m.name, m.kind)
+		for _, sm := range m.samples {
+			labels := ""
+			if m.label != "" {
+				labels = fmt.Sprintf("%v=%q", m.label, sm.label)
+			}
+			if m.kind != "histogram" {
+				fmt.Fprintf(w, "%v%v %v\n", m.name, braces(labels), formatFloat(sm.value))
+				continue
+			}
+			for i, n := range sm.buckets {
+				le := "+Inf"
+				if i < len(latencyBuckets) {
+					le = formatFloat(latencyBuckets[i].Seconds())
+				}
+				fmt.Fprintf(w, "%v_bucket%v %v\n", m.name, braces(joinLabels(labels, fmt.Sprintf("le=%q", le))), n)
+			}
+			fmt.Fprintf(w, "%v_sum%v %v\n", m.name, braces(labels), formatFloat(sm.value))
+			fmt.Fprintf(w, "%v_count%v %v\n", m.name, braces(labels), sm.count())
+		}
+	}
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func joinLabels(labels ...string) string {
+	var nonempty []string
+	for _, l := range labels {
+		if l != "" {
+			nonempty = append(nonempty, l)
+		}
+	}
+	return strings.Join(nonempty, ",")
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Vars returns an expvar.Var which holds the same stats as
+// MetricsHandler serves, as a JSON object, without the "mqtt_"
+// prefixes. Metrics with labels are objects by label, and histograms
+// have their buckets, sum and count. It is for publishing with
+// expvar.Publish.
+func (s *Server) Vars() expvar.Var {
+	return expvar.Func(func() interface{} {
+		vars := make(map[string]interface{})
+		for _, m := range s.metrics() {
+			name := strings.TrimPrefix(m.name, "mqtt_")
+			if m.label == "" {
+				vars[name] = m.samples[0].value
+				continue
+			}
+			byLabel := make(map[string]interface{})
+			for _, sm := range m.samples {
+				if m.kind != "histogram" {
+					byLabel[sm.label] = sm.value
+					continue
+				}
+				buckets := make(map[string]int64)
+				for i, b := range latencyBuckets {
+					buckets[formatFloat(b.Seconds())] = sm.buckets[i]
+				}
+				byLabel[sm.label] = map[string]interface{}{
+					"buckets": buckets,
+					"sum":     sm.value,
+					"count":   sm.count(),
+				}
+			}
+			vars[name] = byLabel
+		}
+		return vars
+	})
+}
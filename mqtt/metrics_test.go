@@ -0,0 +1,84 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestMetrics(t *testing.T) {
+	// As in TestStats, a Server with no goroutines of its own, so the
+	// worker latency is only what we put in.
+	svr := &Server{
+		stats:    newStats(),
+		subs:     &subscriptions{tree: newSubTree(), topics: make(map[*session]map[string]bool), retain: NewMemRetainStore(), posts: make(chan post, postQueue), latency: make([]histogram, 2)},
+		clients:  make(map[string]*incomingConn),
+		sessions: make(map[string]*session),
+	}
+	st := svr.stats
+	st.recv = 30
+	st.recvTypes[proto.MsgPublish] = 5
+	st.bytesSent = 100
+	st.clients = 2
+	svr.subs.posts <- post{}
+	svr.clients["a"] = &incomingConn{jobs: make(chan job, 10)}
+	svr.clients["a"].jobs <- job{}
+	svr.clients["b"] = &incomingConn{jobs: make(chan job, 10)}
+	svr.clients["b"].jobs <- job{}
+	svr.clients["b"].jobs <- job{}
+	svr.subs.latency[1].observe(3 * time.Millisecond)
+	svr.subs.latency[1].observe(2 * time.Second)
+
+	w := httptest.NewRecorder()
+	svr.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	got := w.Body.String()
+	for _, want := range []string{
+		"# TYPE mqtt_messages_received_total counter\nmqtt_messages_received_total 30\n",
+		"mqtt_packets_received_total{type=\"publish\"} 5\n",
+		"mqtt_packets_received_total{type=\"pingreq\"} 0\n",
+		"mqtt_bytes_sent_total 100\n",
+		"mqtt_clients_active 2\n",
+		"mqtt_clients_maximum 2\n",
+		"mqtt_clients_connected 2\n",
+		"mqtt_queue_length{queue=\"posts\"} 1\n",
+		"mqtt_queue_length{queue=\"clients\"} 3\n",
+		"mqtt_client_queue_length_max 2\n",
+		"# TYPE mqtt_worker_latency_seconds histogram\n",
+		"mqtt_worker_latency_seconds_bucket{worker=\"0\",le=\"+Inf\"} 0\n",
+		"mqtt_worker_latency_seconds_bucket{worker=\"1\",le=\"0.0025\"} 0\n",
+		"mqtt_worker_latency_seconds_bucket{worker=\"1\",le=\"0.005\"} 1\n",
+		"mqtt_worker_latency_seconds_bucket{worker=\"1\",le=\"1\"} 1\n",
+		"mqtt_worker_latency_seconds_bucket{worker=\"1\",le=\"+Inf\"} 2\n",
+		"mqtt_worker_latency_seconds_sum{worker=\"1\"} 2.003\n",
+		"mqtt_worker_latency_seconds_count{worker=\"1\"} 2\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("got content type %q", ct)
+	}
+
+	var vars struct {
+		Messages_received_total float64
+		Packets_received_total  map[string]float64
+		Worker_latency_seconds  map[string]struct {
+			Buckets map[string]int64
+			Count   int64
+		}
+	}
+	if err := json.Unmarshal([]byte(svr.Vars().String()), &vars); err != nil {
+		t.Fatal(err)
+	}
+	if vars.Messages_received_total != 30 || vars.Packets_received_total["publish"] != 5 {
+		t.Errorf("got vars %+v", vars)
+	}
+	if l := vars.Worker_latency_seconds["1"]; l.Count != 2 || l.Buckets["0.005"] != 1 {
+		t.Errorf("got latency %+v", l)
+	}
+}
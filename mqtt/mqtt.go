@@ -2,11 +2,12 @@
 package mqtt
 
 import (
+	"bytes"
+	"context"
 	crand "crypto/rand"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"math/rand"
 	"net"
 	"runtime"
@@ -32,143 +33,121 @@ func init() {
 	cliRand = rand.New(rand.NewSource(seed))
 }
 
-type stats struct {
-	recv       int64
-	sent       int64
-	clients    int64
-	clientsMax int64
-	lastmsgs   int64
+// A subscriber is a session, together with the QoS level it was
+// granted when it subscribed, and the options an MQTT 5 client may
+// subscribe with.
+type subscriber struct {
+	sess    *session
+	qos     proto.QosLevel
+	noLocal bool   // do not send the session the messages it publishes itself
+	rap     bool   // keep the retain flag of messages as they were published
+	share   string // for a shared subscription, the "$share/group/filter" it was made with
 }
 
-func (s *stats) messageRecv()      { atomic.AddInt64(&s.recv, 1) }
-func (s *stats) messageSend()      { atomic.AddInt64(&s.sent, 1) }
-func (s *stats) clientConnect()    { atomic.AddInt64(&s.clients, 1) }
-func (s *stats) clientDisconnect() { atomic.AddInt64(&s.clients, -1) }
-
-func statsMessage(topic string, stat int64) *proto.Publish {
-	return &proto.Publish{
-		Header:    header(dupFalse, proto.QosAtMostOnce, retainTrue),
-		TopicName: topic,
-		Payload:   newIntPayload(stat),
-	}
-}
-
-func (s *stats) publish(sub *subscriptions, interval time.Duration) {
-	clients := atomic.LoadInt64(&s.clients)
-	clientsMax := atomic.LoadInt64(&s.clientsMax)
-	if clients > clientsMax {
-		clientsMax = clients
-		atomic.StoreInt64(&s.clientsMax, clientsMax)
-	}
-	sub.submit(nil, statsMessage("$SYS/broker/clients/active", clients))
-	sub.submit(nil, statsMessage("$SYS/broker/clients/maximum", clientsMax))
-	sub.submit(nil, statsMessage("$SYS/broker/messages/received",
-		atomic.LoadInt64(&s.recv)))
-	sub.submit(nil, statsMessage("$SYS/broker/messages/sent",
-		atomic.LoadInt64(&s.sent)))
-
-	msgs := atomic.LoadInt64(&s.recv) + atomic.LoadInt64(&s.recv)
-	msgpersec := (msgs-s.lastmsgs) / int64(interval/time.Second)
-	// no need for atomic because we are the only reader/writer of it
-	s.lastmsgs = msgs
-
-	sub.submit(nil, statsMessage("$SYS/broker/messages/per-sec", msgpersec))
-}
-
-// An intPayload implements proto.Payload, and is an int64 that
-// formats itself and then prints itself into the payload.
-type intPayload string
-
-func newIntPayload(i int64) intPayload {
-	return intPayload(fmt.Sprint(i))
-}
-func (ip intPayload) ReadPayload(r io.Reader) error {
-	// not implemented
-	return nil
-}
-func (ip intPayload) WritePayload(w io.Writer) error {
-	_, err := w.Write([]byte(string(ip)))
-	return err
-}
-func (i intPayload) Size() int {
-	return len(i)
-}
-
-// A retain holds information necessary to correctly manage retained
-// messages.
-//
-// This needs to hold copies of the proto.Publish, not pointers to
-// it, or else we can send out one with the wrong retain flag.
-type retain struct {
-	m    proto.Publish
-	wild wild
+// Is sub the same subscription as this one, other than its QoS level
+// and options?
+func (sub subscriber) same(other subscriber) bool {
+	return sub.sess == other.sess && sub.share == other.share
 }
 
 type subscriptions struct {
+	svr     *Server // for its Logger; nil for subscriptions on their own
 	workers int
 	posts   chan (post)
-
-	mu        sync.Mutex // guards access to fields below
-	subs      map[string][]*incomingConn
-	wildcards []wild
-	retain    map[string]retain
-	stats     *stats
+	running sync.WaitGroup // the workers
+	stop    sync.Once
+	latency []histogram // how long each worker takes over a post
+
+	mu     sync.Mutex // guards access to fields below
+	tree   *subTree
+	topics map[*session]map[string]bool // the topics each session is subscribed to
+	retain RetainStore
+	stats  *stats
+	share  SharePolicy    // how to pick the member of a shared subscription group
+	next   map[string]int // where each shared subscription group is up to, for picking the next member
+	hooks  []Hook         // replaced, not changed in place, by Server.AddHook
 }
 
 // The length of the queue that subscription processing
 // workers are taking from.
 const postQueue = 100
 
-func newSubscriptions(workers int) *subscriptions {
+func newSubscriptions(svr *Server, workers int) *subscriptions {
 	s := &subscriptions{
-		subs:    make(map[string][]*incomingConn),
-		retain:  make(map[string]retain),
+		svr:     svr,
+		tree:    newSubTree(),
+		topics:  make(map[*session]map[string]bool),
+		retain:  NewMemRetainStore(),
+		next:    make(map[string]int),
 		posts:   make(chan post, postQueue),
 		workers: workers,
+		latency: make([]histogram, workers),
 	}
+	s.running.Add(s.workers)
 	for i := 0; i < s.workers; i++ {
 		go s.run(i)
 	}
 	return s
 }
 
-func (s *subscriptions) sendRetain(topic string, c *incomingConn) {
+// Make the workers exit once they have handled the posts already
+// submitted. Nothing may be submitted after this.
+func (s *subscriptions) close() {
+	s.stop.Do(func() { close(s.posts) })
+}
+
+// Send the retained messages matching topic (which may contain
+// wildcards) to a new subscriber. They are found with the lock held,
+// but sent without it, waiting for room in the client's queue rather
+// than being dropped.
+func (s *subscriptions) sendRetain(topic string, qos proto.QosLevel, c *incomingConn) {
 	s.mu.Lock()
-	var tlist []string
-	if isWildcard(topic) {
+	msgs := s.retain.Match(topic)
+	s.mu.Unlock()
 
-		// TODO: select matching topics from the retain map
-	} else {
-		tlist = []string{topic}
-	}
-	for _, t := range tlist {
-		if r, ok := s.retain[t]; ok {
-			c.submit(&r.m)
+	for _, m := range msgs {
+		if !c.submitWait(downgrade(m, qos)) {
+			return
 		}
 	}
-	s.mu.Unlock()
 }
 
-func (s *subscriptions) add(topic string, c *incomingConn) {
+// Add a subscription to filter, which may be a shared subscription. If
+// the session is already subscribed to exactly this filter, the new
+// subscription replaces the old one, so only the QoS level and options
+// change. Returns true if the subscription is a new one.
+func (s *subscriptions) add(filter string, sub subscriber) bool {
+	if !validFilter(filter) {
+		return false
+	}
+	topic, share := splitShare(filter)
+	sub.share = share
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if isWildcard(topic) {
-		w := newWild(topic, c)
-		if w.valid() {
-			s.wildcards = append(s.wildcards, w)
-		}
-	} else {
-		s.subs[topic] = append(s.subs[topic], c)
+	if s.topics[sub.sess] == nil {
+		s.topics[sub.sess] = make(map[string]bool)
 	}
+	s.topics[sub.sess][filter] = true
+	return s.tree.add(topic, sub)
+}
+
+// Is filter something that can be subscribed to? The group name of a
+// shared subscription must not be empty, or contain wildcards.
+func validFilter(filter string) bool {
+	topic, share := splitShare(filter)
+	if share != "" && isWildcard(share[len("$share/"):len(share)-len(topic)]) {
+		return false
+	}
+	return topic != "" && newWild(topic).valid()
 }
 
 type wild struct {
 	wild []string
-	c    *incomingConn
 }
 
-func newWild(topic string, c *incomingConn) wild {
-	return wild{wild: strings.Split(topic, "/"), c: c}
+func newWild(topic string) wild {
+	return wild{wild: strings.Split(topic, "/")}
 }
 
 func (w wild) matches(parts []string) bool {
@@ -200,114 +179,107 @@ func (w wild) matches(parts []string) bool {
 	return false
 }
 
-// Find all connections that are subscribed to this topic.
-func (s *subscriptions) subscribers(topic string) []*incomingConn {
+// Find all sessions that are subscribed to this topic.
+func (s *subscriptions) subscribers(topic string) []subscriber {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-
-	// non-wildcard subscribers
-	res := s.subs[topic]
-
-	// process wildcards
-	parts := strings.Split(topic, "/")
-	for _, w := range s.wildcards {
-		if w.matches(parts) {
-			res = append(res, w.c)
-		}
-	}
-
-	return res
+	return s.tree.match(topic)
 }
 
-// Remove all subscriptions that refer to a connection.
-func (s *subscriptions) unsubAll(c *incomingConn) {
+// Remove all subscriptions that refer to a session.
+func (s *subscriptions) unsubAll(sess *session) {
 	s.mu.Lock()
-	for _, v := range s.subs {
-		for i := range v {
-			if v[i] == c {
-				v[i] = nil
-			}
-		}
-	}
-
-	// remove any associated entries in the wildcard list
-	var wildNew []wild
-	for i := 0; i < len(s.wildcards); i++ {
-		if s.wildcards[i].c != c {
-			wildNew = append(wildNew, s.wildcards[i])
-		}
+	for filter := range s.topics[sess] {
+		topic, share := splitShare(filter)
+		s.tree.remove(topic, subscriber{sess: sess, share: share})
 	}
-	s.wildcards = wildNew
-
+	delete(s.topics, sess)
 	s.mu.Unlock()
 }
 
-// Remove the subscription to topic for a given connection.
-func (s *subscriptions) unsub(topic string, c *incomingConn) {
+// Remove the subscription to filter for a given session. Returns false
+// if there was no such subscription.
+func (s *subscriptions) unsub(filter string, sess *session) bool {
 	s.mu.Lock()
-	if subs, ok := s.subs[topic]; ok {
-		nils := 0
-
-		// Search the list, removing references to our connection.
-		// At the same time, count the nils to see if this list is now empty.
-		for i := 0; i < len(subs); i++ {
-			if subs[i] == c {
-				subs[i] = nil
-			}
-			if subs[i] == nil {
-				nils++
-			}
-		}
-
-		if nils == len(subs) {
-			delete(s.subs, topic)
-		}
+	defer s.mu.Unlock()
+	if !s.topics[sess][filter] {
+		return false
 	}
-	s.mu.Unlock()
+	topic, share := splitShare(filter)
+	s.tree.remove(topic, subscriber{sess: sess, share: share})
+	delete(s.topics[sess], filter)
+	return true
 }
 
 // The subscription processing worker.
 func (s *subscriptions) run(id int) {
 	tag := fmt.Sprintf("worker %d ", id)
-	log.Print(tag, "started")
+	s.svr.logger().Print(tag, "started")
+	defer s.running.Done()
 	for post := range s.posts {
-		// Remember the original retain setting, but send out immediate
-		// copies without retain: "When a server sends a PUBLISH to a client
-		// as a result of a subscription that already existed when the
-		// original PUBLISH arrived, the Retain flag should not be set,
-		// regardless of the Retain flag of the original PUBLISH.
-		isRetain := post.m.Header.Retain
-		post.m.Header.Retain = false
-
-		// Handle "retain with payload size zero = delete retain".
-		// Once the delete is done, return instead of continuing.
-		if isRetain && post.m.Payload.Size() == 0 {
-			s.mu.Lock()
-			delete(s.retain, post.m.TopicName)
-			s.mu.Unlock()
-			return
-		}
+		start := time.Now()
+		s.handle(tag, post)
+		s.latency[id].observe(time.Since(start))
+	}
+}
 
-		// Find all the connections that should be notified of this message.
-		conns := s.subscribers(post.m.TopicName)
+// Send a post to the subscribers, and retain it if need be.
+func (s *subscriptions) handle(tag string, post post) {
+	if post.m = s.onPublish(tag, post); post.m == nil {
+		return
+	}
 
-		// Queue the outgoing messages
-		for _, c := range conns {
-			if c != nil {
-				c.submit(post.m)
-			}
+	// Remember the original retain setting, but send out immediate
+	// copies without retain: "When a server sends a PUBLISH to a client
+	// as a result of a subscription that already existed when the
+	// original PUBLISH arrived, the Retain flag should not be set,
+	// regardless of the Retain flag of the original PUBLISH.
+	isRetain := post.m.Header.Retain
+	post.m.Header.Retain = false
+
+	// Handle "retain with payload size zero = delete retain".
+	// Once the delete is done, that is all.
+	if isRetain && post.m.Payload.Size() == 0 {
+		s.mu.Lock()
+		if err := s.retain.Delete(post.m.TopicName); err != nil {
+			s.svr.logger().Print(tag, "retain: ", err)
 		}
+		s.mu.Unlock()
+		return
+	}
+
+	// Find all the connections that should be notified of this
+	// message, with one from each shared subscription group.
+	subs := s.balance(s.subscribers(post.m.TopicName))
 
-		if isRetain {
-			s.mu.Lock()
-			// Save a copy of it, and set that copy's Retain to true, so that
-			// when we send it out later we notify new subscribers that this
-			// is an old message.
+	// Queue the outgoing messages
+	for _, sub := range subs {
+		if sub.sess == nil {
+			continue
+		}
+		if sub.noLocal && post.c != nil && post.c.sess == sub.sess {
+			continue
+		}
+		if sub.rap && isRetain {
 			msg := *post.m
 			msg.Header.Retain = true
-			s.retain[post.m.TopicName] = retain{m: msg}
-			s.mu.Unlock()
+			sub.sess.deliver(&msg, sub.qos)
+			continue
+		}
+		sub.sess.deliver(post.m, sub.qos)
+	}
+
+	if isRetain {
+		s.mu.Lock()
+		// Save a copy of it, and set that copy's Retain to true, so that
+		// when we send it out later we notify new subscribers that this
+		// is an old message.
+		msg := *post.m
+		msg.Header.Retain = true
+		if err := s.retain.Put(&msg); err != nil {
+			s.svr.logger().Print(tag, "retain: ", err)
 		}
+		s.mu.Unlock()
 	}
 }
 
@@ -323,61 +295,176 @@ type post struct {
 
 // A Server holds all the state associated with an MQTT server.
 type Server struct {
-	l             net.Listener
-	subs          *subscriptions
-	stats         *stats
-	Done          chan struct{}
-	StatsInterval time.Duration // Defaults to 10 seconds. Must be set using sync/atomic.StoreInt64().
-	Dump          bool          // When true, dump the messages in and out.
-	rand          *rand.Rand
+	subs           *subscriptions
+	stats          *stats
+	Done           chan struct{}
+	StatsInterval  time.Duration // Defaults to 10 seconds. Must be set using sync/atomic.StoreInt64().
+	RetryInterval  time.Duration // How long to wait for an ack before resending a QoS 1 or 2 message, except to MQTT 5 clients, who only get it again when they reconnect. Defaults to 20 seconds.
+	MaxQueued      int           // How many QoS 1 and 2 messages to hold for a disconnected persistent session. Defaults to 1000.
+	ConnectTimeout time.Duration // How long a new connection has to send CONNECT. Defaults to 30 seconds; zero means forever.
+	WriteTimeout   time.Duration // How long writing one message to a client may take. Defaults to 30 seconds; zero means forever.
+	Dump           bool          // When true, dump the messages in and out; see also Trace.
+	Capture        *Capture      // When set, the messages in and out are written to it.
+	Authenticator  Authenticator // When set, decides who may connect.
+	Authorizer     Authorizer    // When set, decides who may use which topics.
+	MaxTopicAlias  int           // How many topic aliases an MQTT 5 client may use when publishing. Defaults to 10.
+	Backpressure   Backpressure  // What to do when a client cannot keep up. Defaults to BackpressureDropNewest; see also ClientInfo.
+	BlockTimeout   time.Duration // How long BackpressureBlock waits for room. Defaults to 1 second.
+	MaxPacketSize  uint32        // The most bytes a client may send in one packet, after the fixed header; MQTT 5 clients are told. Defaults to 1MB; zero means as large as MQTT allows. The CONNECT is held to 64KB as well.
+	rand           *rand.Rand
+
+	logTo     atomic.Value  // the Logger, set by SetLogger
+	quit      chan struct{} // closed by Shutdown, with listenersMu held
+	quitOnce  sync.Once
+	running   sync.WaitGroup // the accept loop, and the readers and writers of connections
+	statsDone chan struct{}  // closed when the stats goroutine exits
+
+	listenersMu sync.Mutex // guards access to fields below
+	listeners   []*listener
+	started     bool // set by Start
+	accepting   int  // how many listeners are being accepted from
+	doneOnce    sync.Once
+
+	clientsMu sync.Mutex // guards access to clients and traced
+	clients   map[string]*incomingConn
+	traced    map[string]bool // the client ids to dump the messages of, set by Trace
+
+	sessionsMu sync.Mutex // guards access to sessions
+	sessions   map[string]*session
 }
 
 // NewServer creates a new MQTT server, which accepts connections from
-// the given listener. When the server is stopped (for instance by
-// another goroutine closing the net.Listener), channel Done will become
-// readable.
+// the given listener, if it is not nil, and any added by AddListener.
+// When the server stops accepting connections (because of Shutdown, or
+// other goroutines closing all of the listeners), channel Done will
+// become readable.
 func NewServer(l net.Listener) *Server {
 	svr := &Server{
-		l:             l,
-		stats:         &stats{},
-		Done:          make(chan struct{}),
-		StatsInterval: time.Second * 10,
-		subs:          newSubscriptions(runtime.GOMAXPROCS(0)),
+		stats:          newStats(),
+		Done:           make(chan struct{}),
+		quit:           make(chan struct{}),
+		statsDone:      make(chan struct{}),
+		StatsInterval:  time.Second * 10,
+		RetryInterval:  time.Second * 20,
+		MaxQueued:      1000,
+		ConnectTimeout: time.Second * 30,
+		WriteTimeout:   time.Second * 30,
+		MaxTopicAlias:  10,
+		BlockTimeout:   time.Second,
+		MaxPacketSize:  1 << 20,
+		clients:        make(map[string]*incomingConn),
+		sessions:       make(map[string]*session),
+	}
+	svr.subs = newSubscriptions(svr, runtime.GOMAXPROCS(0))
+	if l != nil {
+		svr.AddListener(l, ListenerConfig{})
 	}
 
 	// start the stats reporting goroutine
 	go func() {
+		defer close(svr.statsDone)
 		for {
-			svr.stats.publish(svr.subs, svr.StatsInterval)
+			svr.publishStats(time.Now())
+			svr.publishDropped()
 			select {
 			case <-svr.Done:
 				return
-			default:
+			case <-svr.quit:
+				return
+			case <-time.After(svr.StatsInterval):
 				// keep going
 			}
-			time.Sleep(svr.StatsInterval)
 		}
 	}()
 
 	return svr
 }
 
+// SetRetainStore makes the Server keep its retained messages in rs,
+// instead of in memory. It should be called before Start.
+func (s *Server) SetRetainStore(rs RetainStore) {
+	if fs, ok := rs.(*FileRetainStore); ok {
+		for _, p := range fs.problems {
+			s.logger().Print(p)
+		}
+		fs.problems = nil
+	}
+	s.subs.mu.Lock()
+	s.subs.retain = rs
+	s.subs.mu.Unlock()
+}
+
+// SetSharePolicy sets how the Server picks which member of a shared
+// subscription group gets each message. The default is ShareRoundRobin.
+func (s *Server) SetSharePolicy(p SharePolicy) {
+	s.subs.mu.Lock()
+	s.subs.share = p
+	s.subs.mu.Unlock()
+}
+
 // Start makes the Server start accepting and handling connections.
 func (s *Server) Start() {
-	go func() {
-		for {
-			conn, err := s.l.Accept()
-			if err != nil {
-				log.Print("Accept: ", err)
-				break
-			}
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	s.started = true
+	for _, ln := range s.listeners {
+		s.serve(ln)
+	}
+}
 
-			cli := s.newIncomingConn(conn)
-			s.stats.clientConnect()
-			cli.start()
+// Shutdown stops the Server gracefully: it stops accepting connections,
+// sends what is queued for each client followed by a DISCONNECT, waits
+// for the connections to close, and then for the subscription workers
+// to handle the messages already published (including the wills of the
+// clients) and exit. It returns nil once everything has stopped, or the
+// context's error if that happens first, in which case Shutdown may be
+// called again to carry on waiting.
+//
+// The RetainStore is not closed; that is up to the caller, once
+// Shutdown has returned nil.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.quitOnce.Do(func() {
+		s.listenersMu.Lock()
+		defer s.listenersMu.Unlock()
+		close(s.quit)
+		for _, ln := range s.listeners {
+			ln.l.Close()
+		}
+		if s.accepting == 0 {
+			s.doneOnce.Do(func() { close(s.Done) })
 		}
-		close(s.Done)
+	})
+
+	conns := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(conns)
 	}()
+	if err := waitFor(ctx, conns); err != nil {
+		return err
+	}
+	if err := waitFor(ctx, s.statsDone); err != nil {
+		return err
+	}
+
+	// Nothing else publishes now, so the workers can be stopped.
+	s.subs.close()
+	workers := make(chan struct{})
+	go func() {
+		s.subs.running.Wait()
+		close(workers)
+	}()
+	return waitFor(ctx, workers)
+}
+
+// Wait until done is closed, or the context is done.
+func waitFor(ctx context.Context, done <-chan struct{}) error {
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // An IncomingConn represents a connection into a Server.
@@ -385,13 +472,26 @@ type incomingConn struct {
 	svr      *Server
 	conn     net.Conn
 	jobs     chan job
+	pubs     chan job // published messages for a BackpressureDropOldest client, kept apart so that they can be dropped from the front
 	clientid string
+	sess     *session          // set by the reader when CONNECT is accepted
+	will     *proto.Publish    // only touched by the reader
+	info     ClientInfo        // set by the reader from the CONNECT
+	version  byte              // the protocol level, set by the reader from the CONNECT
+	maxOut   uint32            // the largest packet an MQTT 5 client will take; zero for no limit
+	aliases  map[uint16]string // the topic aliases of an MQTT 5 client; only touched by the reader
 	Done     chan struct{}
+	gone     chan struct{} // closed when the writer stops, before it gives back what it did not send
+	kicked   chan struct{} // closed when another connection takes over
+	kickOnce sync.Once
+	trusted  bool         // a connection made by the server itself, which is not checked by the Authenticator and Authorizer
+	policy   Backpressure // set by the reader from the CONNECT
+	qmu      sync.Mutex   // held while queueing published messages
+	dropped  int64        // messages to or from the client which were dropped; use sync/atomic
+	trace    int32        // nonzero to dump the messages in and out, as for Server.Dump; use sync/atomic
+	ln       *listener    // the listener the connection came from; nil for connections made otherwise
 }
 
-var clients map[string]*incomingConn = make(map[string]*incomingConn)
-var clientsMu sync.Mutex
-
 const sendingQueueLength = 100
 
 // newIncomingConn creates a new incomingConn associated with this
@@ -400,10 +500,13 @@ const sendingQueueLength = 100
 // channel becomes readable.
 func (s *Server) newIncomingConn(conn net.Conn) *incomingConn {
 	return &incomingConn{
-		svr:  s,
-		conn: conn,
-		jobs: make(chan job, sendingQueueLength),
-		Done: make(chan struct{}),
+		svr:    s,
+		conn:   conn,
+		jobs:   make(chan job, sendingQueueLength),
+		pubs:   make(chan job, sendingQueueLength),
+		Done:   make(chan struct{}),
+		gone:   make(chan struct{}),
+		kicked: make(chan struct{}),
 	}
 }
 
@@ -416,79 +519,98 @@ func (r receipt) wait() {
 }
 
 type job struct {
-	m proto.Message
-	r receipt
+	m   message
+	r   receipt
+	tok *Token // for a message published by a ClientConn
 }
 
 // Start reading and writing on this connection.
 func (c *incomingConn) start() {
+	c.svr.running.Add(2)
 	go c.reader()
 	go c.writer()
 }
 
-// Add this	connection to the map, or find out that an existing connection
-// already exists for the same client-id.
-func (c *incomingConn) add() *incomingConn {
-	clientsMu.Lock()
-	defer clientsMu.Unlock()
+// Register a connection under its client id, returning the connection
+// which had the client id before, if any.
+func (s *Server) register(c *incomingConn) *incomingConn {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
 
-	existing, ok := clients[c.clientid]
-	if !ok {
-		// this client id already exists, return it
-		return existing
-	}
+	old := s.clients[c.clientid]
+	s.clients[c.clientid] = c
+	c.setTrace(s.traced[c.clientid])
+	return old
+}
 
-	clients[c.clientid] = c
-	return nil
+// Forget a connection, unless another one has taken over its client id.
+func (s *Server) unregister(c *incomingConn) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	if s.clients[c.clientid] == c {
+		delete(s.clients, c.clientid)
+	}
 }
 
-// Delete a connection; the conection must be closed by the caller first.
-func (c *incomingConn) del() {
-	clientsMu.Lock()
-	defer clientsMu.Unlock()
-	delete(clients, c.clientid)
-	return
+// Take over the client id of another connection: tell it to go, and
+// wait until it has gone, leaving the session (and its will) behind.
+func (c *incomingConn) takeOver(old *incomingConn) {
+	c.svr.logger().Printf("Client %v already connected, closing old connection.", c.clientid)
+	old.kick()
+	select {
+	case <-old.Done:
+	case <-time.After(takeoverTimeout):
+		old.conn.Close()
+		<-old.Done
+	}
 }
 
-// Replace any existing connection with this one. The one to be replaced,
-// if any, must be closed first by the caller.
-func (c *incomingConn) replace() {
-	clientsMu.Lock()
-	defer clientsMu.Unlock()
+// How long to give a connection which is being taken over to go
+// quietly.
+const takeoverTimeout = 5 * time.Second
 
-	// Check that any existing connection is already closed.
-	existing, ok := clients[c.clientid]
-	if ok {
-		die := false
-		select {
-		case _, ok := <-existing.jobs:
-			// what? we are expecting that this channel is closed!
-			if ok {
-				die = true
-			}
-		default:
-			die = true
-		}
-		if die {
-			panic("attempting to replace a connection that is not closed")
-		}
+// Make the writer hang up, because another connection has taken over.
+func (c *incomingConn) kick() {
+	c.kickOnce.Do(func() { close(c.kicked) })
+}
 
-		delete(clients, c.clientid)
+// Queue a message; no notification of sending is done. Published
+// messages are subject to the client's Backpressure policy. Everything
+// else is a reply to the client, queued by the reader, which waits for
+// room, so that a client which does not read its replies is not read
+// from either.
+func (c *incomingConn) submit(m message) {
+	if p, ok := m.(*proto.Publish); ok {
+		c.submitPublish(p)
+		return
 	}
+	c.jobs <- job{m: m}
+}
 
-	clients[c.clientid] = c
-	return
+// Queue a copy of a published message for delivery to this connection.
+func (c *incomingConn) deliver(m *proto.Publish, qos proto.QosLevel) {
+	c.submit(downgrade(m, qos))
 }
 
-// Queue a message; no notification of sending is done.
-func (c *incomingConn) submit(m proto.Message) {
-	j := job{m: m}
-	select {
-	case c.jobs <- j:
-	default:
-		log.Print(c, ": failed to submit message")
+// Make a copy of a published message for delivery to one subscriber.
+// The QoS level of the copy is the lower of the QoS level it was
+// published with and the QoS level granted to the subscription.
+func downgrade(m *proto.Publish, qos proto.QosLevel) *proto.Publish {
+	if m.Header.QosLevel < qos {
+		qos = m.Header.QosLevel
 	}
-	return
+	msg := *m
+	msg.Header.DupFlag = false
+	msg.Header.QosLevel = qos
+	// The message id will be allocated by the writer.
+	msg.MessageId = 0
+	return &msg
+}
+
+// How many messages are waiting to be sent.
+func (c *incomingConn) queued() int {
+	return len(c.jobs) + len(c.pubs)
 }
 
 func (c *incomingConn) String() string {
@@ -497,24 +619,191 @@ func (c *incomingConn) String() string {
 
 // Queue a message, returns a channel that will be readable
 // when the message is sent.
-func (c *incomingConn) submitSync(m proto.Message) receipt {
+func (c *incomingConn) submitSync(m message) receipt {
 	j := job{m: m, r: make(receipt)}
 	c.jobs <- j
 	return j.r
 }
 
+// Queue a message, waiting for room rather than applying the
+// Backpressure policy. Returns false if the writer is gone.
+func (c *incomingConn) submitWait(m message) bool {
+	select {
+	case <-c.gone:
+		return false
+	default:
+	}
+	select {
+	case c.jobs <- job{m: m}:
+		return true
+	case <-c.gone:
+		return false
+	}
+}
+
+// Pass a message published by this connection on to the subscribers.
+// Returns the reason code to ack it with, for MQTT 5 clients.
+func (c *incomingConn) publish(m *proto.Publish) byte {
+	if isWildcard(m.TopicName) {
+		c.svr.logger().Print("reader: ignoring PUBLISH with wildcard topic ", m.TopicName)
+		return reasonTopicNameInvalid
+	}
+	if !c.authorized(m.TopicName, AccessWrite) {
+		return reasonNotAuthorized
+	}
+	c.post(m)
+	return reasonSuccess
+}
+
+// Make an ack in the client's protocol version. Only MQTT 5 clients are
+// told the reason code.
+func (c *incomingConn) ack(m proto.Message, reason byte) message {
+	if c.version == Version5 && reason != reasonSuccess {
+		return &packet5{m: m, reason: reason}
+	}
+	return m
+}
+
+// Make a CONNACK in the client's protocol version. The reason code is
+// for refusing MQTT 5 clients for reasons that MQTT 3 has no return
+// code for, and the properties are only sent to MQTT 5 clients.
+func (c *incomingConn) connack(rc proto.ReturnCode, reason byte, present bool, props properties) message {
+	switch c.version {
+	case Version5:
+		return &packet5{
+			m:              &proto.ConnAck{ReturnCode: rc},
+			reason:         reason,
+			sessionPresent: present,
+			props:          props,
+		}
+	case Version311:
+		return &connAck4{sessionPresent: present, rc: rc}
+	}
+	return &proto.ConnAck{ReturnCode: rc}
+}
+
+// What to put in a SUBACK for a subscription which was not made, given
+// the QoS level it would have been granted. MQTT 3.1 has no way to say
+// no, so the subscription is acked anyway.
+func (c *incomingConn) refuse(qos proto.QosLevel, reason byte) proto.QosLevel {
+	switch c.version {
+	case Version5:
+		return proto.QosLevel(reason)
+	case Version311:
+		return 0x80
+	}
+	return qos
+}
+
+// Apply the topic alias in the properties of an MQTT 5 PUBLISH: an alias
+// which comes with a topic is set to it, and one without stands for the
+// topic it was last set to. Returns false if the PUBLISH has no topic
+// after all, or the alias is out of range.
+func (c *incomingConn) resolveAlias(m *proto.Publish, props properties) bool {
+	pr, ok := props.get(propTopicAlias)
+	if !ok {
+		return m.TopicName != ""
+	}
+	alias := uint16(pr.n)
+	if alias == 0 || int(alias) > c.svr.MaxTopicAlias {
+		return false
+	}
+	if m.TopicName == "" {
+		m.TopicName, ok = c.aliases[alias]
+		return ok
+	}
+	if c.aliases == nil {
+		c.aliases = make(map[uint16]string)
+	}
+	c.aliases[alias] = m.TopicName
+	return true
+}
+
+// Make up a client id, for a client which connects without one.
+func newClientId() string {
+	var b [16]byte
+	crand.Read(b[:])
+	return fmt.Sprintf("auto-%x", b)
+}
+
+// The session expiry for a Session Expiry Interval property.
+func sessionExpiry(secs uint32) time.Duration {
+	if secs == 0xffffffff {
+		return neverExpires
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// Ask the server's Authorizer, if any, whether this client may use
+// a topic.
+func (c *incomingConn) authorized(topic string, acc Access) bool {
+	if c.trusted || c.authorizer() == nil || c.authorizer().Authorize(&c.info, topic, acc) {
+		return true
+	}
+	c.svr.logger().Printf("reader: %v not authorized for %q", c.clientid, topic)
+	return false
+}
+
 func (c *incomingConn) reader() {
 	// On exit, close the connection and arrange for the writer to exit
 	// by closing the output channel.
+	graceful := false // set when the client sends DISCONNECT
 	defer func() {
 		c.conn.Close()
 		c.svr.stats.clientDisconnect()
+		// Stop deliveries from the session before closing jobs.
+		if c.sess != nil {
+			c.sess.detach(c)
+			c.svr.subs.onDisconnect(&c.info, graceful)
+		}
+		// We did not get a DISCONNECT, so tell everyone.
+		if c.will != nil {
+			c.svr.subs.submit(c, c.will)
+		}
 		close(c.jobs)
+		c.svr.running.Done()
 	}()
 
+	// Set from the CONNECT; zero means the client does not want
+	// keepalive checking.
+	var keepalive time.Duration
+
+	// Everything is read through here, to count the bytes.
+	in := meteredReader{c.conn, &c.svr.stats.bytesRecv}
+
 	for {
-		// TODO: timeout (first message and/or keepalives)
-		m, err := proto.DecodeOneMessage(c.conn, nil)
+		// The CONNECT must arrive promptly, and after that the
+		// client must send something (if only a PINGREQ) within
+		// one and a half keepalive periods.
+		var deadline time.Time
+		if c.sess == nil {
+			if c.svr.ConnectTimeout > 0 {
+				deadline = time.Now().Add(c.svr.ConnectTimeout)
+			}
+		} else if keepalive > 0 {
+			deadline = time.Now().Add(keepalive * 3 / 2)
+		}
+		c.conn.SetReadDeadline(deadline)
+
+		// MQTT 5 packets are decoded here, and the rest by package
+		// proto. Until the CONNECT, we do not know which it will be.
+		var m proto.Message
+		var p *packet5 // the MQTT 5 packet m came in, for an MQTT 5 client
+		var err error
+		switch {
+		case c.sess == nil:
+			m, p, err = c.readConnect(in)
+		case c.version == Version5:
+			if p, err = read5(in, c.svr.maxPacketSize()); err == nil {
+				m = p.m
+			}
+		default:
+			var first byte
+			var body []byte
+			if first, body, err = readPacket(in, c.svr.maxPacketSize()); err == nil {
+				m, err = proto.DecodeOneMessage(bytes.NewReader(rawPacket(first, body)), nil)
+			}
+		}
 		if err != nil {
 			if err == io.EOF {
 				return
@@ -522,72 +811,228 @@ func (c *incomingConn) reader() {
 			if strings.HasSuffix(err.Error(), "use of closed network connection") {
 				return
 			}
-			log.Print("reader: ", err)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				c.svr.logger().Printf("reader: client %v timed out", c.conn.RemoteAddr())
+				return
+			}
+			c.svr.logger().Print("reader: ", err)
 			return
 		}
-		c.svr.stats.messageRecv()
+		c.svr.stats.messageRecv(m)
+
+		// The CONNECT is traced if the client it is from is.
+		if m, ok := m.(*proto.Connect); ok {
+			c.clientid = m.ClientId
+			c.setTrace(c.svr.tracing(m.ClientId))
+		}
+		if p != nil {
+			c.dump("in", p)
+		} else {
+			c.dump("in", m)
+		}
 
-		if c.svr.Dump {
-			log.Printf("dump  in: %T %v", m, m)
+		// The first message must be a CONNECT, and there
+		// must be only one of them.
+		if _, ok := m.(*proto.Connect); ok == (c.sess != nil) {
+			c.svr.logger().Printf("reader: unexpected %T from %v", m, c.conn.RemoteAddr())
+			return
 		}
 
 		switch m := m.(type) {
 		case *proto.Connect:
 			rc := proto.RetCodeAccepted
+			var reason byte // for refusing MQTT 5 clients without a return code
 
-			if m.ProtocolName != "MQIsdp" ||
-				m.ProtocolVersion != 3 {
-				log.Print("reader: reject connection from ", m.ProtocolName, " version ", m.ProtocolVersion)
+			switch {
+			case m.ProtocolName == "MQIsdp" && m.ProtocolVersion == Version31,
+				m.ProtocolName == "MQTT" && m.ProtocolVersion == Version311,
+				m.ProtocolName == "MQTT" && m.ProtocolVersion == Version5:
+				c.version = m.ProtocolVersion
+			default:
+				c.svr.logger().Print("reader: reject connection from ", m.ProtocolName, " version ", m.ProtocolVersion)
 				rc = proto.RetCodeUnacceptableProtocolVersion
 			}
 
-			// Check client id.
-			if len(m.ClientId) < 1 || len(m.ClientId) > 23 {
-				rc = proto.RetCodeIdentifierRejected
+			// Check client id. Since MQTT 3.1.1, a client may leave it
+			// to us to make one up, if it is not coming back for its
+			// session (MQTT 5 clients are told the id, so they can).
+			assigned := false
+			if rc == proto.RetCodeAccepted {
+				switch {
+				case m.ClientId == "" && (c.version == Version5 || c.version == Version311 && m.CleanSession):
+					m.ClientId = newClientId()
+					assigned = true
+				case m.ClientId == "", c.version == Version31 && len(m.ClientId) > 23:
+					rc = proto.RetCodeIdentifierRejected
+				}
 			}
 			c.clientid = m.ClientId
 
-			// Disconnect existing connections.
-			if existing := c.add(); existing != nil {
-				disconnect := &proto.Disconnect{}
-				r := existing.submitSync(disconnect)
-				r.wait()
-				existing.del()
+			// An MQTT 3 session lasts forever, unless it is clean.
+			// MQTT 5 clients say how long to keep it, and tell us
+			// things about themselves, and we them.
+			expiry := neverExpires
+			if m.CleanSession {
+				expiry = 0
+			}
+			var props properties
+			if p != nil {
+				expiry = 0
+				if pr, ok := p.props.get(propSessionExpiry); ok {
+					expiry = sessionExpiry(pr.n)
+				}
+				if pr, ok := p.props.get(propMaximumPacketSize); ok {
+					c.maxOut = pr.n
+				}
+				if _, ok := p.props.get(propAuthMethod); ok && rc == proto.RetCodeAccepted {
+					// enhanced authentication is not supported
+					rc = proto.RetCodeNotAuthorized
+					reason = reasonBadAuthMethod
+				}
+				if assigned {
+					props = append(props, property{id: propAssignedClientId, s: m.ClientId})
+				}
+				props = append(props,
+					property{id: propMaximumPacketSize, n: c.svr.maxPacketSize()},
+					property{id: propTopicAliasMaximum, n: uint32(c.svr.MaxTopicAlias)},
+					property{id: propSubscriptionIds, n: 0},
+					property{id: propSharedSubs, n: 1})
 			}
-			c.add()
 
-			// TODO: Last will
+			c.info = ClientInfo{
+				ClientId:   m.ClientId,
+				Username:   m.Username,
+				Password:   m.Password,
+				RemoteAddr: c.conn.RemoteAddr(),
+				Cert:       peerCert(c.conn),
+			}
+			if c.ln != nil {
+				c.info.Listener = c.ln.cfg.Name
+				if rc == proto.RetCodeAccepted && c.ln.cfg.RequireCert && c.info.Cert == nil {
+					c.svr.logger().Printf("reader: %v did not present a client certificate", c.clientid)
+					rc = proto.RetCodeNotAuthorized
+				}
+			}
+			if auth := c.authenticator(); rc == proto.RetCodeAccepted && auth != nil && !c.trusted {
+				rc = auth.Authenticate(&c.info)
+				if int(rc) >= len(ConnectionErrors) {
+					rc = proto.RetCodeNotAuthorized
+				}
+			}
+			if rc == proto.RetCodeAccepted {
+				if err := c.svr.subs.onConnect(&c.info); err != nil {
+					c.svr.logger().Printf("reader: hook refused %v: %v", c.clientid, err)
+					rc = proto.RetCodeNotAuthorized
+				}
+			}
+			c.policy = c.info.Backpressure
+			if c.policy == BackpressureDefault {
+				c.policy = c.svr.Backpressure
+			}
 
-			connack := &proto.ConnAck{
-				ReturnCode: rc,
+			// Find the session (if there is one) before queuing
+			// the CONNACK; the writer picks it up from there. Any
+			// connection with the same client id must be gone
+			// first, so that it lets go of the session.
+			present := false
+			if rc == proto.RetCodeAccepted {
+				if old := c.svr.register(c); old != nil {
+					c.takeOver(old)
+				}
+				c.sess, present = c.svr.session(c.clientid, m.CleanSession, expiry)
 			}
-			c.submit(connack)
 
-			// close connection if it was a bad connect
+			connack := c.connack(rc, reason, present, props)
+
+			// close connection if it was a bad connect, once they
+			// have been told why
 			if rc != proto.RetCodeAccepted {
-				log.Printf("Connection refused for %v: %v", c.conn.RemoteAddr(), ConnectionErrors[rc])
+				c.submitSync(connack).wait()
+				c.svr.logger().Printf("Connection refused for %v: %v", c.conn.RemoteAddr(), ConnectionErrors[rc])
 				return
 			}
+			c.submit(connack)
+
+			// Pick up where the session left off, resending what
+			// it has for us.
+			c.sess.attach(c)
+			keepalive = time.Duration(m.KeepAliveTimer) * time.Second
+
+			// Hang on to the will, to publish if the client
+			// goes away without a DISCONNECT.
+			if m.WillFlag {
+				c.will = will(m)
+				if c.will == nil {
+					c.svr.logger().Printf("reader: ignoring invalid will for %v on topic %q", m.ClientId, m.WillTopic)
+				}
+				if c.will != nil && !c.authorized(c.will.TopicName, AccessWrite) {
+					c.will = nil
+				}
+				// The will is published at once; its delay is not
+				// supported.
+				if c.will != nil && p != nil {
+					c.will.Payload = withProps(c.will.Payload, p.willProps.without(propWillDelay))
+				}
+			}
 
 			// Log in mosquitto format.
 			clean := 0
 			if m.CleanSession {
 				clean = 1
 			}
-			log.Printf("New client connected from %v as %v (c%v, k%v).", c.conn.RemoteAddr(), c.clientid, clean, m.KeepAliveTimer)
+			c.svr.logger().Printf("New client connected from %v as %v (c%v, k%v).", c.conn.RemoteAddr(), c.clientid, clean, m.KeepAliveTimer)
 
 		case *proto.Publish:
-			// TODO: Proper QoS support
-			if m.Header.QosLevel != proto.QosAtMostOnce {
-				log.Printf("reader: no support for QoS %v yet", m.Header.QosLevel)
+			if p != nil && !c.resolveAlias(m, p.props) {
+				c.svr.logger().Printf("reader: bad topic alias from %v", c.conn.RemoteAddr())
+				c.submitSync(&packet5{m: &proto.Disconnect{}, reason: reasonTopicAliasInvalid}).wait()
 				return
 			}
-			if isWildcard(m.TopicName) {
-				log.Print("reader: ignoring PUBLISH with wildcard topic ", m.TopicName)
-			} else {
-				c.svr.subs.submit(c, m)
+
+			switch qos := m.Header.QosLevel; qos {
+			case proto.QosAtMostOnce:
+				c.publish(m)
+			case proto.QosAtLeastOnce:
+				reason := c.publish(m)
+				c.submit(c.ack(&proto.PubAck{MessageId: m.MessageId}, reason))
+			case proto.QosExactlyOnce:
+				// Pass it on the first time we see it, and only
+				// ack the duplicates until the PUBREL arrives.
+				// A refusal ends the exchange, for MQTT 5.
+				reason := byte(reasonSuccess)
+				if c.sess.received(m.MessageId) {
+					reason = c.publish(m)
+				}
+				if reason != reasonSuccess {
+					c.sess.released(m.MessageId)
+				}
+				c.submit(c.ack(&proto.PubRec{MessageId: m.MessageId}, reason))
+			default:
+				c.svr.logger().Printf("reader: invalid QoS %v", qos)
+				return
+			}
+
+		case *proto.PubAck:
+			c.sess.out.ack(m.MessageId)
+
+		case *proto.PubRec:
+			if p != nil && p.reason >= reasonUnspecified {
+				// refused; there will be no PUBCOMP
+				c.sess.out.ack(m.MessageId)
+				break
 			}
-			c.submit(&proto.PubAck{MessageId: m.MessageId})
+			c.sess.out.rec(m.MessageId)
+			c.submit(&proto.PubRel{
+				Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+				MessageId: m.MessageId,
+			})
+
+		case *proto.PubRel:
+			c.sess.released(m.MessageId)
+			c.submit(&proto.PubComp{MessageId: m.MessageId})
+
+		case *proto.PubComp:
+			c.sess.out.ack(m.MessageId)
 
 		case *proto.PingReq:
 			c.submit(&proto.PingResp{})
@@ -601,71 +1046,457 @@ func (c *incomingConn) reader() {
 				MessageId: m.MessageId,
 				TopicsQos: make([]proto.QosLevel, len(m.Topics)),
 			}
+			sendRetain := make([]bool, len(m.Topics))
 			for i, tq := range m.Topics {
-				// TODO: Handle varying QoS correctly
-				c.svr.subs.add(tq.Topic, c)
-				suback.TopicsQos[i] = proto.QosAtMostOnce
+				// The hooks may change what is subscribed to.
+				tq, err := c.svr.subs.onSubscribe(&c.info, tq)
+				m.Topics[i] = tq
+
+				// Grant the QoS they asked for, or the best we
+				// can do if they asked for something invalid.
+				qos := tq.Qos
+				if !qos.IsValid() {
+					qos = proto.QosExactlyOnce
+				}
+				suback.TopicsQos[i] = qos
+
+				// MQTT 5 subscription options; by default the
+				// retained messages are always sent.
+				sub := subscriber{sess: c.sess, qos: qos}
+				var retainHandling byte
+				if p != nil {
+					sub.noLocal = p.opts[i]&0x04 != 0
+					sub.rap = p.opts[i]&0x08 != 0
+					retainHandling = p.opts[i] >> 4 & 3
+				}
+
+				// A shared subscription is authorized like the
+				// plain one, and gets no retained messages.
+				topic, share := splitShare(tq.Topic)
+				switch {
+				case err != nil:
+					c.svr.logger().Printf("reader: hook refused subscription of %v to %q: %v", c.clientid, tq.Topic, err)
+					suback.TopicsQos[i] = c.refuse(qos, reasonNotAuthorized)
+				case !validFilter(tq.Topic):
+					suback.TopicsQos[i] = c.refuse(qos, reasonTopicFilterInvalid)
+				case !c.authorized(topic, AccessRead):
+					suback.TopicsQos[i] = c.refuse(qos, reasonNotAuthorized)
+				default:
+					isNew := c.svr.subs.add(tq.Topic, sub)
+					sendRetain[i] = share == "" && (retainHandling == 0 || retainHandling == 1 && isNew)
+				}
 			}
 			c.submit(suback)
 
 			// Process retained messages.
-			for _, tq := range m.Topics {
-				c.svr.subs.sendRetain(tq.Topic, c)
+			for i, tq := range m.Topics {
+				if sendRetain[i] {
+					c.svr.subs.sendRetain(tq.Topic, suback.TopicsQos[i], c)
+				}
 			}
 
 		case *proto.Unsubscribe:
-			for _, t := range m.Topics {
-				c.svr.subs.unsub(t, c)
+			reasons := make([]byte, len(m.Topics))
+			for i, t := range m.Topics {
+				t, err := c.svr.subs.onUnsubscribe(&c.info, t)
+				switch {
+				case err != nil:
+					c.svr.logger().Printf("reader: hook refused unsubscription of %v from %q: %v", c.clientid, t, err)
+					reasons[i] = reasonNotAuthorized
+				case !c.svr.subs.unsub(t, c.sess):
+					reasons[i] = reasonNoSubscription
+				}
 			}
 			ack := &proto.UnsubAck{MessageId: m.MessageId}
-			c.submit(ack)
+			if p != nil {
+				c.submit(&packet5{m: ack, reasons: reasons})
+			} else {
+				c.submit(ack)
+			}
 
 		case *proto.Disconnect:
+			// A clean exit; the will is not published, unless an
+			// MQTT 5 client asks for it to be. MQTT 5 clients can
+			// change their minds about keeping the session, too.
+			if p == nil || p.reason != reasonDisconnectWithWill {
+				c.will = nil
+			}
+			graceful = true
+			if p != nil {
+				if pr, ok := p.props.get(propSessionExpiry); ok {
+					c.sess.setExpiry(sessionExpiry(pr.n))
+				}
+			}
 			return
 
 		default:
-			log.Printf("reader: unknown msg type %T", m)
+			c.svr.logger().Printf("reader: unknown msg type %T", m)
 			return
 		}
 	}
 }
 
+// The largest CONNECT a client may send. Anyone can send one, so it is
+// kept small, whatever MaxPacketSize allows later.
+const maxConnectSize = 64 << 10
+
+// The largest packet a client may send, from MaxPacketSize.
+func (s *Server) maxPacketSize() uint32 {
+	if s.MaxPacketSize == 0 || s.MaxPacketSize > maxRemaining {
+		return maxRemaining
+	}
+	return s.MaxPacketSize
+}
+
+// Read the first packet from the client, which is decoded as MQTT 5 if
+// it is a CONNECT asking for that, and by package proto otherwise.
+func (c *incomingConn) readConnect(r io.Reader) (proto.Message, *packet5, error) {
+	max := c.svr.maxPacketSize()
+	if max > maxConnectSize {
+		max = maxConnectSize
+	}
+	first, body, err := readPacket(r, max)
+	if err != nil {
+		return nil, nil, err
+	}
+	if proto.MessageType(first>>4) == proto.MsgConnect {
+		if name, level := connectVersion(body); name == "MQTT" && level == Version5 {
+			p, err := decode5(first, body)
+			if err != nil {
+				return nil, nil, err
+			}
+			return p.m, p, nil
+		}
+	}
+	m, err := proto.DecodeOneMessage(bytes.NewReader(rawPacket(first, body)), nil)
+	return m, nil, err
+}
+
+// Make the message to publish for the will in a CONNECT. Returns nil if
+// the will is not valid.
+func will(m *proto.Connect) *proto.Publish {
+	if m.WillTopic == "" || isWildcard(m.WillTopic) || !m.WillQos.IsValid() {
+		return nil
+	}
+	return &proto.Publish{
+		Header:    header(dupFalse, m.WillQos, retainFlag(m.WillRetain)),
+		TopicName: m.WillTopic,
+		Payload:   proto.BytesPayload(m.WillMessage),
+	}
+}
+
 func (c *incomingConn) writer() {
 
+	// The session is only known once the reader has accepted the
+	// CONNECT, which it does before queueing the CONNACK.
+	var sess *session
+
 	// Close connection on exit in order to cause reader to exit.
 	defer func() {
 		c.conn.Close()
-		c.del()
-		c.svr.subs.unsubAll(c)
+		close(c.gone)
+
+		// Give anything that did not get sent back to the session,
+		// until the reader closes the channel. The reader detaches
+		// the session first, so nothing more is published to us by
+		// then.
+		giveBack := func(job job) {
+			if job.r != nil {
+				close(job.r)
+			}
+			if m, ok := job.m.(*proto.Publish); ok && sess != nil {
+				sess.requeue(c, m)
+			}
+		}
+		for job := range c.jobs {
+			giveBack(job)
+		}
+		for len(c.pubs) > 0 {
+			giveBack(<-c.pubs)
+		}
+
+		c.svr.unregister(c)
+		close(c.Done)
+		c.svr.running.Done()
 	}()
 
-	for job := range c.jobs {
-		if c.svr.Dump {
-			log.Printf("dump out: %T %v", job.m, job.m)
+	retry := time.NewTicker(c.svr.RetryInterval)
+	defer retry.Stop()
+
+	// Send the message in a job, returning false if the writer
+	// should exit.
+	write := func(job job) bool {
+		if isConnAck(job.m) {
+			sess = c.sess
 		}
 
-		// TODO: write timeout
-		err := job.m.Encode(c.conn)
+		// MQTT 5 clients may limit the size of what we send.
+		if m, ok := job.m.(*proto.Publish); ok && c.maxOut > 0 && encodedSize(to5(m)) > int64(c.maxOut) {
+			c.svr.logger().Printf("writer: message on %v too large for %v, dropping it", m.TopicName, c)
+			return true
+		}
+
+		// QoS 1 and 2 messages get their message id now, and
+		// stay in flight until they are acked. Messages which
+		// already have one are being resent from the session.
+		if m, ok := job.m.(*proto.Publish); ok && m.Header.QosLevel != proto.QosAtMostOnce && m.MessageId == 0 {
+			if !sess.out.add(m, nil) {
+				c.svr.logger().Print(c, ": no message ids available, dropping message")
+				return true
+			}
+		}
+
+		err := c.send(job.m)
 		if job.r != nil {
 			// notifiy the sender that this message is sent
 			close(job.r)
 		}
 		if err != nil {
-			// This one is not interesting; it happens when clients
-			// disappear before we send their acks.
-			if err.Error() == "use of closed network connection" {
+			return false
+		}
+
+		if _, ok := unwrap(job.m).(*proto.Disconnect); ok {
+			c.svr.logger().Print("writer: sent disconnect message")
+			return false
+		}
+		return true
+	}
+
+	// Published messages kept apart are only sent once the CONNACK
+	// has been.
+	var pubs chan job
+
+	for {
+		if pubs == nil && sess != nil {
+			pubs = c.pubs
+		}
+		select {
+		case job, ok := <-c.jobs:
+			if !ok || !write(job) {
 				return
 			}
-			log.Print("writer: ", err)
+
+		case job := <-pubs:
+			if !write(job) {
+				return
+			}
+
+		case <-c.svr.quit:
+			// The server is shutting down: send what is queued
+			// already, and then say goodbye, if the client got
+			// as far as connecting. (MQTT 3 has no DISCONNECT from
+			// the server, but there is no harm in sending one
+			// before hanging up.)
+			for n := len(c.jobs); n > 0; n-- {
+				job, ok := <-c.jobs
+				if !ok || !write(job) {
+					return
+				}
+			}
+			for n := len(pubs); n > 0; n-- {
+				if !write(<-pubs) {
+					return
+				}
+			}
+			switch {
+			case sess == nil:
+			case c.version == Version5:
+				c.send(&packet5{m: &proto.Disconnect{}, reason: reasonServerShuttingDown})
+			default:
+				c.send(&proto.Disconnect{})
+			}
 			return
-		}
-		c.svr.stats.messageSend()
 
-		if _, ok := job.m.(*proto.Disconnect); ok {
-			log.Print("writer: sent disconnect message")
+		case <-c.kicked:
+			// Only MQTT 5 has a way to tell the client why.
+			if c.version == Version5 {
+				c.send(&packet5{m: &proto.Disconnect{}, reason: reasonSessionTakenOver})
+			}
 			return
+
+		case now := <-retry.C:
+			// MQTT 5 only allows resending when the session is
+			// resumed.
+			if sess == nil || c.version == Version5 {
+				continue
+			}
+			for _, m := range sess.out.due(now.Add(-c.svr.RetryInterval)) {
+				if err := c.send(m); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Write one message to the connection, in the client's protocol
+// version. Errors are logged here, and returned so that the writer
+// knows to exit.
+func (c *incomingConn) send(m message) error {
+	if c.version == Version5 {
+		m = to5(m)
+	}
+	c.dump("out", m)
+
+	if c.svr.WriteTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.svr.WriteTimeout))
+	}
+	err := m.Encode(meteredWriter{c.conn, &c.svr.stats.bytesSent})
+	if err != nil {
+		// This one is not interesting; it happens when clients
+		// disappear before we send their acks.
+		if !strings.HasSuffix(err.Error(), "use of closed network connection") {
+			c.svr.logger().Print("writer: ", err)
+		}
+		return err
+	}
+	c.svr.stats.messageSend(m)
+	return nil
+}
+
+// An inflight holds the QoS 1 and 2 messages sent to a client which
+// have not been completely acknowledged yet, indexed by message id.
+type inflight struct {
+	mu       sync.Mutex // guards access to fields below
+	next     uint16
+	msgs     map[uint16]*flight
+	reserved map[uint16]struct{} // ids in use by a ClientConn's SUBSCRIBEs and UNSUBSCRIBEs
+}
+
+type flight struct {
+	m    *proto.Publish
+	sent time.Time
+	rel  bool   // true once PUBREC is received; now waiting on PUBCOMP
+	tok  *Token // for a message published by a ClientConn
+}
+
+func newInflight() *inflight {
+	return &inflight{msgs: make(map[uint16]*flight), reserved: make(map[uint16]struct{})}
+}
+
+// Allocate a message id for m and start tracking it, along with its
+// Token, if it has one. Returns false if every message id is already
+// in use.
+func (f *inflight) add(m *proto.Publish, tok *Token) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id, ok := f.id()
+	if ok {
+		m.MessageId = id
+		f.msgs[id] = &flight{m: m, sent: time.Now(), tok: tok}
+	}
+	return ok
+}
+
+// Allocate a message id for something other than a PUBLISH, which is
+// in use until it is freed. Returns false if every message id is
+// already in use.
+func (f *inflight) reserve() (uint16, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id, ok := f.id()
+	if ok {
+		f.reserved[id] = struct{}{}
+	}
+	return id, ok
+}
+
+// Free a message id allocated by reserve.
+func (f *inflight) free(id uint16) {
+	f.mu.Lock()
+	delete(f.reserved, id)
+	f.mu.Unlock()
+}
+
+// Find a message id which is not in use. Called with f.mu held.
+func (f *inflight) id() (uint16, bool) {
+	for i := 0; i < 0xffff; i++ {
+		f.next++
+		// message id 0 is reserved
+		if f.next == 0 {
+			f.next++
+		}
+		_, busy := f.msgs[f.next]
+		if _, ok := f.reserved[f.next]; !ok && !busy {
+			return f.next, true
+		}
+	}
+	return 0, false
+}
+
+// Forget about a message; it is finished (PUBACK for QoS 1, PUBCOMP
+// for QoS 2). Returns what was known about it, if anything.
+func (f *inflight) ack(id uint16) *flight {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fl := f.msgs[id]
+	delete(f.msgs, id)
+	return fl
+}
+
+// Forget about all the messages, returning what was known about them.
+func (f *inflight) clear() []*flight {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var res []*flight
+	for id, fl := range f.msgs {
+		res = append(res, fl)
+		delete(f.msgs, id)
+	}
+	return res
+}
+
+// Forget about the QoS 2 messages, returning what was known about them.
+func (f *inflight) clearQos2() []*flight {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var res []*flight
+	for id, fl := range f.msgs {
+		if fl.m.Header.QosLevel == proto.QosExactlyOnce {
+			res = append(res, fl)
+			delete(f.msgs, id)
+		}
+	}
+	return res
+}
+
+// Note that a QoS 2 message has been received by the client (PUBREC);
+// from now on it is the PUBREL that needs to be resent, not the message.
+func (f *inflight) rec(id uint16) {
+	f.mu.Lock()
+	if fl, ok := f.msgs[id]; ok {
+		fl.rel = true
+		fl.sent = time.Now()
+	}
+	f.mu.Unlock()
+}
+
+// Return the messages that need to be resent because they were last
+// sent before the given time. Resent PUBLISH messages have the DUP flag
+// set; PUBREL has no DUP flag.
+func (f *inflight) due(before time.Time) []proto.Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var res []proto.Message
+	for id, fl := range f.msgs {
+		if fl.sent.After(before) {
+			continue
+		}
+		fl.sent = time.Now()
+		if fl.rel {
+			res = append(res, &proto.PubRel{
+				Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+				MessageId: id,
+			})
+		} else {
+			fl.m.Header.DupFlag = true
+			res = append(res, fl.m)
 		}
 	}
+	return res
 }
 
 // header is used to initialize a proto.Header when the zero value
@@ -713,120 +1544,307 @@ const clientQueueLength = 100
 
 // A ClientConn holds all the state associated with a connection
 // to an MQTT server. It should be allocated via NewClientConn.
+//
+// The protocol version to speak is chosen by setting Version before the
+// call to Connect. A server which does not speak it refuses the
+// connection with ConnectionErrors[1] (or just closes it), after which
+// an older version may be tried on a new connection.
+//
+// When Dial is set, a ClientConn which loses its connection makes a new
+// one, and carries on where it left off: see Dial.
 type ClientConn struct {
-	ClientId string              // May be set before the call to Connect.
+	ClientId string              // May be set before the call to Connect, which sets it to the one in use. Guarded by mu from then on.
+	Version  uint8               // Version31 (the default), Version311 or Version5; may be set before the call to Connect.
 	Dump     bool                // When true, dump the messages in and out.
-	Incoming chan *proto.Publish // Incoming messages arrive on this channel.
-	out      chan job
-	conn     net.Conn
-	done     chan struct{} // This channel will be readable once a Disconnect has been successfully sent and the connection is closed.
-	connack  chan *proto.ConnAck
-	suback   chan *proto.SubAck
+	Logger   Logger              // Where to log to; nil for the standard logger of package log. May be set before the call to Connect.
+	Capture  *Capture            // When set, the messages in and out are written to it. May be set before the call to Connect.
+	Incoming chan *proto.Publish // Incoming messages arrive on this channel, unless a handler takes them.
+
+	// When set, the messages which match none of the topic filters given
+	// to SubscribeHandler go to DefaultHandler, rather than to the
+	// Incoming channel. May be set before the call to Connect.
+	DefaultHandler MessageHandler
+
+	// When PersistentSession is set, the server is asked to keep the
+	// session (the subscriptions, and the QoS 1 and 2 messages for the
+	// client) while the client is disconnected, and to carry on with any
+	// session it kept from before, rather than starting clean. May be
+	// set before the call to Connect.
+	PersistentSession bool
+
+	// When set, the ClientConn reconnects when its connection is lost,
+	// once Connect has succeeded, until Disconnect is called. Dial makes
+	// the new connection, which is sent the CONNECT again, with the same
+	// ClientId, and then, unless the server kept the session, the
+	// SUBSCRIBEs which were acked. With a clean session, QoS 2 messages
+	// which the server had not yet acknowledged are not sent again, and
+	// their Tokens are finished with ErrSessionLost. Meanwhile,
+	// messages published are kept, to be sent once the ClientConn is
+	// connected again, and Incoming stays open. These may be set before
+	// the call to Connect.
+	Dial              func() (net.Conn, error)
+	ReconnectDelay    time.Duration                    // How long to wait before reconnecting. Defaults to 1 second, doubling with each further failure.
+	MaxReconnectDelay time.Duration                    // The longest to wait before reconnecting. Defaults to 1 minute.
+	StateChanged      func(state ConnState, err error) // When set, called as the connection comes and goes, with the error which ended it, if any.
+
+	// When KeepAlive is set, a PINGREQ is sent whenever nothing else has
+	// been sent to the server for that long, and the connection is
+	// closed, and reported lost with ErrPingTimeout, if the PINGRESP
+	// does not arrive within PingTimeout, which defaults to KeepAlive.
+	// The server is told the KeepAlive in the CONNECT, so that it can
+	// tell when the client is gone, too. These may be set before the
+	// call to Connect.
+	KeepAlive   time.Duration
+	PingTimeout time.Duration
+
+	out       chan job
+	done      chan struct{} // This channel will be readable once a Disconnect has been successfully sent and the connection is closed.
+	stop      chan struct{} // closed by Disconnect, so that there is no reconnecting
+	stopped   sync.Once
+	connack   chan *packet5 // CONNACKs in any version come wrapped up as MQTT 5 ones
+	connected chan struct{} // closed once Connect has succeeded
+	v5        int32         // set by Connect, using sync/atomic, when speaking MQTT 5
+
+	// The QoS 1 and 2 messages we published which are not finished yet,
+	// and the ids of the QoS 2 messages received which are waiting for
+	// their PUBREL; in is only touched by the reader, and by resume.
+	inflight *inflight
+	in       map[uint16]struct{}
+
+	mu         sync.Mutex                    // guards access to fields below
+	connectMsg *proto.Connect                // the CONNECT which was accepted, to send again on reconnecting
+	subscribed []message                     // the SUBSCRIBEs which were acked, to send again on reconnecting
+	routes     []route                       // the handlers given to SubscribeHandler
+	acks       map[uint16]chan proto.Message // the SUBACKs and UNSUBACKs waited for, by message id
 }
 
 // NewClientConn allocates a new ClientConn.
 func NewClientConn(c net.Conn) *ClientConn {
 	cc := &ClientConn{
-		conn:     c,
-		out:      make(chan job, clientQueueLength),
-		Incoming: make(chan *proto.Publish, clientQueueLength),
-		done:     make(chan struct{}),
-		connack:  make(chan *proto.ConnAck),
-		suback:   make(chan *proto.SubAck),
-	}
-	go cc.reader()
-	go cc.writer()
+		Incoming:          make(chan *proto.Publish, clientQueueLength),
+		ReconnectDelay:    time.Second,
+		MaxReconnectDelay: time.Minute,
+		out:               make(chan job, clientQueueLength),
+		done:              make(chan struct{}),
+		stop:              make(chan struct{}),
+		connack:           make(chan *packet5, 1),
+		connected:         make(chan struct{}),
+		acks:              make(map[uint16]chan proto.Message),
+		inflight:          newInflight(),
+		in:                make(map[uint16]struct{}),
+	}
+	go cc.run(c)
 	return cc
 }
 
-func (c *ClientConn) reader() {
+// Look after the connections: read and write this one until it ends,
+// and then, if we are to reconnect, the next one, and so on.
+func (c *ClientConn) run(conn net.Conn) {
 	defer func() {
-		// Cause the writer to exit.
-		close(c.out)
 		// Cause any goroutines waiting on messages to arrive to exit.
 		close(c.Incoming)
-		c.conn.Close()
+		close(c.connack)
+		c.abandon()
+		c.changed(StateClosed, nil)
 	}()
 
 	for {
-		// TODO: timeout (first message and/or keepalives)
-		m, err := proto.DecodeOneMessage(c.conn, nil)
+		gone := make(chan struct{})
+		k := newKeepalive()
+		var lost error
+		go func() {
+			lost = c.reader(conn, k)
+			close(gone)
+		}()
+		pinged := make(chan error, 1)
+		go func() {
+			pinged <- c.ping(conn, k, gone)
+		}()
+		disconnected := c.writer(conn, gone, k)
+		conn.Close()
+		<-gone
+		if err := <-pinged; err != nil {
+			// the reader only saw the connection closed
+			lost = err
+		}
+
+		if !disconnected && c.accepted() != nil {
+			c.changed(StateDisconnected, lost)
+		}
+		if disconnected || c.Dial == nil || c.accepted() == nil {
+			// Signal to Disconnect() that the message is on its
+			// way, or that the connection is closing one way or
+			// the other...
+			close(c.done)
+			return
+		}
+		c.failRequests()
+		if conn = c.reconnect(); conn == nil {
+			close(c.done)
+			return
+		}
+		c.changed(StateConnected, nil)
+	}
+}
+
+// Read a message from the server.
+func (c *ClientConn) read(r io.Reader) (proto.Message, *packet5, error) {
+	first, body, err := readPacket(r, maxRemaining)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var m proto.Message
+	var p *packet5
+	if atomic.LoadInt32(&c.v5) != 0 {
+		if p, err = decode5(first, body); err == nil {
+			m = p.m
+		}
+	} else {
+		m, err = proto.DecodeOneMessage(bytes.NewReader(rawPacket(first, body)), nil)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if p != nil {
+		c.dump("in", p)
+	} else {
+		c.dump("in", m)
+	}
+	// The CONNACK of MQTT 3.1.1 says whether the server kept the
+	// session, which package proto does not tell us.
+	if m, ok := m.(*proto.ConnAck); ok && p == nil {
+		p = &packet5{m: m, sessionPresent: len(body) > 0 && body[0]&1 != 0}
+	}
+	return m, p, nil
+}
+
+// Read from the connection until it ends, returning the error which
+// ended it, if it did not end cleanly.
+func (c *ClientConn) reader(conn net.Conn, k *keepalive) error {
+	for {
+		// TODO: timeout for the first message
+		m, p, err := c.read(conn)
 		if err != nil {
 			if err == io.EOF {
-				return
+				return nil
 			}
 			if strings.HasSuffix(err.Error(), "use of closed network connection") {
-				return
+				return nil
 			}
-			log.Print("cli reader: ", err)
-			return
+			c.logger().Print("cli reader: ", err)
+			return err
 		}
 
-		if c.Dump {
-			log.Printf("dump  in: %T %v", m, m)
+		if reply, ok := c.handle(m, p); ok {
+			if reply != nil {
+				c.queue(job{m: c.packet(reply)})
+			}
+			continue
 		}
-
 		switch m := m.(type) {
-		case *proto.Publish:
-			c.Incoming <- m
-		case *proto.PubAck:
-			// ignore these
-			continue
 		case *proto.ConnAck:
-			c.connack <- m
+			if p == nil {
+				p = &packet5{m: m}
+			}
+			select {
+			case c.connack <- p:
+			default:
+				c.logger().Print("cli reader: unexpected CONNACK")
+			}
 		case *proto.SubAck:
-			c.suback <- m
+			c.answer(m.MessageId, m)
+		case *proto.UnsubAck:
+			c.answer(m.MessageId, m)
+		case *proto.PingResp:
+			k.ponged()
 		case *proto.Disconnect:
-			return
+			return nil
 		default:
-			log.Printf("cli reader: got msg type %T", m)
+			c.logger().Printf("cli reader: got msg type %T", m)
 		}
 	}
 }
 
-func (c *ClientConn) writer() {
-	// Close connection on exit in order to cause reader to exit.
-	defer func() {
-		// Signal to Disconnect() that the message is on its way, or
-		// that the connection is closing one way or the other...
-		close(c.done)
-	}()
+// Write the messages queued to the connection, until it is gone.
+// Returns true if the last thing written was a DISCONNECT.
+func (c *ClientConn) writer(conn net.Conn, gone chan struct{}, k *keepalive) bool {
+	for {
+		var job job
+		select {
+		case job = <-c.out:
+		case <-gone:
+			return false
+		}
 
-	for job := range c.out {
-		if c.Dump {
-			log.Printf("dump out: %T %v", job.m, job.m)
+		// QoS 1 and 2 messages get their message ids as they are
+		// sent, and stay in flight until they are acked, to be sent
+		// again if we reconnect first.
+		m, _ := unwrap(job.m).(*proto.Publish)
+		if m != nil && m.Header.QosLevel != proto.QosAtMostOnce && m.MessageId == 0 {
+			if !c.inflight.add(m, job.tok) {
+				c.logger().Print("cli writer: no message ids available, dropping message")
+				job.tok.finish(errNoMessageIds)
+				continue
+			}
 		}
 
+		c.dump("out", job.m)
+
 		// TODO: write timeout
-		err := job.m.Encode(c.conn)
+		err := job.m.Encode(conn)
 		if job.r != nil {
 			close(job.r)
 		}
+		if m != nil && m.Header.QosLevel == proto.QosAtMostOnce && job.tok != nil {
+			job.tok.finish(err)
+		}
 
 		if err != nil {
-			log.Print("cli writer: ", err)
-			return
+			c.logger().Print("cli writer: ", err)
+			return false
 		}
+		k.wrote()
 
-		if _, ok := job.m.(*proto.Disconnect); ok {
-			return
+		if _, ok := unwrap(job.m).(*proto.Disconnect); ok {
+			return true
 		}
 	}
 }
 
 // Send the CONNECT message to the server. If the ClientId is not already
 // set, use a default (a 63-bit decimal random number). The "clean session"
-// bit is always set.
+// bit is set unless PersistentSession is.
 func (c *ClientConn) Connect(user, pass string) error {
-	// TODO: Keepalive timer
+	return c.ConnectContext(context.Background(), user, pass)
+}
+
+// ConnectContext is like Connect, but gives up when ctx is done, in
+// which case the ClientConn should be closed with Disconnect, since the
+// server may yet accept the CONNECT.
+func (c *ClientConn) ConnectContext(ctx context.Context, user, pass string) error {
+	// The reader and writer look at the ClientId, for dump.
+	c.mu.Lock()
 	if c.ClientId == "" {
 		c.ClientId = fmt.Sprint(cliRand.Int63())
 	}
+	id := c.ClientId
+	c.mu.Unlock()
 	req := &proto.Connect{
 		ProtocolName:    "MQIsdp",
-		ProtocolVersion: 3,
-		ClientId:        c.ClientId,
-		CleanSession:    true,
+		ProtocolVersion: Version31,
+		ClientId:        id,
+		CleanSession:    !c.PersistentSession,
+		KeepAliveTimer:  keepAliveTimer(c.KeepAlive),
+	}
+	switch c.Version {
+	case 0, Version31:
+	case Version311, Version5:
+		req.ProtocolName = "MQTT"
+		req.ProtocolVersion = c.Version
+	default:
+		return fmt.Errorf("mqtt: unknown protocol version %v", c.Version)
 	}
 	if user != "" {
 		req.UsernameFlag = true
@@ -835,9 +1853,65 @@ func (c *ClientConn) Connect(user, pass string) error {
 		req.Password = pass
 	}
 
-	c.sync(req)
-	ack := <-c.connack
-	return ConnectionErrors[ack.ReturnCode]
+	if c.Version == Version5 {
+		atomic.StoreInt32(&c.v5, 1)
+	}
+	// A CONNACK left over from an earlier Connect which gave up is
+	// not the answer to this one.
+	select {
+	case <-c.connack:
+	default:
+	}
+	if err := c.sync(ctx, c.connectPacket(req)); err != nil {
+		return err
+	}
+	var p *packet5
+	select {
+	case ack, ok := <-c.connack:
+		if !ok {
+			return errors.New("mqtt: connection closed before CONNACK")
+		}
+		p = ack
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	c.mu.Lock()
+	if pr, ok := p.props.get(propAssignedClientId); ok {
+		c.ClientId = pr.s
+	}
+	id = c.ClientId
+	c.mu.Unlock()
+	rc := p.m.(*proto.ConnAck).ReturnCode
+	if rc == proto.RetCodeAccepted {
+		// Keep it for reconnecting, with any client id we were given.
+		req.ClientId = id
+		c.mu.Lock()
+		if c.connectMsg == nil {
+			close(c.connected)
+		}
+		c.connectMsg = req
+		c.mu.Unlock()
+		c.changed(StateConnected, nil)
+	}
+	return ConnectionErrors[rc]
+}
+
+// Wrap up a CONNECT, which for a persistent MQTT 5 session asks for it
+// never to expire, since otherwise it ends with the connection.
+func (c *ClientConn) connectPacket(req *proto.Connect) message {
+	m := c.packet(req)
+	if p, ok := m.(*packet5); ok && !req.CleanSession {
+		p.props = properties{{id: propSessionExpiry, n: 0xffffffff}}
+	}
+	return m
+}
+
+// Wrap m up as an MQTT 5 packet, if that is what we speak.
+func (c *ClientConn) packet(m proto.Message) message {
+	if c.Version == Version5 {
+		return to5(m)
+	}
+	return m
 }
 
 // ConnectionErrors is an array of errors corresponding to the
@@ -852,37 +1926,202 @@ var ConnectionErrors = [6]error{
 }
 
 // Sent a DISCONNECT message to the server. This function blocks until the
-// disconnect message is actually sent, and the connection is closed.
+// disconnect message is actually sent, and the connection is closed. A
+// ClientConn which is reconnecting gives up.
 func (c *ClientConn) Disconnect() {
-	c.sync(&proto.Disconnect{})
-	<-c.done
+	c.DisconnectContext(context.Background())
+}
+
+// DisconnectContext is like Disconnect, but gives up waiting when ctx is
+// done, returning its error.
+func (c *ClientConn) DisconnectContext(ctx context.Context) error {
+	c.stopped.Do(func() { close(c.stop) })
+	if err := c.sync(ctx, c.packet(&proto.Disconnect{})); err != nil && err != ErrClientClosed {
+		return err
+	}
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // Subscribe subscribes this connection to a list of topics. Messages
-// will be delivered on the Incoming channel.
+// will be delivered to the DefaultHandler, or on the Incoming channel,
+// unless they match the topics of a SubscribeHandler. It returns nil if
+// the connection closes before the SUBACK arrives.
 func (c *ClientConn) Subscribe(tqs []proto.TopicQos) *proto.SubAck {
-	c.sync(&proto.Subscribe{
-		Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
-		MessageId: 0,
-		Topics:    tqs,
-	})
-	ack := <-c.suback
+	ack, _ := c.SubscribeContext(context.Background(), tqs)
 	return ack
 }
 
-// Publish publishes the given message to the MQTT server.
-// The QosLevel of the message must be QosAtLeastOnce for now.
-func (c *ClientConn) Publish(m *proto.Publish) {
-	if m.QosLevel != proto.QosAtMostOnce {
-		panic("unsupported QoS level")
+// SubscribeContext is like Subscribe, but gives up when ctx is done,
+// and returns an error rather than nil. If the connection is lost before
+// the SUBACK arrives, it returns ErrConnectionLost, and the subscription
+// is not made again on reconnecting; that is up to the caller.
+func (c *ClientConn) SubscribeContext(ctx context.Context, tqs []proto.TopicQos) (*proto.SubAck, error) {
+	return c.subscribe(ctx, c.packet(&proto.Subscribe{
+		Header: header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+		Topics: tqs,
+	}))
+}
+
+// Send a SUBSCRIBE, which may be an MQTT 5 one with subscription
+// options, and wait for the SUBACK.
+func (c *ClientConn) subscribe(ctx context.Context, m message) (*proto.SubAck, error) {
+	ack, err := c.request(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	suback, ok := ack.(*proto.SubAck)
+	if !ok {
+		return nil, fmt.Errorf("mqtt: expected SUBACK, got %T", ack)
+	}
+	c.mu.Lock()
+	c.subscribed = append(c.subscribed, m)
+	c.mu.Unlock()
+	return suback, nil
+}
+
+// Publish publishes the given message to the MQTT server, at the QoS
+// level in its header, and returns a Token which is finished when that
+// is done. The message is copied, so that it may be reused.
+func (c *ClientConn) Publish(m *proto.Publish) *Token {
+	return c.publish(context.Background(), m)
+}
+
+// PublishContext is like Publish, but waits for the Token to be
+// finished, giving up when ctx is done. A QoS 1 or 2 message which was
+// sent stays in flight when it gives up, and is still sent again on
+// reconnecting.
+func (c *ClientConn) PublishContext(ctx context.Context, m *proto.Publish) error {
+	tok := c.publish(ctx, m)
+	select {
+	case <-tok.Done():
+		return tok.Wait()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *ClientConn) publish(ctx context.Context, m *proto.Publish) *Token {
+	msg := *m
+	msg.Header.DupFlag = false
+	msg.MessageId = 0
+	tok := newToken()
+	if err := c.send(ctx, job{m: c.packet(&msg), tok: tok}); err != nil {
+		tok.finish(err)
+	}
+	return tok
+}
+
+// Queue a job for the writer, returning false if the writer has
+// stopped because the connection is gone.
+func (c *ClientConn) queue(j job) bool {
+	return c.send(context.Background(), j) == nil
+}
+
+// Queue a job for the writer, unless ctx is done first, or the writer
+// has stopped because the connection is gone.
+func (c *ClientConn) send(ctx context.Context, j job) error {
+	select {
+	case <-c.done:
+		return ErrClientClosed
+	default:
+	}
+	select {
+	case c.out <- j:
+		return nil
+	case <-c.done:
+		return ErrClientClosed
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	c.out <- job{m: m}
 }
 
-// sync sends a message and blocks until it was actually sent.
-func (c *ClientConn) sync(m proto.Message) {
+// sync sends a message and blocks until it was actually sent, the
+// connection is gone, or ctx is done.
+func (c *ClientConn) sync(ctx context.Context, m message) error {
 	j := job{m: m, r: make(receipt)}
-	c.out <- j
-	<-j.r
-	return
+	if err := c.send(ctx, j); err != nil {
+		return err
+	}
+	select {
+	case <-j.r:
+		return nil
+	case <-c.done:
+		return ErrClientClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Send m, a SUBSCRIBE or UNSUBSCRIBE, with a message id of its own,
+// and wait for the ack with that id, so that acks cannot go to the
+// wrong caller.
+func (c *ClientConn) request(ctx context.Context, m message) (proto.Message, error) {
+	id, ok := c.inflight.reserve()
+	if !ok {
+		return nil, errNoMessageIds
+	}
+	defer c.inflight.free(id)
+	switch m := unwrap(m).(type) {
+	case *proto.Subscribe:
+		m.MessageId = id
+	case *proto.Unsubscribe:
+		m.MessageId = id
+	}
+
+	ch := make(chan proto.Message, 1)
+	c.mu.Lock()
+	c.acks[id] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.acks, id)
+		c.mu.Unlock()
+	}()
+
+	if err := c.sync(ctx, m); err != nil {
+		return nil, err
+	}
+	select {
+	case ack, ok := <-ch:
+		if !ok {
+			return nil, ErrConnectionLost
+		}
+		return ack, nil
+	case <-c.done:
+		return nil, ErrClientClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Pass on an ack to the request waiting for it.
+func (c *ClientConn) answer(id uint16, m proto.Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := c.acks[id]
+	if ch == nil {
+		c.logger().Printf("cli reader: unexpected %T for message id %v", m, id)
+		return
+	}
+	select {
+	case ch <- m:
+	default:
+	}
+	delete(c.acks, id)
+}
+
+// Give up on the requests waiting for acks, which will not come now
+// that the connection they were sent on is lost.
+func (c *ClientConn) failRequests() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, ch := range c.acks {
+		close(ch)
+		delete(c.acks, id)
+	}
 }
@@ -2,59 +2,87 @@ package main
 
 import (
 	"code.google.com/p/jra-go/mqtt"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"expvar"
+	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
-type mlRes struct {
-	conn net.Conn
-	err  error
-}
+var authFile = flag.String("auth", "", "file of users and topic rules (see mqtt.FileAuth)")
+var retainDir = flag.String("retain", "", "directory to keep retained messages in (default: memory only)")
+var wsAddr = flag.String("ws", "", "address to serve MQTT over WebSocket on, at path /mqtt (e.g. :8080)")
+var unixPath = flag.String("unix", "", "path of a unix socket to serve MQTT on")
+var tlsAddr = flag.String("tls", "", "address to serve MQTT over TLS on (e.g. :8883)")
+var certFile = flag.String("cert", "server.crt", "TLS certificate file")
+var keyFile = flag.String("key", "server.key", "TLS key file")
+var caFile = flag.String("cafile", "", "file of CA certificates to verify TLS client certificates with")
+var requireCert = flag.Bool("require-cert", false, "refuse TLS clients without a client certificate")
+var bridgeAddr = flag.String("bridge", "", "address of a remote broker to bridge to (e.g. central:1883)")
+var bridgeTopics topicList
+var dump = flag.Bool("dump", false, "dump the messages in and out")
+var trace = flag.String("trace", "", "comma-separated client ids to dump the messages in and out of")
+var captureFile = flag.String("capture", "", "file to capture the messages in and out to, for replay")
 
-type multiListener struct {
-	listeners []net.Listener
-	next      chan mlRes
+func init() {
+	flag.Var(&bridgeTopics, "bridge-topic", `topic to bridge, as "pattern [in|out|both [qos [local-prefix [remote-prefix]]]]"; may be repeated`)
 }
 
-func newMultiListener(l ...net.Listener) *multiListener {
-	ml := &multiListener{
-		listeners: make([]net.Listener, len(l)),
-		next:      make(chan mlRes, len(l)),
-	}
-	copy(ml.listeners, l)
-
-	for _, l := range ml.listeners {
-		go func(l net.Listener, next chan mlRes) {
-			for {
-				res := mlRes{}
-				res.conn, res.err = l.Accept()
-				next <- res
-			}
-		}(l, ml.next)
-	}
+// A topicList is a flag.Value holding the bridge topics.
+type topicList []mqtt.BridgeTopic
 
-	return ml
+func (tl *topicList) String() string {
+	return fmt.Sprint(*tl)
 }
 
-func (ml *multiListener) Accept() (net.Conn, error) {
-	res := <-ml.next
-	return res.conn, res.err
-}
-
-func (ml *multiListener) Close() error {
-	for _, l := range ml.listeners {
-		l.Close()
+func (tl *topicList) Set(s string) error {
+	t, err := mqtt.ParseBridgeTopic(s)
+	if err != nil {
+		return err
 	}
+	*tl = append(*tl, t)
 	return nil
 }
 
-func (ml *multiListener) Addr() net.Addr {
-	return ml.listeners[0].Addr()
+// The TLS settings from the flags. Client certificates are asked for,
+// and verified, when there is a CA file to verify them with.
+func tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"mqtt"},
+	}
+	if *caFile != "" {
+		pem, err := ioutil.ReadFile(*caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %v", *caFile)
+		}
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
 }
 
 func main() {
+	flag.Parse()
+
 	// see godoc net/http/pprof
 	go func() {
 		log.Println(http.ListenAndServe("localhost:6060", nil))
@@ -66,6 +94,106 @@ func main() {
 		return
 	}
 	svr := mqtt.NewServer(l)
+	if *wsAddr != "" {
+		wl, err := net.Listen("tcp", *wsAddr)
+		if err != nil {
+			log.Print("listen: ", err)
+			return
+		}
+		svr.AddListener(mqtt.ServeWebSocket(wl, "/mqtt"), mqtt.ListenerConfig{Name: "websocket"})
+	}
+	if *unixPath != "" {
+		// A socket left behind by an earlier run is in the way.
+		os.Remove(*unixPath)
+		ul, err := net.Listen("unix", *unixPath)
+		if err != nil {
+			log.Print("listen: ", err)
+			return
+		}
+		svr.AddListener(ul, mqtt.ListenerConfig{Name: "unix"})
+	}
+	if *tlsAddr != "" {
+		cfg, err := tlsConfig()
+		if err != nil {
+			log.Print("tls: ", err)
+			return
+		}
+		tl, err := tls.Listen("tcp", *tlsAddr, cfg)
+		if err != nil {
+			log.Print("listen: ", err)
+			return
+		}
+		svr.AddListener(tl, mqtt.ListenerConfig{Name: "tls", RequireCert: *requireCert})
+	}
+	// The metrics are served with pprof, at /metrics for Prometheus
+	// and in /debug/vars for expvar.
+	http.Handle("/metrics", svr.MetricsHandler())
+	expvar.Publish("mqtt", svr.Vars())
+	if *authFile != "" {
+		auth, err := mqtt.LoadAuthFile(*authFile)
+		if err != nil {
+			log.Print("auth: ", err)
+			return
+		}
+		svr.Authenticator = auth
+		svr.Authorizer = auth
+	}
+	var rs *mqtt.FileRetainStore
+	if *retainDir != "" {
+		var err error
+		if rs, err = mqtt.OpenFileRetainStore(*retainDir); err != nil {
+			log.Print("retain: ", err)
+			return
+		}
+		svr.SetRetainStore(rs)
+	}
+	svr.Dump = *dump
+	if *trace != "" {
+		for _, id := range strings.Split(*trace, ",") {
+			svr.Trace(id, true)
+		}
+	}
+	if *captureFile != "" {
+		// The capture holds everything clients send, so it is
+		// for our eyes only.
+		f, err := os.OpenFile(*captureFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			log.Print("capture: ", err)
+			return
+		}
+		defer f.Close()
+		svr.Capture = mqtt.NewCapture(f)
+	}
 	svr.Start()
-	<-svr.Done
+
+	if *bridgeAddr != "" {
+		b := mqtt.NewBridge(svr, *bridgeAddr)
+		b.Topics = bridgeTopics
+		if err := b.Start(); err != nil {
+			log.Print("bridge: ", err)
+			return
+		}
+	}
+
+	// Stop cleanly when asked to, so that the clients are told and
+	// the retained messages are saved.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-sig:
+	case <-svr.Done:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := svr.Shutdown(ctx); err != nil {
+		// The retained messages are still being changed, so the
+		// store cannot be closed; what is in its log is kept.
+		log.Print("shutdown: ", err)
+		return
+	}
+	if rs != nil {
+		if err := rs.Close(); err != nil {
+			log.Print("retain: ", err)
+		}
+	}
 }
@@ -0,0 +1,804 @@
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	proto "github.com/huin/mqtt"
+)
+
+// The protocol levels a CONNECT can ask for.
+const (
+	Version31  = 3 // MQTT 3.1, with protocol name "MQIsdp"
+	Version311 = 4 // MQTT 3.1.1, with protocol name "MQTT"
+	Version5   = 5 // MQTT 5, with protocol name "MQTT"
+)
+
+// A message is anything that can be written to a connection: one of the
+// proto.Message types, or one of the packets below, for the protocol
+// versions package proto does not know about.
+type message interface {
+	Encode(w io.Writer) error
+}
+
+// A connAck4 is the CONNACK of MQTT 3.1.1, which, unlike that of MQTT
+// 3.1, says whether the server had a session for the client.
+type connAck4 struct {
+	sessionPresent bool
+	rc             proto.ReturnCode
+}
+
+func (m *connAck4) Encode(w io.Writer) error {
+	var flags byte
+	if m.sessionPresent {
+		flags = 1
+	}
+	_, err := w.Write([]byte{0x20, 2, flags, byte(m.rc)})
+	return err
+}
+
+func (m *connAck4) String() string {
+	return fmt.Sprintf("{ConnAck %v present=%v}", m.rc, m.sessionPresent)
+}
+
+// Is m a CONNACK, in any protocol version?
+func isConnAck(m message) bool {
+	switch unwrap(m).(type) {
+	case *proto.ConnAck, *connAck4:
+		return true
+	}
+	return false
+}
+
+// Find the proto.Message inside an MQTT 5 packet.
+func unwrap(m message) message {
+	if p, ok := m.(*packet5); ok {
+		return p.m
+	}
+	return m
+}
+
+// How many bytes m takes up on the wire.
+func encodedSize(m message) int64 {
+	var n countWriter
+	m.Encode(&n)
+	return int64(n)
+}
+
+type countWriter int64
+
+func (n *countWriter) Write(b []byte) (int, error) {
+	*n += countWriter(len(b))
+	return len(b), nil
+}
+
+// MQTT 5 (https://docs.oasis-open.org/mqtt/mqtt/v5.0/mqtt-v5.0.html)
+// keeps the packets of MQTT 3.1.1, but adds properties and reason codes
+// to most of them, which package proto cannot parse. So MQTT 5 packets
+// are decoded here into the proto types, along with what MQTT 5 adds,
+// and encoded from them, so that the rest of the package deals with the
+// same messages whichever version the client speaks. AUTH packets are
+// not supported.
+
+// A packet5 is an MQTT 5 packet.
+type packet5 struct {
+	m              proto.Message
+	props          properties
+	reason         byte       // for CONNACK, the publish acks and DISCONNECT
+	sessionPresent bool       // for CONNACK
+	willProps      properties // for CONNECT
+	opts           []byte     // for SUBSCRIBE, the options of each subscription
+	reasons        []byte     // for SUBACK and UNSUBACK
+}
+
+func (p *packet5) String() string {
+	return fmt.Sprintf("{MQTT 5 %T %v reason=%#x props=%v}", p.m, p.m, p.reason, p.props)
+}
+
+// Wrap m up as an MQTT 5 packet, if it is not one already.
+func to5(m message) message {
+	if pm, ok := m.(proto.Message); ok {
+		return &packet5{m: pm}
+	}
+	return m
+}
+
+// The reason codes used here.
+const (
+	reasonSuccess            = 0x00
+	reasonDisconnectWithWill = 0x04
+	reasonNoSubscription     = 0x11
+	reasonUnspecified        = 0x80
+	reasonUnsupportedVersion = 0x84
+	reasonIdentifierRejected = 0x85
+	reasonBadUserOrPassword  = 0x86
+	reasonNotAuthorized      = 0x87
+	reasonServerUnavailable  = 0x88
+	reasonServerShuttingDown = 0x8B
+	reasonBadAuthMethod      = 0x8C
+	reasonSessionTakenOver   = 0x8E
+	reasonTopicFilterInvalid = 0x8F
+	reasonTopicNameInvalid   = 0x90
+	reasonTopicAliasInvalid  = 0x94
+)
+
+// The CONNACK reason codes for the MQTT 3 return codes.
+var connackReasons = [...]byte{
+	proto.RetCodeAccepted:                    reasonSuccess,
+	proto.RetCodeUnacceptableProtocolVersion: reasonUnsupportedVersion,
+	proto.RetCodeIdentifierRejected:          reasonIdentifierRejected,
+	proto.RetCodeServerUnavailable:           reasonServerUnavailable,
+	proto.RetCodeBadUsernameOrPassword:       reasonBadUserOrPassword,
+	proto.RetCodeNotAuthorized:               reasonNotAuthorized,
+}
+
+// The MQTT 3 return code closest to a CONNACK reason code.
+func connackReturnCode(reason byte) proto.ReturnCode {
+	for rc, r := range connackReasons {
+		if r == reason {
+			return proto.ReturnCode(rc)
+		}
+	}
+	if reason < reasonUnspecified {
+		return proto.RetCodeAccepted
+	}
+	return proto.RetCodeServerUnavailable
+}
+
+// Property identifiers.
+const (
+	propPayloadFormat       = 0x01
+	propMessageExpiry       = 0x02
+	propContentType         = 0x03
+	propResponseTopic       = 0x08
+	propCorrelationData     = 0x09
+	propSubscriptionId      = 0x0B
+	propSessionExpiry       = 0x11
+	propAssignedClientId    = 0x12
+	propServerKeepAlive     = 0x13
+	propAuthMethod          = 0x15
+	propAuthData            = 0x16
+	propRequestProblemInfo  = 0x17
+	propWillDelay           = 0x18
+	propRequestResponseInfo = 0x19
+	propResponseInfo        = 0x1A
+	propServerReference     = 0x1C
+	propReasonString        = 0x1F
+	propReceiveMaximum      = 0x21
+	propTopicAliasMaximum   = 0x22
+	propTopicAlias          = 0x23
+	propMaximumQos          = 0x24
+	propRetainAvailable     = 0x25
+	propUserProperty        = 0x26
+	propMaximumPacketSize   = 0x27
+	propWildcardSubs        = 0x28
+	propSubscriptionIds     = 0x29
+	propSharedSubs          = 0x2A
+)
+
+// How the value of a property is encoded.
+type propKind int
+
+const (
+	kindByte propKind = iota + 1
+	kindUint16
+	kindUint32
+	kindVarint
+	kindString // strings and binary data
+	kindPair   // user properties
+)
+
+var propKinds = map[byte]propKind{
+	propPayloadFormat:       kindByte,
+	propMessageExpiry:       kindUint32,
+	propContentType:         kindString,
+	propResponseTopic:       kindString,
+	propCorrelationData:     kindString,
+	propSubscriptionId:      kindVarint,
+	propSessionExpiry:       kindUint32,
+	propAssignedClientId:    kindString,
+	propServerKeepAlive:     kindUint16,
+	propAuthMethod:          kindString,
+	propAuthData:            kindString,
+	propRequestProblemInfo:  kindByte,
+	propWillDelay:           kindUint32,
+	propRequestResponseInfo: kindByte,
+	propResponseInfo:        kindString,
+	propServerReference:     kindString,
+	propReasonString:        kindString,
+	propReceiveMaximum:      kindUint16,
+	propTopicAliasMaximum:   kindUint16,
+	propTopicAlias:          kindUint16,
+	propMaximumQos:          kindByte,
+	propRetainAvailable:     kindByte,
+	propUserProperty:        kindPair,
+	propMaximumPacketSize:   kindUint32,
+	propWildcardSubs:        kindByte,
+	propSubscriptionIds:     kindByte,
+	propSharedSubs:          kindByte,
+}
+
+// A property of an MQTT 5 packet.
+type property struct {
+	id byte
+	n  uint32 // the value of an integer property
+	s  string // the value of a string or binary property, or the name of a user property
+	v  string // the value of a user property
+}
+
+type properties []property
+
+// Find the first property with the given id.
+func (ps properties) get(id byte) (property, bool) {
+	for _, p := range ps {
+		if p.id == id {
+			return p, true
+		}
+	}
+	return property{}, false
+}
+
+// Return the properties, leaving out the ones with the given ids.
+func (ps properties) without(ids ...byte) properties {
+	var res properties
+outer:
+	for _, p := range ps {
+		for _, id := range ids {
+			if p.id == id {
+				continue outer
+			}
+		}
+		res = append(res, p)
+	}
+	return res
+}
+
+func (ps properties) encode(buf *bytes.Buffer) {
+	var b bytes.Buffer
+	for _, p := range ps {
+		putVarint(&b, uint32(p.id))
+		switch propKinds[p.id] {
+		case kindByte:
+			b.WriteByte(byte(p.n))
+		case kindUint16:
+			putUint16(&b, uint16(p.n))
+		case kindUint32:
+			putUint32(&b, p.n)
+		case kindVarint:
+			putVarint(&b, p.n)
+		case kindString:
+			putString(&b, p.s)
+		case kindPair:
+			putString(&b, p.s)
+			putString(&b, p.v)
+		}
+	}
+	putVarint(buf, uint32(b.Len()))
+	buf.Write(b.Bytes())
+}
+
+// A payload5 is the payload of a PUBLISH which arrived over MQTT 5,
+// together with the properties which go along with it to the
+// subscribers. To everything but an MQTT 5 subscriber, it is just the
+// payload.
+type payload5 struct {
+	proto.Payload
+	props properties
+}
+
+// Attach the properties which are passed on to subscribers to a payload.
+func withProps(pl proto.Payload, props properties) proto.Payload {
+	props = props.without(propTopicAlias, propSubscriptionId)
+	if len(props) == 0 {
+		return pl
+	}
+	return &payload5{Payload: pl, props: props}
+}
+
+func putUint16(buf *bytes.Buffer, v uint16) {
+	buf.WriteByte(byte(v >> 8))
+	buf.WriteByte(byte(v))
+}
+
+func putUint32(buf *bytes.Buffer, v uint32) {
+	putUint16(buf, uint16(v>>16))
+	putUint16(buf, uint16(v))
+}
+
+func putVarint(buf *bytes.Buffer, v uint32) {
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v != 0 {
+			b |= 0x80
+		}
+		buf.WriteByte(b)
+		if v == 0 {
+			return
+		}
+	}
+}
+
+func putString(buf *bytes.Buffer, s string) {
+	putUint16(buf, uint16(len(s)))
+	buf.WriteString(s)
+}
+
+// The largest remaining length that can be encoded.
+const maxRemaining = 268435455
+
+var (
+	errMalformed   = errors.New("mqtt: malformed packet")
+	errUnsupported = errors.New("mqtt: unsupported packet type")
+	errTooLarge    = errors.New("mqtt: packet too large")
+)
+
+// Read one packet, returning its first byte and what follows the
+// remaining length. Packets with more than max bytes after the remaining
+// length are refused before anything is allocated for them.
+func readPacket(r io.Reader, max uint32) (byte, []byte, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, nil, err
+	}
+	first := b[0]
+
+	var n, shift uint32
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errMalformed
+		}
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, nil, unexpectedEOF(err)
+		}
+		n |= uint32(b[0]&0x7f) << shift
+		shift += 7
+		if b[0]&0x80 == 0 {
+			break
+		}
+	}
+
+	if n > max {
+		return 0, nil, errTooLarge
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	return first, body, nil
+}
+
+// Running out of input part way through a packet is not a clean EOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Put a packet back together, as it was before readPacket took it apart.
+func rawPacket(first byte, body []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(first)
+	putVarint(&buf, uint32(len(body)))
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// Find the protocol name and level in the body of a CONNECT, without
+// decoding the rest of it.
+func connectVersion(body []byte) (string, byte) {
+	d := &dec5{b: body}
+	name := d.string()
+	level := d.byte()
+	if d.err != nil {
+		return "", 0
+	}
+	return name, level
+}
+
+// A dec5 decodes the fields of a packet. The first error sticks, and
+// the fields read after it are zero.
+type dec5 struct {
+	b   []byte
+	err error
+}
+
+func (d *dec5) take(n int) []byte {
+	if d.err != nil || len(d.b) < n {
+		d.err = errMalformed
+		return nil
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *dec5) byte() byte {
+	if b := d.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *dec5) uint16() uint16 {
+	if b := d.take(2); b != nil {
+		return uint16(b[0])<<8 | uint16(b[1])
+	}
+	return 0
+}
+
+func (d *dec5) uint32() uint32 {
+	if b := d.take(4); b != nil {
+		return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	}
+	return 0
+}
+
+func (d *dec5) varint() uint32 {
+	var n, shift uint32
+	for i := 0; i < 4; i++ {
+		b := d.byte()
+		n |= uint32(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			return n
+		}
+	}
+	d.err = errMalformed
+	return 0
+}
+
+func (d *dec5) string() string {
+	n := d.uint16()
+	return string(d.take(int(n)))
+}
+
+func (d *dec5) props() properties {
+	n := d.varint()
+	if d.err != nil || uint32(len(d.b)) < n {
+		d.err = errMalformed
+		return nil
+	}
+	pd := &dec5{b: d.b[:n]}
+	d.b = d.b[n:]
+
+	var ps properties
+	for len(pd.b) > 0 && pd.err == nil {
+		p := property{id: byte(pd.varint())}
+		switch propKinds[p.id] {
+		case kindByte:
+			p.n = uint32(pd.byte())
+		case kindUint16:
+			p.n = uint32(pd.uint16())
+		case kindUint32:
+			p.n = pd.uint32()
+		case kindVarint:
+			p.n = pd.varint()
+		case kindString:
+			p.s = pd.string()
+		case kindPair:
+			p.s = pd.string()
+			p.v = pd.string()
+		default:
+			pd.err = errMalformed
+		}
+		ps = append(ps, p)
+	}
+	if pd.err != nil {
+		d.err = pd.err
+	}
+	return ps
+}
+
+// Read an MQTT 5 packet, of no more than max bytes, as readPacket does.
+func read5(r io.Reader, max uint32) (*packet5, error) {
+	first, body, err := readPacket(r, max)
+	if err != nil {
+		return nil, err
+	}
+	return decode5(first, body)
+}
+
+// Decode an MQTT 5 packet, given its first byte and the rest of it.
+func decode5(first byte, body []byte) (*packet5, error) {
+	d := &dec5{b: body}
+	p := &packet5{}
+	hdr := proto.Header{
+		DupFlag:  first&0x08 != 0,
+		QosLevel: proto.QosLevel(first >> 1 & 3),
+		Retain:   first&0x01 != 0,
+	}
+
+	switch proto.MessageType(first >> 4) {
+	case proto.MsgConnect:
+		m := &proto.Connect{Header: hdr}
+		m.ProtocolName = d.string()
+		m.ProtocolVersion = d.byte()
+		flags := d.byte()
+		m.KeepAliveTimer = d.uint16()
+		p.props = d.props()
+		m.ClientId = d.string()
+		m.CleanSession = flags&0x02 != 0
+		m.WillFlag = flags&0x04 != 0
+		m.WillQos = proto.QosLevel(flags >> 3 & 3)
+		m.WillRetain = flags&0x20 != 0
+		m.PasswordFlag = flags&0x40 != 0
+		m.UsernameFlag = flags&0x80 != 0
+		if m.WillFlag {
+			p.willProps = d.props()
+			m.WillTopic = d.string()
+			m.WillMessage = d.string()
+		}
+		if m.UsernameFlag {
+			m.Username = d.string()
+		}
+		if m.PasswordFlag {
+			m.Password = d.string()
+		}
+		p.m = m
+
+	case proto.MsgConnAck:
+		p.sessionPresent = d.byte()&1 != 0
+		p.reason = d.byte()
+		p.props = d.props()
+		p.m = &proto.ConnAck{Header: hdr, ReturnCode: connackReturnCode(p.reason)}
+
+	case proto.MsgPublish:
+		m := &proto.Publish{Header: hdr}
+		m.TopicName = d.string()
+		if hdr.QosLevel.HasId() {
+			m.MessageId = d.uint16()
+		}
+		p.props = d.props()
+		m.Payload = withProps(proto.BytesPayload(d.take(len(d.b))), p.props)
+		p.m = m
+
+	case proto.MsgPubAck, proto.MsgPubRec, proto.MsgPubRel, proto.MsgPubComp:
+		id := d.uint16()
+		if len(d.b) > 0 {
+			p.reason = d.byte()
+		}
+		if len(d.b) > 0 {
+			p.props = d.props()
+		}
+		switch proto.MessageType(first >> 4) {
+		case proto.MsgPubAck:
+			p.m = &proto.PubAck{Header: hdr, MessageId: id}
+		case proto.MsgPubRec:
+			p.m = &proto.PubRec{Header: hdr, MessageId: id}
+		case proto.MsgPubRel:
+			p.m = &proto.PubRel{Header: hdr, MessageId: id}
+		default:
+			p.m = &proto.PubComp{Header: hdr, MessageId: id}
+		}
+
+	case proto.MsgSubscribe:
+		m := &proto.Subscribe{Header: hdr}
+		m.MessageId = d.uint16()
+		p.props = d.props()
+		for len(d.b) > 0 && d.err == nil {
+			topic := d.string()
+			opts := d.byte()
+			m.Topics = append(m.Topics, proto.TopicQos{Topic: topic, Qos: proto.QosLevel(opts & 3)})
+			p.opts = append(p.opts, opts)
+		}
+		p.m = m
+
+	case proto.MsgSubAck:
+		m := &proto.SubAck{Header: hdr}
+		m.MessageId = d.uint16()
+		p.props = d.props()
+		p.reasons = d.take(len(d.b))
+		for _, r := range p.reasons {
+			m.TopicsQos = append(m.TopicsQos, proto.QosLevel(r))
+		}
+		p.m = m
+
+	case proto.MsgUnsubscribe:
+		m := &proto.Unsubscribe{Header: hdr}
+		m.MessageId = d.uint16()
+		p.props = d.props()
+		for len(d.b) > 0 && d.err == nil {
+			m.Topics = append(m.Topics, d.string())
+		}
+		p.m = m
+
+	case proto.MsgUnsubAck:
+		m := &proto.UnsubAck{Header: hdr}
+		m.MessageId = d.uint16()
+		p.props = d.props()
+		p.reasons = d.take(len(d.b))
+		p.m = m
+
+	case proto.MsgPingReq:
+		p.m = &proto.PingReq{Header: hdr}
+
+	case proto.MsgPingResp:
+		p.m = &proto.PingResp{Header: hdr}
+
+	case proto.MsgDisconnect:
+		if len(d.b) > 0 {
+			p.reason = d.byte()
+		}
+		if len(d.b) > 0 {
+			p.props = d.props()
+		}
+		p.m = &proto.Disconnect{Header: hdr}
+
+	default:
+		return nil, errUnsupported
+	}
+
+	if d.err == nil && len(d.b) != 0 {
+		d.err = errMalformed
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return p, nil
+}
+
+// Encode implements message.
+func (p *packet5) Encode(w io.Writer) error {
+	var buf bytes.Buffer
+	var first byte
+
+	switch m := p.m.(type) {
+	case *proto.Connect:
+		first = byte(proto.MsgConnect) << 4
+		putString(&buf, "MQTT")
+		buf.WriteByte(Version5)
+		var flags byte
+		if m.CleanSession {
+			flags |= 0x02
+		}
+		if m.WillFlag {
+			flags |= 0x04 | byte(m.WillQos)<<3
+			if m.WillRetain {
+				flags |= 0x20
+			}
+		}
+		if m.PasswordFlag {
+			flags |= 0x40
+		}
+		if m.UsernameFlag {
+			flags |= 0x80
+		}
+		buf.WriteByte(flags)
+		putUint16(&buf, m.KeepAliveTimer)
+		p.props.encode(&buf)
+		putString(&buf, m.ClientId)
+		if m.WillFlag {
+			p.willProps.encode(&buf)
+			putString(&buf, m.WillTopic)
+			putString(&buf, m.WillMessage)
+		}
+		if m.UsernameFlag {
+			putString(&buf, m.Username)
+		}
+		if m.PasswordFlag {
+			putString(&buf, m.Password)
+		}
+
+	case *proto.ConnAck:
+		first = byte(proto.MsgConnAck) << 4
+		if p.sessionPresent {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+		reason := p.reason
+		if reason == reasonSuccess && int(m.ReturnCode) < len(connackReasons) {
+			reason = connackReasons[m.ReturnCode]
+		}
+		buf.WriteByte(reason)
+		p.props.encode(&buf)
+
+	case *proto.Publish:
+		first = byte(proto.MsgPublish)<<4 | byte(m.Header.QosLevel)<<1
+		if m.Header.DupFlag {
+			first |= 0x08
+		}
+		if m.Header.Retain {
+			first |= 0x01
+		}
+		putString(&buf, m.TopicName)
+		if m.Header.QosLevel.HasId() {
+			putUint16(&buf, m.MessageId)
+		}
+		props := p.props
+		if pl, ok := m.Payload.(*payload5); ok {
+			props = append(pl.props[:len(pl.props):len(pl.props)], props...)
+		}
+		props.encode(&buf)
+		if err := m.Payload.WritePayload(&buf); err != nil {
+			return err
+		}
+
+	case *proto.PubAck:
+		first = byte(proto.MsgPubAck) << 4
+		p.encodeAck(&buf, m.MessageId)
+	case *proto.PubRec:
+		first = byte(proto.MsgPubRec) << 4
+		p.encodeAck(&buf, m.MessageId)
+	case *proto.PubRel:
+		first = byte(proto.MsgPubRel)<<4 | 0x02
+		p.encodeAck(&buf, m.MessageId)
+	case *proto.PubComp:
+		first = byte(proto.MsgPubComp) << 4
+		p.encodeAck(&buf, m.MessageId)
+
+	case *proto.Subscribe:
+		first = byte(proto.MsgSubscribe)<<4 | 0x02
+		putUint16(&buf, m.MessageId)
+		p.props.encode(&buf)
+		for i, tq := range m.Topics {
+			putString(&buf, tq.Topic)
+			if i < len(p.opts) {
+				buf.WriteByte(p.opts[i])
+			} else {
+				buf.WriteByte(byte(tq.Qos))
+			}
+		}
+
+	case *proto.SubAck:
+		first = byte(proto.MsgSubAck) << 4
+		putUint16(&buf, m.MessageId)
+		p.props.encode(&buf)
+		if p.reasons != nil {
+			buf.Write(p.reasons)
+		} else {
+			for _, q := range m.TopicsQos {
+				buf.WriteByte(byte(q))
+			}
+		}
+
+	case *proto.Unsubscribe:
+		first = byte(proto.MsgUnsubscribe)<<4 | 0x02
+		putUint16(&buf, m.MessageId)
+		p.props.encode(&buf)
+		for _, t := range m.Topics {
+			putString(&buf, t)
+		}
+
+	case *proto.UnsubAck:
+		first = byte(proto.MsgUnsubAck) << 4
+		putUint16(&buf, m.MessageId)
+		p.props.encode(&buf)
+		buf.Write(p.reasons)
+
+	case *proto.PingReq:
+		first = byte(proto.MsgPingReq) << 4
+	case *proto.PingResp:
+		first = byte(proto.MsgPingResp) << 4
+
+	case *proto.Disconnect:
+		first = byte(proto.MsgDisconnect) << 4
+		if p.reason != reasonSuccess || len(p.props) > 0 {
+			buf.WriteByte(p.reason)
+			p.props.encode(&buf)
+		}
+
+	default:
+		return errUnsupported
+	}
+
+	if buf.Len() > maxRemaining {
+		return errors.New("mqtt: packet too large")
+	}
+	_, err := w.Write(rawPacket(first, buf.Bytes()))
+	return err
+}
+
+// The reason code and properties of the publish acks may be left out
+// when there is nothing to say.
+func (p *packet5) encodeAck(buf *bytes.Buffer, id uint16) {
+	putUint16(buf, id)
+	if p.reason != reasonSuccess || len(p.props) > 0 {
+		buf.WriteByte(p.reason)
+		p.props.encode(buf)
+	}
+}
@@ -0,0 +1,381 @@
+package mqtt
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestCodec5(t *testing.T) {
+	pub := &proto.Publish{
+		Header:    header(dupTrue, proto.QosExactlyOnce, retainTrue),
+		TopicName: "a/b",
+		MessageId: 9,
+		Payload:   proto.BytesPayload("hello"),
+	}
+	user := property{id: propUserProperty, s: "k", v: "v"}
+	packets := []*packet5{
+		{
+			m: &proto.Connect{
+				ProtocolName:    "MQTT",
+				ProtocolVersion: Version5,
+				CleanSession:    true,
+				KeepAliveTimer:  30,
+				ClientId:        "c",
+				WillFlag:        true,
+				WillQos:         proto.QosAtLeastOnce,
+				WillTopic:       "will",
+				WillMessage:     "bye",
+				UsernameFlag:    true,
+				PasswordFlag:    true,
+				Username:        "u",
+				Password:        "p",
+			},
+			props:     properties{{id: propSessionExpiry, n: 60}, {id: propReceiveMaximum, n: 10}},
+			willProps: properties{{id: propWillDelay, n: 5}},
+		},
+		{
+			m:              &proto.ConnAck{ReturnCode: proto.RetCodeAccepted},
+			sessionPresent: true,
+			props:          properties{{id: propAssignedClientId, s: "auto-1"}},
+		},
+		{m: pub, props: properties{{id: propTopicAlias, n: 1}}},
+		{m: &proto.PubAck{MessageId: 1}},
+		{m: &proto.PubRec{MessageId: 2}, reason: reasonNotAuthorized},
+		{m: &proto.PubRel{Header: header(dupFalse, proto.QosAtLeastOnce, retainFalse), MessageId: 3}},
+		{m: &proto.PubComp{MessageId: 4}, props: properties{user}},
+		{
+			m: &proto.Subscribe{
+				Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+				MessageId: 5,
+				Topics:    []proto.TopicQos{{Topic: "x/#", Qos: proto.QosAtLeastOnce}},
+			},
+			opts: []byte{0x2d},
+		},
+		{m: &proto.SubAck{MessageId: 5, TopicsQos: []proto.QosLevel{1}}, reasons: []byte{1}},
+		{
+			m: &proto.Unsubscribe{
+				Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+				MessageId: 6,
+				Topics:    []string{"x/#", "y"},
+			},
+		},
+		{m: &proto.UnsubAck{MessageId: 6}, reasons: []byte{0, reasonNoSubscription}},
+		{m: &proto.PingReq{}},
+		{m: &proto.PingResp{}},
+		{m: &proto.Disconnect{}},
+		{m: &proto.Disconnect{}, reason: reasonDisconnectWithWill, props: properties{{id: propSessionExpiry, n: 0}}},
+	}
+	for _, want := range packets {
+		var buf bytes.Buffer
+		if err := want.Encode(&buf); err != nil {
+			t.Fatalf("%v: %v", want, err)
+		}
+		got, err := read5(&buf, maxRemaining)
+		if err != nil {
+			t.Fatalf("%v: %v", want, err)
+		}
+
+		// The payload comes back with the properties attached.
+		if m, ok := got.m.(*proto.Publish); ok {
+			pl, ok := m.Payload.(proto.BytesPayload)
+			if !ok || string(pl) != "hello" {
+				t.Fatalf("bad payload %#v", m.Payload)
+			}
+			m.Payload = pub.Payload
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+
+	// Properties which come with the payload go out with it again.
+	pl := withProps(proto.BytesPayload("x"), properties{user, {id: propTopicAlias, n: 3}})
+	var buf bytes.Buffer
+	to5(&proto.Publish{TopicName: "t", Payload: pl}).Encode(&buf)
+	got, err := read5(&buf, maxRemaining)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.props, properties{user}) {
+		t.Errorf("got properties %v", got.props)
+	}
+
+	// Trailing garbage is not allowed.
+	if _, err := decode5(byte(proto.MsgPingReq)<<4, []byte{0}); err != errMalformed {
+		t.Error("expected malformed packet, got ", err)
+	}
+}
+
+func (tc *testClient) send5(p *packet5) {
+	tc.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if err := p.Encode(tc.conn); err != nil {
+		tc.t.Fatal("send: ", err)
+	}
+}
+
+func (tc *testClient) recv5() *packet5 {
+	tc.conn.SetReadDeadline(time.Now().Add(time.Second))
+	p, err := read5(tc.conn, maxRemaining)
+	if err != nil {
+		tc.t.Fatal("recv: ", err)
+	}
+	return p
+}
+
+// Connect with MQTT 5, and return the CONNACK.
+func (tc *testClient) connect5(id string, cleanStart bool, props ...property) *packet5 {
+	tc.send5(&packet5{
+		m: &proto.Connect{
+			ProtocolName:    "MQTT",
+			ProtocolVersion: Version5,
+			ClientId:        id,
+			CleanSession:    cleanStart,
+		},
+		props: props,
+	})
+	ack := tc.recv5()
+	if m, ok := ack.m.(*proto.ConnAck); !ok || m.ReturnCode != proto.RetCodeAccepted {
+		tc.t.Fatalf("%v: bad connack %v", id, ack)
+	}
+	return ack
+}
+
+func TestVersion311(t *testing.T) {
+	svr := NewServer(nil)
+
+	connect := func(id string, clean bool) (byte, []byte) {
+		tc := dialTest(t, svr)
+		tc.send(&proto.Connect{
+			ProtocolName:    "MQTT",
+			ProtocolVersion: Version311,
+			ClientId:        id,
+			CleanSession:    clean,
+		})
+		tc.conn.SetReadDeadline(time.Now().Add(time.Second))
+		first, body, err := readPacket(tc.conn, maxRemaining)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc.conn.Close()
+		return first, body
+	}
+
+	var tests = []struct {
+		id    string
+		clean bool
+		want  []byte // flags and return code
+	}{
+		{"", true, []byte{0, byte(proto.RetCodeAccepted)}},
+		{"", false, []byte{0, byte(proto.RetCodeIdentifierRejected)}},
+		{"a-client-id-longer-than-23-bytes", false, []byte{0, byte(proto.RetCodeAccepted)}},
+		{"a-client-id-longer-than-23-bytes", false, []byte{1, byte(proto.RetCodeAccepted)}},
+	}
+	for _, x := range tests {
+		first, body := connect(x.id, x.clean)
+		if first != 0x20 || !bytes.Equal(body, x.want) {
+			t.Errorf("%q clean=%v: got %#x %v, want %v", x.id, x.clean, first, body, x.want)
+		}
+	}
+
+	// Subscriptions which cannot be made are refused.
+	tc := dialTest(t, svr)
+	tc.send(&proto.Connect{
+		ProtocolName:    "MQTT",
+		ProtocolVersion: Version311,
+		ClientId:        "sub",
+		CleanSession:    true,
+	})
+	readPacket(tc.conn, maxRemaining)
+	tc.send(&proto.Subscribe{
+		Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+		MessageId: 1,
+		Topics:    []proto.TopicQos{{Topic: "a/#/b", Qos: 1}, {Topic: "a/+", Qos: 1}},
+	})
+	ack, ok := tc.recv().(*proto.SubAck)
+	if !ok || !reflect.DeepEqual(ack.TopicsQos, []proto.QosLevel{0x80, 1}) {
+		t.Fatalf("bad suback %v", ack)
+	}
+}
+
+func TestVersion5(t *testing.T) {
+	svr := NewServer(nil)
+	svr.MaxTopicAlias = 2
+
+	sub := dialTest(t, svr)
+	ack := sub.connect5("", true)
+	id, ok := ack.props.get(propAssignedClientId)
+	if !ok || id.s == "" {
+		t.Fatal("no client id assigned: ", ack)
+	}
+	if max, ok := ack.props.get(propTopicAliasMaximum); !ok || max.n != 2 {
+		t.Fatal("bad topic alias maximum: ", ack)
+	}
+	sub.send5(&packet5{
+		m: &proto.Subscribe{
+			Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+			MessageId: 1,
+			Topics: []proto.TopicQos{
+				{Topic: "v5/+", Qos: proto.QosAtLeastOnce},
+				{Topic: "v5/#/bad", Qos: proto.QosAtLeastOnce},
+			},
+		},
+		opts: []byte{0x01 | 0x04, 0x01},
+	})
+	if p := sub.recv5(); !bytes.Equal(p.reasons, []byte{1, reasonTopicFilterInvalid}) {
+		t.Fatalf("bad suback %v", p)
+	}
+
+	// The subscriber does not hear its own messages (No Local).
+	sub.send5(&packet5{m: &proto.Publish{TopicName: "v5/own", Payload: proto.BytesPayload("own")}})
+
+	// An MQTT 3.1 publisher is not told its message is refused...
+	pub := newTestClient(t, svr, "pub")
+	pub.send(&proto.Publish{
+		Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+		TopicName: "v5/#",
+		MessageId: 1,
+		Payload:   proto.BytesPayload("x"),
+	})
+	if m, ok := pub.recv().(*proto.PubAck); !ok || m.MessageId != 1 {
+		t.Fatalf("expected PUBACK, got %v", m)
+	}
+
+	// ...but an MQTT 5 one is.
+	pub5 := dialTest(t, svr)
+	pub5.connect5("pub5", true)
+	pub5.send5(&packet5{m: &proto.Publish{
+		Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+		TopicName: "v5/#",
+		MessageId: 2,
+		Payload:   proto.BytesPayload("x"),
+	}})
+	if p := pub5.recv5(); p.reason != reasonTopicNameInvalid {
+		t.Fatalf("expected refusal, got %v", p)
+	}
+
+	// Set up a topic alias, and then use it. User properties go
+	// through to the subscriber.
+	user := property{id: propUserProperty, s: "k", v: "v"}
+	for _, topic := range []string{"v5/alias", ""} {
+		pub5.send5(&packet5{
+			m:     &proto.Publish{TopicName: topic, Payload: proto.BytesPayload("a")},
+			props: properties{{id: propTopicAlias, n: 2}, user},
+		})
+		p := sub.recv5()
+		m, ok := p.m.(*proto.Publish)
+		if !ok || m.TopicName != "v5/alias" || !reflect.DeepEqual(p.props, properties{user}) {
+			t.Fatalf("bad message through alias: %v", p)
+		}
+	}
+
+	// Unsubscribing says whether there was a subscription.
+	sub.send5(&packet5{m: &proto.Unsubscribe{
+		Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+		MessageId: 2,
+		Topics:    []string{"v5/+", "v5/+"},
+	}})
+	if p := sub.recv5(); !bytes.Equal(p.reasons, []byte{0, reasonNoSubscription}) {
+		t.Fatalf("bad unsuback %v", p)
+	}
+
+	// An alias out of range gets the publisher thrown out.
+	pub5.send5(&packet5{
+		m:     &proto.Publish{TopicName: "v5/x", Payload: proto.BytesPayload("a")},
+		props: properties{{id: propTopicAlias, n: 3}},
+	})
+	if p := pub5.recv5(); p.reason != reasonTopicAliasInvalid {
+		t.Fatalf("expected DISCONNECT, got %v", p)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	svr := NewServer(nil)
+	pub := newTestClient(t, svr, "pub")
+
+	// Wait for the server to be done with the connection.
+	detached := func() {
+		for {
+			svr.sessionsMu.Lock()
+			sess := svr.sessions["exp"]
+			svr.sessionsMu.Unlock()
+			sess.mu.Lock()
+			gone := sess.c == nil
+			sess.mu.Unlock()
+			if gone {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	sub := dialTest(t, svr)
+	sub.connect5("exp", true, property{id: propSessionExpiry, n: 1})
+	sub.send5(&packet5{m: &proto.Subscribe{
+		Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+		MessageId: 1,
+		Topics:    []proto.TopicQos{{Topic: "exp", Qos: proto.QosAtLeastOnce}},
+	}})
+	sub.recv5()
+	sub.send5(&packet5{m: &proto.Disconnect{}})
+	sub.conn.Close()
+	detached()
+
+	// Within the expiry, the session is still there, with the
+	// message that arrived in the meantime.
+	pub.send(&proto.Publish{
+		Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+		TopicName: "exp",
+		MessageId: 1,
+		Payload:   proto.BytesPayload("queued"),
+	})
+	pub.recv()
+	sub = dialTest(t, svr)
+	if ack := sub.connect5("exp", false, property{id: propSessionExpiry, n: 1}); !ack.sessionPresent {
+		t.Fatal("session not kept")
+	}
+	p := sub.recv5()
+	if m, ok := p.m.(*proto.Publish); !ok || m.TopicName != "exp" {
+		t.Fatalf("expected queued message, got %v", p)
+	}
+	sub.conn.Close()
+	detached()
+
+	// After it, it is gone.
+	time.Sleep(1500 * time.Millisecond)
+	sub = dialTest(t, svr)
+	if ack := sub.connect5("exp", false); ack.sessionPresent {
+		t.Fatal("session not expired")
+	}
+}
+
+func TestClientVersions(t *testing.T) {
+	svr := NewServer(nil)
+	for _, v := range []uint8{Version31, Version311, Version5} {
+		cli, srv := net.Pipe()
+		c := svr.newIncomingConn(srv)
+		svr.stats.clientConnect()
+		c.start()
+
+		cc := NewClientConn(cli)
+		cc.Version = v
+		if err := cc.Connect("", ""); err != nil {
+			t.Fatalf("version %v: %v", v, err)
+		}
+		cc.Subscribe([]proto.TopicQos{{Topic: "cv", Qos: proto.QosAtMostOnce}})
+		cc.Publish(&proto.Publish{TopicName: "cv", Payload: proto.BytesPayload("x")})
+		select {
+		case m := <-cc.Incoming:
+			if m.TopicName != "cv" {
+				t.Fatalf("version %v: got %v", v, m)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("version %v: message did not arrive", v)
+		}
+		cc.Disconnect()
+	}
+}
@@ -15,6 +15,7 @@ var user = flag.String("user", "", "username")
 var pass = flag.String("pass", "", "password")
 var dump = flag.Bool("dump", false, "dump messages?")
 var retain = flag.Bool("retain", false, "retain message?")
+var qos = flag.Int("qos", 0, "QoS level to publish at (0, 1 or 2)")
 var wait = flag.Bool("wait", false, "stay connected after publishing?")
 
 func main() {
@@ -39,11 +40,15 @@ func main() {
 	}
 	fmt.Println("Connected with client id ", cc.ClientId)
 
-	cc.Publish(&proto.Publish{
-		Header:    proto.Header{Retain: *retain},
+	tok := cc.Publish(&proto.Publish{
+		Header:    proto.Header{QosLevel: proto.QosLevel(*qos), Retain: *retain},
 		TopicName: flag.Arg(0),
 		Payload:   proto.BytesPayload([]byte(flag.Arg(1))),
 	})
+	if err := tok.Wait(); err != nil {
+		fmt.Fprintf(os.Stderr, "publish: %v\n", err)
+		os.Exit(1)
+	}
 
 	if *wait {
 		<-make(chan bool)
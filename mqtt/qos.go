@@ -0,0 +1,173 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A Token follows a message published by a ClientConn. It is finished
+// once the message has been sent, for QoS 0, or once it has been acked:
+// by PUBACK for QoS 1, and by PUBCOMP for QoS 2. A message in flight
+// when the connection is lost is sent again, with the DUP flag set, if
+// the ClientConn reconnects.
+type Token struct {
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+func newToken() *Token {
+	return &Token{done: make(chan struct{})}
+}
+
+func (t *Token) finish(err error) {
+	t.once.Do(func() {
+		t.err = err
+		close(t.done)
+	})
+}
+
+// Done returns a channel which is closed when the token is finished.
+func (t *Token) Done() <-chan struct{} {
+	return t.done
+}
+
+// Wait waits for the token to be finished. It returns an error if an
+// MQTT 5 server refused the message, or if the ClientConn was closed
+// first.
+func (t *Token) Wait() error {
+	<-t.done
+	return t.err
+}
+
+// ErrClientClosed finishes the Tokens of messages which were not
+// finished when their ClientConn was closed.
+var ErrClientClosed = errors.New("mqtt: client connection closed")
+
+// ErrConnectionLost is returned by SubscribeContext and
+// UnsubscribeContext when the connection is lost before the ack
+// arrives, and the ClientConn is reconnecting.
+var ErrConnectionLost = errors.New("mqtt: connection lost")
+
+// ErrSessionLost finishes the Tokens of the QoS 2 messages which the
+// server had not acknowledged when a ClientConn reconnected to it, and
+// found it had started a new session. They may or may not have been
+// delivered, and are not sent again, in case they were.
+var ErrSessionLost = errors.New("mqtt: session lost before QoS 2 message was acknowledged")
+
+var errNoMessageIds = errors.New("mqtt: no message ids available")
+
+// The error for an ack with an MQTT 5 reason code, if it is a failure.
+func ackError(p *packet5) error {
+	if p == nil || p.reason < reasonUnspecified {
+		return nil
+	}
+	return fmt.Errorf("mqtt: message refused, reason code %#x", p.reason)
+}
+
+// Pass on a message from the server, returning the ack to send for it,
+// if any. A QoS 2 message is passed on only the first time it arrives,
+// until its PUBREL arrives.
+func (c *ClientConn) receive(m *proto.Publish) proto.Message {
+	switch m.Header.QosLevel {
+	case proto.QosAtLeastOnce:
+		c.deliver(m)
+		return &proto.PubAck{MessageId: m.MessageId}
+	case proto.QosExactlyOnce:
+		if _, ok := c.in[m.MessageId]; !ok {
+			c.in[m.MessageId] = struct{}{}
+			c.deliver(m)
+		}
+		return &proto.PubRec{MessageId: m.MessageId}
+	}
+	c.deliver(m)
+	return nil
+}
+
+// Finish with a QoS 2 message from the server, returning the PUBCOMP.
+func (c *ClientConn) released(id uint16) proto.Message {
+	delete(c.in, id)
+	return &proto.PubComp{MessageId: id}
+}
+
+// Handle an ack for a message we published, returning what to send
+// in reply, if anything.
+func (c *ClientConn) acked(m proto.Message, p *packet5) proto.Message {
+	finish := func(id uint16) {
+		if fl := c.inflight.ack(id); fl != nil && fl.tok != nil {
+			fl.tok.finish(ackError(p))
+		}
+	}
+	switch m := m.(type) {
+	case *proto.PubAck:
+		finish(m.MessageId)
+	case *proto.PubRec:
+		if ackError(p) != nil {
+			// refused; there will be no PUBCOMP
+			finish(m.MessageId)
+			break
+		}
+		c.inflight.rec(m.MessageId)
+		return &proto.PubRel{
+			Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+			MessageId: m.MessageId,
+		}
+	case *proto.PubComp:
+		finish(m.MessageId)
+	}
+	return nil
+}
+
+// Handle a PUBLISH, PUBREL or publish ack from the server, returning
+// what to send in reply, if anything, and false for any other message.
+func (c *ClientConn) handle(m proto.Message, p *packet5) (proto.Message, bool) {
+	switch m := m.(type) {
+	case *proto.Publish:
+		return c.receive(m), true
+	case *proto.PubRel:
+		return c.released(m.MessageId), true
+	case *proto.PubAck, *proto.PubRec, *proto.PubComp:
+		return c.acked(m, p), true
+	}
+	return nil, false
+}
+
+// Finish with the QoS 2 messages in flight when the server has started a
+// new session, which knows nothing of them. Those it sent PUBREC for
+// have arrived. The others may have too, so sending them again might
+// deliver them twice. QoS 1 messages are sent again as usual.
+func (c *ClientConn) sessionLost() {
+	for _, fl := range c.inflight.clearQos2() {
+		switch {
+		case fl.tok == nil:
+		case fl.rel:
+			fl.tok.finish(nil)
+		default:
+			fl.tok.finish(ErrSessionLost)
+		}
+	}
+}
+
+// Finish the tokens of the messages which will never be finished now
+// that the ClientConn is closed: those in flight, and those which were
+// never sent.
+func (c *ClientConn) abandon() {
+	for _, fl := range c.inflight.clear() {
+		if fl.tok != nil {
+			fl.tok.finish(ErrClientClosed)
+		}
+	}
+	for {
+		select {
+		case j := <-c.out:
+			if j.tok != nil {
+				j.tok.finish(ErrClientClosed)
+			}
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,394 @@
+package mqtt
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func waitToken(t *testing.T, tok *Token) error {
+	select {
+	case <-tok.Done():
+		return tok.Wait()
+	case <-time.After(time.Second):
+		t.Fatal("token not finished")
+	}
+	return nil
+}
+
+func TestClientQos(t *testing.T) {
+	svr := NewServer(nil)
+	d := &pipeDialer{svr: svr}
+	sub := newTestClient(t, svr, "sub")
+	sub.subscribe("q/#", proto.QosAtMostOnce)
+
+	conn, _ := d.dial()
+	cc := NewClientConn(conn)
+	if err := cc.Connect("", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, qos := range []proto.QosLevel{proto.QosAtMostOnce, proto.QosAtLeastOnce, proto.QosExactlyOnce} {
+		m := &proto.Publish{
+			Header:    header(dupFalse, qos, retainFalse),
+			TopicName: "q/out",
+			Payload:   proto.BytesPayload("hi"),
+		}
+		if err := waitToken(t, cc.Publish(m)); err != nil {
+			t.Errorf("qos %v: %v", qos, err)
+		}
+		if m.MessageId != 0 {
+			t.Errorf("qos %v: message was changed", qos)
+		}
+		if got, ok := sub.recv().(*proto.Publish); !ok || got.TopicName != "q/out" {
+			t.Errorf("qos %v: got %v", qos, got)
+		}
+	}
+	if n := len(cc.inflight.clear()); n != 0 {
+		t.Errorf("%v messages still in flight", n)
+	}
+	cc.Disconnect()
+
+	tok := cc.Publish(&proto.Publish{TopicName: "q/out", Payload: proto.BytesPayload("late")})
+	if err := waitToken(t, tok); err != ErrClientClosed {
+		t.Errorf("publish after Disconnect: got %v", err)
+	}
+}
+
+// Play the server's part on a net.Pipe, returning the ClientConn once
+// it is connected. The ClientConn is passed to setup, if any, first.
+func fakeServer(t *testing.T, setup ...func(cc *ClientConn)) (*ClientConn, *testClient) {
+	cli, srv := net.Pipe()
+	cc := NewClientConn(cli)
+	for _, f := range setup {
+		f(cc)
+	}
+	tc := &testClient{t: t, conn: srv}
+	done := make(chan error)
+	go func() { done <- cc.Connect("", "") }()
+	if _, ok := tc.recv().(*proto.Connect); !ok {
+		t.Fatal("expected CONNECT")
+	}
+	tc.send(&proto.ConnAck{ReturnCode: proto.RetCodeAccepted})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	return cc, tc
+}
+
+// Disconnect a ClientConn from a fakeServer, which takes the DISCONNECT.
+func disconnectFake(cc *ClientConn, srv *testClient) {
+	go proto.DecodeOneMessage(srv.conn, nil)
+	cc.Disconnect()
+}
+
+func TestClientQosInbound(t *testing.T) {
+	cc, srv := fakeServer(t)
+	defer disconnectFake(cc, srv)
+
+	incoming := func(want bool) {
+		select {
+		case <-cc.Incoming:
+			if !want {
+				t.Error("message delivered twice")
+			}
+		case <-time.After(50 * time.Millisecond):
+			if want {
+				t.Error("message not delivered")
+			}
+		}
+	}
+	publish := func(qos proto.QosLevel, dup bool, id uint16) {
+		srv.send(&proto.Publish{
+			Header:    header(dupFlag(dup), qos, retainFalse),
+			TopicName: "q/in",
+			MessageId: id,
+			Payload:   proto.BytesPayload("hi"),
+		})
+	}
+
+	publish(proto.QosAtLeastOnce, false, 7)
+	incoming(true)
+	if m, ok := srv.recv().(*proto.PubAck); !ok || m.MessageId != 7 {
+		t.Fatalf("expected PUBACK 7, got %v", m)
+	}
+
+	publish(proto.QosExactlyOnce, false, 8)
+	incoming(true)
+	if m, ok := srv.recv().(*proto.PubRec); !ok || m.MessageId != 8 {
+		t.Fatalf("expected PUBREC 8, got %v", m)
+	}
+	// Sent again, before the PUBREL: acked again, but not delivered.
+	publish(proto.QosExactlyOnce, true, 8)
+	incoming(false)
+	if m, ok := srv.recv().(*proto.PubRec); !ok || m.MessageId != 8 {
+		t.Fatalf("expected PUBREC 8, got %v", m)
+	}
+	srv.send(&proto.PubRel{Header: header(dupFalse, proto.QosAtLeastOnce, retainFalse), MessageId: 8})
+	if m, ok := srv.recv().(*proto.PubComp); !ok || m.MessageId != 8 {
+		t.Fatalf("expected PUBCOMP 8, got %v", m)
+	}
+}
+
+func TestClientQosResend(t *testing.T) {
+	// MQTT 3.1 does not say whether the session was kept, so it is
+	// taken to have been.
+	cc, srv := fakeServer(t, func(cc *ClientConn) { cc.PersistentSession = true })
+	cc.ReconnectDelay = 10 * time.Millisecond
+	dialed := make(chan *testClient, 1)
+	cc.Dial = func() (net.Conn, error) {
+		cli, s := net.Pipe()
+		dialed <- &testClient{t: t, conn: s}
+		return cli, nil
+	}
+
+	tok1 := cc.Publish(&proto.Publish{
+		Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+		TopicName: "q/1",
+		Payload:   proto.BytesPayload("one"),
+	})
+	tok2 := cc.Publish(&proto.Publish{
+		Header:    header(dupFalse, proto.QosExactlyOnce, retainFalse),
+		TopicName: "q/2",
+		Payload:   proto.BytesPayload("two"),
+	})
+	m1, ok := srv.recv().(*proto.Publish)
+	if !ok || m1.MessageId == 0 || m1.DupFlag {
+		t.Fatalf("bad first send %v", m1)
+	}
+	m2, ok := srv.recv().(*proto.Publish)
+	if !ok || m2.MessageId == 0 || m2.MessageId == m1.MessageId {
+		t.Fatalf("bad first send %v", m2)
+	}
+	// The connection is lost before either is acked.
+	srv.conn.Close()
+
+	srv = <-dialed
+	if _, ok := srv.recv().(*proto.Connect); !ok {
+		t.Fatal("expected CONNECT")
+	}
+	srv.send(&proto.ConnAck{ReturnCode: proto.RetCodeAccepted})
+	resent := make(map[uint16]*proto.Publish)
+	for i := 0; i < 2; i++ {
+		m, ok := srv.recv().(*proto.Publish)
+		if !ok || !m.DupFlag {
+			t.Fatalf("expected PUBLISH with DUP, got %v", m)
+		}
+		resent[m.MessageId] = m
+	}
+	if resent[m1.MessageId] == nil || resent[m2.MessageId] == nil {
+		t.Fatalf("message ids changed: %v", resent)
+	}
+
+	srv.send(&proto.PubAck{MessageId: m1.MessageId})
+	if err := waitToken(t, tok1); err != nil {
+		t.Error(err)
+	}
+	srv.send(&proto.PubRec{MessageId: m2.MessageId})
+	if m, ok := srv.recv().(*proto.PubRel); !ok || m.MessageId != m2.MessageId {
+		t.Fatalf("expected PUBREL, got %v", m)
+	}
+	select {
+	case <-tok2.Done():
+		t.Fatal("QoS 2 token finished before PUBCOMP")
+	default:
+	}
+
+	// The connection is lost again before the PUBCOMP, and the PUBREL
+	// is sent again, without DUP, since it has none.
+	srv.conn.Close()
+	srv = <-dialed
+	if _, ok := srv.recv().(*proto.Connect); !ok {
+		t.Fatal("expected CONNECT")
+	}
+	srv.send(&proto.ConnAck{ReturnCode: proto.RetCodeAccepted})
+	b := make([]byte, 4)
+	srv.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(srv.conn, b); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0x62, 2, byte(m2.MessageId >> 8), byte(m2.MessageId)}; !bytes.Equal(b, want) {
+		t.Fatalf("resent PUBREL % x, want % x", b, want)
+	}
+	srv.send(&proto.PubComp{MessageId: m2.MessageId})
+	if err := waitToken(t, tok2); err != nil {
+		t.Error(err)
+	}
+
+	disconnectFake(cc, srv)
+}
+
+// A QoS 2 message from the server while the ClientConn is waiting for a
+// SUBACK on reconnecting is finished there and then.
+func TestClientQosResume(t *testing.T) {
+	cc, srv := fakeServer(t)
+	cc.ReconnectDelay = 10 * time.Millisecond
+	dialed := make(chan *testClient, 1)
+	cc.Dial = func() (net.Conn, error) {
+		cli, s := net.Pipe()
+		dialed <- &testClient{t: t, conn: s}
+		return cli, nil
+	}
+	go cc.Subscribe([]proto.TopicQos{{Topic: "q/in", Qos: proto.QosExactlyOnce}})
+	sub, ok := srv.recv().(*proto.Subscribe)
+	if !ok {
+		t.Fatalf("expected SUBSCRIBE, got %v", sub)
+	}
+	srv.send(&proto.SubAck{MessageId: sub.MessageId, TopicsQos: []proto.QosLevel{proto.QosExactlyOnce}})
+	waitKept(t, cc)
+	srv.conn.Close()
+
+	srv = <-dialed
+	if _, ok := srv.recv().(*proto.Connect); !ok {
+		t.Fatal("expected CONNECT")
+	}
+	srv.send(&proto.ConnAck{ReturnCode: proto.RetCodeAccepted})
+	sub, ok = srv.recv().(*proto.Subscribe)
+	if !ok {
+		t.Fatalf("expected SUBSCRIBE, got %v", sub)
+	}
+	publish := func() {
+		srv.send(&proto.Publish{
+			Header:    header(dupFalse, proto.QosExactlyOnce, retainFalse),
+			TopicName: "q/in",
+			MessageId: 5,
+			Payload:   proto.BytesPayload("hi"),
+		})
+		if m, ok := srv.recv().(*proto.PubRec); !ok || m.MessageId != 5 {
+			t.Fatalf("expected PUBREC 5, got %v", m)
+		}
+		srv.send(&proto.PubRel{Header: header(dupFalse, proto.QosAtLeastOnce, retainFalse), MessageId: 5})
+		if m, ok := srv.recv().(*proto.PubComp); !ok || m.MessageId != 5 {
+			t.Fatalf("expected PUBCOMP 5, got %v", m)
+		}
+		select {
+		case <-cc.Incoming:
+		case <-time.After(time.Second):
+			t.Fatal("message not delivered")
+		}
+	}
+	publish()
+	srv.send(&proto.SubAck{MessageId: sub.MessageId, TopicsQos: []proto.QosLevel{proto.QosExactlyOnce}})
+
+	// The id is free for the next message.
+	publish()
+	disconnectFake(cc, srv)
+}
+
+// Wait for a ClientConn to keep a subscription for reconnecting.
+func waitKept(t *testing.T, cc *ClientConn) {
+	for i := 0; i < 100; i++ {
+		cc.mu.Lock()
+		n := len(cc.subscribed)
+		cc.mu.Unlock()
+		if n > 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("subscription not kept")
+}
+
+func TestClientSession(t *testing.T) {
+	dial := func(cc *ClientConn) chan *testClient {
+		cc.ReconnectDelay = 10 * time.Millisecond
+		dialed := make(chan *testClient, 1)
+		cc.Dial = func() (net.Conn, error) {
+			cli, s := net.Pipe()
+			dialed <- &testClient{t: t, conn: s}
+			return cli, nil
+		}
+		return dialed
+	}
+	publish := func(cc *ClientConn, qos proto.QosLevel) *Token {
+		return cc.Publish(&proto.Publish{
+			Header:    header(dupFalse, qos, retainFalse),
+			TopicName: "s",
+			Payload:   proto.BytesPayload("x"),
+		})
+	}
+	reconnected := func(srv *testClient, clean bool) {
+		if m, ok := srv.recv().(*proto.Connect); !ok || m.CleanSession != clean {
+			t.Fatalf("expected CONNECT with clean session %v, got %v", clean, m)
+		}
+	}
+
+	// A clean session: the QoS 2 messages are finished with, rather
+	// than sent again, but the QoS 1 message is sent again.
+	cc, srv := fakeServer(t)
+	dialed := dial(cc)
+	tok1 := publish(cc, proto.QosAtLeastOnce)
+	tok2 := publish(cc, proto.QosExactlyOnce)
+	tok3 := publish(cc, proto.QosExactlyOnce)
+	var ids []uint16
+	for i := 0; i < 3; i++ {
+		m, ok := srv.recv().(*proto.Publish)
+		if !ok {
+			t.Fatalf("expected PUBLISH, got %v", m)
+		}
+		ids = append(ids, m.MessageId)
+	}
+	srv.send(&proto.PubRec{MessageId: ids[2]})
+	if m, ok := srv.recv().(*proto.PubRel); !ok {
+		t.Fatalf("expected PUBREL, got %v", m)
+	}
+	srv.conn.Close()
+	srv = <-dialed
+	reconnected(srv, true)
+	srv.send(&proto.ConnAck{ReturnCode: proto.RetCodeAccepted})
+	if m, ok := srv.recv().(*proto.Publish); !ok || m.MessageId != ids[0] || !m.DupFlag {
+		t.Fatalf("expected QoS 1 PUBLISH again, got %v", m)
+	}
+	if err := waitToken(t, tok2); err != ErrSessionLost {
+		t.Errorf("QoS 2 message not acknowledged: got %v", err)
+	}
+	if err := waitToken(t, tok3); err != nil {
+		t.Errorf("QoS 2 message acknowledged: got %v", err)
+	}
+	srv.send(&proto.PubAck{MessageId: ids[0]})
+	if err := waitToken(t, tok1); err != nil {
+		t.Error(err)
+	}
+	disconnectFake(cc, srv)
+
+	// A persistent session which the MQTT 3.1.1 server kept: there is
+	// no subscribing again, and the QoS 2 message is sent again.
+	cc, srv = fakeServer(t, func(cc *ClientConn) {
+		cc.PersistentSession = true
+		cc.Version = Version311
+	})
+	dialed = dial(cc)
+	go cc.Subscribe([]proto.TopicQos{{Topic: "s", Qos: proto.QosAtMostOnce}})
+	sub, ok := srv.recv().(*proto.Subscribe)
+	if !ok {
+		t.Fatalf("expected SUBSCRIBE, got %v", sub)
+	}
+	srv.send(&proto.SubAck{MessageId: sub.MessageId, TopicsQos: []proto.QosLevel{proto.QosAtMostOnce}})
+	waitKept(t, cc)
+	tok := publish(cc, proto.QosExactlyOnce)
+	m, ok := srv.recv().(*proto.Publish)
+	if !ok {
+		t.Fatalf("expected PUBLISH, got %v", m)
+	}
+	srv.conn.Close()
+	srv = <-dialed
+	reconnected(srv, false)
+	if err := (&connAck4{sessionPresent: true, rc: proto.RetCodeAccepted}).Encode(srv.conn); err != nil {
+		t.Fatal(err)
+	}
+	if m2, ok := srv.recv().(*proto.Publish); !ok || m2.MessageId != m.MessageId || !m2.DupFlag {
+		t.Fatalf("expected QoS 2 PUBLISH again, got %v", m2)
+	}
+	srv.send(&proto.PubRec{MessageId: m.MessageId})
+	if m, ok := srv.recv().(*proto.PubRel); !ok {
+		t.Fatalf("expected PUBREL, got %v", m)
+	}
+	srv.send(&proto.PubComp{MessageId: m.MessageId})
+	if err := waitToken(t, tok); err != nil {
+		t.Error(err)
+	}
+	disconnectFake(cc, srv)
+}
@@ -0,0 +1,162 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A ConnState is the state of the connection of a ClientConn, as told
+// to its StateChanged function.
+type ConnState int
+
+const (
+	StateConnected    ConnState = iota // connected, by Connect or by reconnecting
+	StateDisconnected                  // the connection was lost; if Dial is set, reconnecting follows
+	StateReconnecting                  // about to try to reconnect
+	StateClosed                        // closed for good; the ClientConn cannot be used any more
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("ConnState(%d)", int(s))
+}
+
+// How long the server has to answer a CONNECT or SUBSCRIBE sent on
+// reconnecting.
+const reconnectTimeout = 30 * time.Second
+
+func (c *ClientConn) changed(state ConnState, err error) {
+	if c.StateChanged != nil {
+		c.StateChanged(state, err)
+	}
+}
+
+// The CONNECT the server accepted, or nil if it has not accepted one.
+func (c *ClientConn) accepted() *proto.Connect {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connectMsg
+}
+
+// Keep trying to make a new connection, waiting longer each time,
+// until it works, or Disconnect is called, in which case it returns nil.
+func (c *ClientConn) reconnect() net.Conn {
+	delay := c.ReconnectDelay
+	for {
+		select {
+		case <-time.After(delay):
+		case <-c.stop:
+			return nil
+		}
+		if delay *= 2; delay > c.MaxReconnectDelay {
+			delay = c.MaxReconnectDelay
+		}
+
+		c.changed(StateReconnecting, nil)
+		conn, err := c.Dial()
+		if err == nil {
+			if err = c.resume(conn); err != nil {
+				conn.Close()
+			}
+		}
+		if err == nil {
+			return conn
+		}
+		c.logger().Print("cli reconnect: ", err)
+		c.changed(StateDisconnected, err)
+	}
+}
+
+var errResumeClosed = errors.New("mqtt: connection closed while reconnecting")
+
+// Pick up where we left off, on a new connection: send the CONNECT, and
+// then, unless the server kept the session, the SUBSCRIBEs, waiting for
+// each to be acked, and then the messages which were in flight. This is done before the reader and
+// writer start, so that nothing else is sent first.
+func (c *ClientConn) resume(conn net.Conn) error {
+	c.mu.Lock()
+	req := *c.connectMsg
+	subscribed := append([]message(nil), c.subscribed...)
+	c.mu.Unlock()
+
+	conn.SetReadDeadline(time.Now().Add(reconnectTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	send := func(m message) error {
+		c.dump("out", m)
+		return m.Encode(conn)
+	}
+	if err := send(c.connectPacket(&req)); err != nil {
+		return err
+	}
+	m, p, err := c.read(conn)
+	if err != nil {
+		return err
+	}
+	ack, ok := m.(*proto.ConnAck)
+	if !ok {
+		return fmt.Errorf("mqtt: expected CONNACK, got %T", m)
+	}
+	if err := ConnectionErrors[ack.ReturnCode]; err != nil {
+		return err
+	}
+	// MQTT 3.1 servers do not say whether they kept the session, so
+	// one which was asked for is taken to have been kept.
+	kept := !req.CleanSession && (p.sessionPresent || c.Version == 0 || c.Version == Version31)
+	if !kept {
+		// The server has forgotten the QoS 2 messages on their way
+		// in and out.
+		c.in = make(map[uint16]struct{})
+		c.sessionLost()
+	}
+	if p.sessionPresent {
+		subscribed = nil
+	}
+
+	for _, sub := range subscribed {
+		if err := send(sub); err != nil {
+			return err
+		}
+		// Messages may arrive before the SUBACK.
+		for acked := false; !acked; {
+			m, p, err := c.read(conn)
+			if err != nil {
+				return err
+			}
+			if reply, ok := c.handle(m, p); ok {
+				if reply != nil {
+					if err := send(c.packet(reply)); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			switch m.(type) {
+			case *proto.SubAck:
+				acked = true
+			case *proto.Disconnect:
+				return errResumeClosed
+			}
+		}
+	}
+
+	for _, m := range c.inflight.due(time.Now()) {
+		if err := send(c.packet(m)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
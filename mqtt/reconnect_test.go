@@ -0,0 +1,88 @@
+package mqtt
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestReconnect(t *testing.T) {
+	svr := NewServer(nil)
+	d := &pipeDialer{svr: svr}
+	sub := newTestClient(t, svr, "sub")
+	sub.subscribe("r/#", proto.QosAtMostOnce)
+
+	conn, _ := d.dial()
+	cc := NewClientConn(conn)
+	cc.ClientId = "rc"
+	cc.ReconnectDelay = 10 * time.Millisecond
+	// The server is down until we say otherwise.
+	up := make(chan bool)
+	cc.Dial = func() (net.Conn, error) {
+		if !<-up {
+			return nil, errors.New("down")
+		}
+		return d.dial()
+	}
+	states := make(chan ConnState, 10)
+	cc.StateChanged = func(state ConnState, err error) {
+		states <- state
+	}
+	expect := func(want ...ConnState) {
+		for _, w := range want {
+			select {
+			case got := <-states:
+				if got != w {
+					t.Fatalf("got state %v, want %v", got, w)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("no state change, want %v", w)
+			}
+		}
+	}
+
+	if err := cc.Connect("", ""); err != nil {
+		t.Fatal(err)
+	}
+	expect(StateConnected)
+	cc.Subscribe([]proto.TopicQos{{Topic: "r/in", Qos: proto.QosAtMostOnce}})
+
+	// Messages published while the connection is down are kept, and
+	// the subscriptions are made again.
+	d.hangUp()
+	expect(StateDisconnected, StateReconnecting)
+	cc.Publish(&proto.Publish{TopicName: "r/out", Payload: proto.BytesPayload("kept")})
+	up <- false
+	expect(StateDisconnected, StateReconnecting)
+	up <- true
+	expect(StateConnected)
+
+	m, ok := sub.recv().(*proto.Publish)
+	if !ok || m.TopicName != "r/out" || string(m.Payload.(proto.BytesPayload)) != "kept" {
+		t.Fatalf("expected kept message, got %v", m)
+	}
+	sub.send(&proto.Publish{TopicName: "r/in", Payload: proto.BytesPayload("again")})
+	select {
+	case m := <-cc.Incoming:
+		if m.TopicName != "r/in" {
+			t.Fatalf("got %v", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("resubscription did not work")
+	}
+	svr.clientsMu.Lock()
+	_, ok = svr.clients["rc"]
+	svr.clientsMu.Unlock()
+	if !ok {
+		t.Error("client id changed")
+	}
+
+	cc.Disconnect()
+	expect(StateClosed)
+	if _, ok := <-cc.Incoming; ok {
+		t.Error("Incoming not closed")
+	}
+}
@@ -0,0 +1,362 @@
+package mqtt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A RetainStore keeps the retained messages for a Server. The Server
+// serializes its calls to the RetainStore.
+//
+// The messages given to Put are copies that belong to the RetainStore,
+// and have their Retain flag set. The messages returned by Match must
+// not be modified by the caller.
+type RetainStore interface {
+	// Put keeps m, replacing any message already retained on its topic.
+	Put(m *proto.Publish) error
+	// Delete forgets the message retained on topic, if any.
+	Delete(topic string) error
+	// Match returns the retained messages matching topic, which may
+	// contain wildcards. A wildcard in the first level does not match
+	// topics starting with $.
+	Match(topic string) []*proto.Publish
+	// Len returns the number of retained messages.
+	Len() int
+}
+
+// NewMemRetainStore returns a RetainStore which keeps the messages in
+// memory only. This is what a Server uses unless it is told otherwise.
+func NewMemRetainStore() RetainStore {
+	return newRetainTree()
+}
+
+// A retainTree holds the retained messages, indexed one topic level
+// at a time, so that the ones matching a wildcard subscription can be
+// found without looking at all of them.
+type retainTree struct {
+	root retainNode
+	n    int
+}
+
+type retainNode struct {
+	m    *proto.Publish // the retained message for this topic, if any
+	kids map[string]*retainNode
+}
+
+func newRetainTree() *retainTree {
+	return &retainTree{}
+}
+
+// Put implements RetainStore.
+func (t *retainTree) Put(m *proto.Publish) error {
+	n := &t.root
+	for _, part := range strings.Split(m.TopicName, "/") {
+		if n.kids == nil {
+			n.kids = make(map[string]*retainNode)
+		}
+		kid, ok := n.kids[part]
+		if !ok {
+			kid = &retainNode{}
+			n.kids[part] = kid
+		}
+		n = kid
+	}
+	if n.m == nil {
+		t.n++
+	}
+	n.m = m
+	return nil
+}
+
+// Delete implements RetainStore.
+func (t *retainTree) Delete(topic string) error {
+	t.root.remove(strings.Split(topic, "/"), &t.n)
+	return nil
+}
+
+// Remove the message at the end of the path given by parts, and return
+// true if n is now empty, so that the caller can prune it. The count
+// of messages is decremented if one is removed.
+func (n *retainNode) remove(parts []string, count *int) bool {
+	if len(parts) == 0 {
+		if n.m != nil {
+			n.m = nil
+			*count--
+		}
+	} else if kid, ok := n.kids[parts[0]]; ok {
+		if kid.remove(parts[1:], count) {
+			delete(n.kids, parts[0])
+		}
+	}
+	return n.m == nil && len(n.kids) == 0
+}
+
+// Match implements RetainStore.
+func (t *retainTree) Match(topic string) []*proto.Publish {
+	parts := strings.Split(topic, "/")
+	if parts[0] != "+" && parts[0] != "#" {
+		return t.root.match(parts, nil)
+	}
+
+	var res []*proto.Publish
+	for name, kid := range t.root.kids {
+		if strings.HasPrefix(name, "$") {
+			continue
+		}
+		if parts[0] == "#" {
+			res = kid.all(res)
+		} else {
+			res = kid.match(parts[1:], res)
+		}
+	}
+	return res
+}
+
+// Len implements RetainStore.
+func (t *retainTree) Len() int {
+	return t.n
+}
+
+func (n *retainNode) match(parts []string, res []*proto.Publish) []*proto.Publish {
+	if len(parts) == 0 {
+		if n.m != nil {
+			res = append(res, n.m)
+		}
+		return res
+	}
+
+	switch parts[0] {
+	case "#":
+		// finance/stock/ibm/# matches finance/stock/ibm too
+		return n.all(res)
+	case "+":
+		for _, kid := range n.kids {
+			res = kid.match(parts[1:], res)
+		}
+	default:
+		if kid, ok := n.kids[parts[0]]; ok {
+			res = kid.match(parts[1:], res)
+		}
+	}
+	return res
+}
+
+// Add every message at or below n to res.
+func (n *retainNode) all(res []*proto.Publish) []*proto.Publish {
+	if n.m != nil {
+		res = append(res, n.m)
+	}
+	for _, kid := range n.kids {
+		res = kid.all(res)
+	}
+	return res
+}
+
+// A FileRetainStore is a RetainStore which keeps the retained messages
+// on disk, so that they survive restarting the server. The messages are
+// held in memory too, and each change is appended to a log, which is
+// compacted into a snapshot from time to time. Both files are streams of
+// MQTT PUBLISH messages; one with an empty payload in the log is a
+// deletion.
+//
+// The log is not synced to disk after each change, so changes can be
+// lost if the machine (but not the server process) crashes.
+//
+// Messages on $SYS topics are only kept in memory, since they describe
+// the server as it is now, and are published again after a restart.
+type FileRetainStore struct {
+	mem    *retainTree
+	dir    string
+	log    *os.File
+	w      *bufio.Writer
+	logged int // changes in the log since the last snapshot
+
+	// What was wrong with the files when they were opened, for the
+	// Server given the store to log.
+	problems []string
+}
+
+const (
+	retainSnapshot = "retain.snap"
+	retainLog      = "retain.log"
+
+	// The log is compacted when it holds this many more changes than
+	// there are retained messages.
+	retainCompactSlack = 1000
+)
+
+// OpenFileRetainStore opens the retained messages stored in directory
+// dir, which is created if necessary.
+func OpenFileRetainStore(dir string) (*FileRetainStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	fs := &FileRetainStore{mem: newRetainTree(), dir: dir}
+	for _, name := range []string{retainSnapshot, retainLog} {
+		if err := fs.load(filepath.Join(dir, name)); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	fs.log, err = os.OpenFile(filepath.Join(dir, retainLog), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fs.w = bufio.NewWriter(fs.log)
+
+	// Start from a fresh snapshot and an empty log, which also gets
+	// rid of any partly written message at the end of the log.
+	if err := fs.compact(); err != nil {
+		fs.log.Close()
+		return nil, err
+	}
+	return fs, nil
+}
+
+// Apply the changes in the named file, if it exists.
+func (fs *FileRetainStore) load(name string) error {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		m, err := proto.DecodeOneMessage(r, nil)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			// Probably a crash while writing; keep what we have.
+			fs.problems = append(fs.problems, fmt.Sprintf("retain: ignoring the rest of %v: %v", name, err))
+			return nil
+		}
+		p, ok := m.(*proto.Publish)
+		if !ok {
+			fs.problems = append(fs.problems, fmt.Sprintf("retain: ignoring the rest of %v: unexpected %T", name, m))
+			return nil
+		}
+		switch {
+		case isSys(p.TopicName):
+			// left by an older version
+		case p.Payload.Size() == 0:
+			fs.mem.Delete(p.TopicName)
+		default:
+			fs.mem.Put(p)
+		}
+	}
+}
+
+// Append a change to the log, compacting it if it is getting long.
+func (fs *FileRetainStore) append(m *proto.Publish) error {
+	if err := m.Encode(fs.w); err != nil {
+		return err
+	}
+	if err := fs.w.Flush(); err != nil {
+		return err
+	}
+	fs.logged++
+	if fs.logged > fs.mem.Len()+retainCompactSlack {
+		return fs.compact()
+	}
+	return nil
+}
+
+// Write all the messages to a new snapshot, and empty the log.
+func (fs *FileRetainStore) compact() error {
+	name := filepath.Join(fs.dir, retainSnapshot)
+	f, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, m := range fs.mem.root.all(nil) {
+		if isSys(m.TopicName) {
+			continue
+		}
+		if err = m.Encode(w); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(name+".tmp", name)
+	}
+	if err != nil {
+		os.Remove(name + ".tmp")
+		return err
+	}
+
+	// If we crash before this, the log is replayed on top of the
+	// new snapshot at startup, which does no harm.
+	if err := fs.log.Truncate(0); err != nil {
+		return err
+	}
+	fs.logged = 0
+	return nil
+}
+
+// Put implements RetainStore.
+func (fs *FileRetainStore) Put(m *proto.Publish) error {
+	fs.mem.Put(m)
+	if isSys(m.TopicName) {
+		return nil
+	}
+	return fs.append(m)
+}
+
+// Delete implements RetainStore.
+func (fs *FileRetainStore) Delete(topic string) error {
+	fs.mem.Delete(topic)
+	if isSys(topic) {
+		return nil
+	}
+	return fs.append(&proto.Publish{
+		Header:    header(dupFalse, proto.QosAtMostOnce, retainTrue),
+		TopicName: topic,
+		Payload:   proto.BytesPayload{},
+	})
+}
+
+// Match implements RetainStore.
+func (fs *FileRetainStore) Match(topic string) []*proto.Publish {
+	return fs.mem.Match(topic)
+}
+
+// Len implements RetainStore.
+func (fs *FileRetainStore) Len() int {
+	return fs.mem.Len()
+}
+
+// Whether topic is one of the server's own $SYS topics.
+func isSys(topic string) bool {
+	return strings.HasPrefix(topic, "$SYS/")
+}
+
+// Close compacts the log and closes it.
+func (fs *FileRetainStore) Close() error {
+	err := fs.compact()
+	if cerr := fs.log.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,193 @@
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestRetainTree(t *testing.T) {
+	rt := newRetainTree()
+	for _, topic := range []string{
+		"finance/stock/ibm",
+		"finance/stock/ibm/close",
+		"finance/stock/aapl/close",
+		"finance/bond",
+		"weather",
+		"/leading",
+		"$SYS/broker/uptime",
+	} {
+		rt.Put(&proto.Publish{TopicName: topic})
+	}
+	rt.Delete("finance/bond")
+	rt.Delete("not/there")
+	if rt.Len() != 6 {
+		t.Fatal("expected 6 messages, got ", rt.Len())
+	}
+
+	var tests = []struct {
+		topic string
+		want  string
+	}{
+		{"finance/stock/ibm", "finance/stock/ibm"},
+		{"finance/stock/ibm/#", "finance/stock/ibm finance/stock/ibm/close"},
+		{"finance/stock/+/close", "finance/stock/aapl/close finance/stock/ibm/close"},
+		{"finance/+", ""},
+		{"finance/bond", ""},
+		{"+", "weather"},
+		{"+/+", "/leading"},
+		{"#", "/leading finance/stock/aapl/close finance/stock/ibm finance/stock/ibm/close weather"},
+		{"+/broker/+", ""},
+		{"$SYS/#", "$SYS/broker/uptime"},
+	}
+	for _, x := range tests {
+		var got []string
+		for _, m := range rt.Match(x.topic) {
+			got = append(got, m.TopicName)
+		}
+		sort.Strings(got)
+		if g := strings.Join(got, " "); g != x.want {
+			t.Errorf("%v: got %q, want %q", x.topic, g, x.want)
+		}
+	}
+
+	// Removing everything leaves an empty tree behind.
+	for _, topic := range []string{"#", "$SYS/#"} {
+		for _, m := range rt.Match(topic) {
+			rt.Delete(m.TopicName)
+		}
+	}
+	if len(rt.root.kids) != 0 || rt.Len() != 0 {
+		t.Error("tree not pruned: ", rt.root.kids)
+	}
+}
+
+func TestFileRetainStore(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := OpenFileRetainStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put := func(topic, payload string) {
+		err := fs.Put(&proto.Publish{
+			Header:    header(dupFalse, proto.QosAtLeastOnce, retainTrue),
+			TopicName: topic,
+			MessageId: 1,
+			Payload:   proto.BytesPayload(payload),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Enough changes to the same topics to compact the log.
+	for i := 0; i < retainCompactSlack+10; i++ {
+		put("dev/a", "old")
+	}
+	put("dev/a", "a")
+	put("dev/b", "b")
+	put("dev/c", "c")
+	if err := fs.Delete("dev/c"); err != nil {
+		t.Fatal(err)
+	}
+	put("$SYS/broker/uptime", "1 seconds")
+	if len(fs.Match("$SYS/#")) != 1 {
+		t.Fatal("$SYS message not retained")
+	}
+
+	// Simulate a crash: no Close, and half a message at the end of
+	// the log.
+	lf, err := os.OpenFile(filepath.Join(dir, retainLog), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lf.Write([]byte{0x31, 0x20, 0, 5, 'd'})
+	lf.Close()
+
+	fs2, err := OpenFileRetainStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs2.Close()
+
+	got := make(map[string]string)
+	for _, m := range fs2.Match("dev/#") {
+		var buf bytes.Buffer
+		m.Payload.WritePayload(&buf)
+		got[m.TopicName] = buf.String()
+		if !m.Header.Retain || m.Header.QosLevel != proto.QosAtLeastOnce {
+			t.Errorf("%v: bad header %v", m.TopicName, m.Header)
+		}
+	}
+	if len(got) != 2 || got["dev/a"] != "a" || got["dev/b"] != "b" {
+		t.Fatal("bad messages after reopening: ", got)
+	}
+	if ms := fs2.Match("$SYS/#"); len(ms) != 0 {
+		t.Fatal("$SYS message kept on disk: ", ms)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, retainLog)); err != nil || fi.Size() != 0 {
+		t.Fatal("log not compacted on open")
+	}
+
+	// The half message is reported by the Server given the store.
+	svr := NewServer(nil)
+	var buf syncBuffer
+	svr.SetLogger(log.New(&buf, "", 0))
+	svr.SetRetainStore(fs2)
+	if got := buf.String(); !strings.Contains(got, "retain: ignoring the rest of") {
+		t.Errorf("log: %q", got)
+	}
+	// The server is done with the store before it is closed.
+	if err := svr.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// More retained messages than fit in a client's queue all arrive.
+func TestRetainMany(t *testing.T) {
+	svr := NewServer(nil)
+	const n = 3 * sendingQueueLength
+	pub := newTestClient(t, svr, "pub")
+	for i := 0; i < n; i++ {
+		pub.send(&proto.Publish{
+			Header:    header(dupFalse, proto.QosAtMostOnce, retainTrue),
+			TopicName: fmt.Sprint("r/", i),
+			Payload:   proto.BytesPayload("x"),
+		})
+	}
+	// Wait for the last one to be retained.
+	last := fmt.Sprint("r/", n-1)
+	for i := 0; ; i++ {
+		svr.subs.mu.Lock()
+		n := len(svr.subs.retain.Match(last))
+		svr.subs.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if i == 1000 {
+			t.Fatal("not retained")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	sub := newTestClient(t, svr, "sub")
+	sub.subscribe("r/#", proto.QosAtMostOnce)
+	seen := make(map[string]bool)
+	for len(seen) < n {
+		m, ok := sub.recv().(*proto.Publish)
+		if !ok || !m.Header.Retain {
+			t.Fatalf("expected retained PUBLISH, got %v", m)
+		}
+		seen[m.TopicName] = true
+	}
+}
@@ -0,0 +1,183 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A MessageHandler is called with the messages a ClientConn receives.
+// Handlers are called one at a time, by the goroutine which reads from
+// the connection, so they must not block for long, and must not wait on
+// the ClientConn, as Subscribe and Unsubscribe do.
+type MessageHandler func(c *ClientConn, m *proto.Publish)
+
+// A route sends the messages matching a topic filter to a handler.
+type route struct {
+	filter string
+	w      wild
+	h      MessageHandler
+}
+
+// SubscribeHandler subscribes this connection to a list of topics, like
+// Subscribe, with the messages matching them going to h, rather than to
+// the DefaultHandler or the Incoming channel. Topic filters have the
+// same + and # wildcards as on the server. A message which matches
+// the filters of several handlers goes to each of them (and the server
+// may send it once for each of those subscriptions, too). The handler
+// for a shared subscription, "$share/group/filter", gets the messages
+// matching filter. Subscribing to a topic filter again replaces its
+// handler.
+func (c *ClientConn) SubscribeHandler(tqs []proto.TopicQos, h MessageHandler) *proto.SubAck {
+	ack, _ := c.SubscribeHandlerContext(context.Background(), tqs, h)
+	return ack
+}
+
+// SubscribeHandlerContext is like SubscribeHandler, but gives up when
+// ctx is done, as SubscribeContext does.
+func (c *ClientConn) SubscribeHandlerContext(ctx context.Context, tqs []proto.TopicQos, h MessageHandler) (*proto.SubAck, error) {
+	// The routes are in place before the SUBSCRIBE is sent, since
+	// messages may arrive before the SUBACK.
+	for _, tq := range tqs {
+		c.route(tq.Topic, h)
+	}
+	ack, err := c.SubscribeContext(ctx, tqs)
+	for i, tq := range tqs {
+		if ack == nil || i >= len(ack.TopicsQos) || ack.TopicsQos[i] >= 0x80 {
+			c.unroute(tq.Topic)
+		}
+	}
+	return ack, err
+}
+
+// Unsubscribe unsubscribes this connection from a list of topic
+// filters, and forgets their handlers, if any. It returns nil if the
+// connection closes before the UNSUBACK arrives.
+func (c *ClientConn) Unsubscribe(topics []string) *proto.UnsubAck {
+	ack, _ := c.UnsubscribeContext(context.Background(), topics)
+	return ack
+}
+
+// UnsubscribeContext is like Unsubscribe, but gives up when ctx is
+// done, and returns an error rather than nil.
+func (c *ClientConn) UnsubscribeContext(ctx context.Context, topics []string) (*proto.UnsubAck, error) {
+	m, err := c.request(ctx, c.packet(&proto.Unsubscribe{
+		Header: header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+		Topics: topics,
+	}))
+	if err != nil {
+		return nil, err
+	}
+	ack, ok := m.(*proto.UnsubAck)
+	if !ok {
+		return nil, fmt.Errorf("mqtt: expected UNSUBACK, got %T", m)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var subscribed []message
+	for _, m := range c.subscribed {
+		if m = without(m, topics); m != nil {
+			subscribed = append(subscribed, m)
+		}
+	}
+	c.subscribed = subscribed
+	for _, t := range topics {
+		c.unrouteLocked(t)
+	}
+	return ack, nil
+}
+
+// Send the messages matching filter to h. Messages for a shared
+// subscription come on the topics matching its filter, without the
+// $share/group/ in front.
+func (c *ClientConn) route(filter string, h MessageHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range c.routes {
+		if c.routes[i].filter == filter {
+			c.routes[i].h = h
+			return
+		}
+	}
+	topic, _ := splitShare(filter)
+	c.routes = append(c.routes, route{filter: filter, w: newWild(topic), h: h})
+}
+
+func (c *ClientConn) unroute(filter string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unrouteLocked(filter)
+}
+
+// Forget the handler for filter. Called with c.mu held.
+func (c *ClientConn) unrouteLocked(filter string) {
+	for i := range c.routes {
+		if c.routes[i].filter == filter {
+			c.routes = append(c.routes[:i], c.routes[i+1:]...)
+			return
+		}
+	}
+}
+
+// Pass on a message from the server to the handlers of the topic filters
+// it matches. If there are none, it goes to the DefaultHandler, if there
+// is one, or else to the Incoming channel.
+func (c *ClientConn) deliver(m *proto.Publish) {
+	parts := strings.Split(m.TopicName, "/")
+	var hs []MessageHandler
+	c.mu.Lock()
+	for _, r := range c.routes {
+		if r.w.matches(parts) {
+			hs = append(hs, r.h)
+		}
+	}
+	c.mu.Unlock()
+
+	switch {
+	case len(hs) > 0:
+		for _, h := range hs {
+			h(c, m)
+		}
+	case c.DefaultHandler != nil:
+		c.DefaultHandler(c, m)
+	default:
+		c.Incoming <- m
+	}
+}
+
+// A copy of the SUBSCRIBE m, without the subscriptions to topics, or nil
+// if there are none left.
+func without(m message, topics []string) message {
+	drop := make(map[string]bool)
+	for _, t := range topics {
+		drop[t] = true
+	}
+	p, _ := m.(*packet5)
+	sub := unwrap(m).(*proto.Subscribe)
+
+	res := *sub
+	res.Topics = nil
+	var opts []byte
+	for i, tq := range sub.Topics {
+		if drop[tq.Topic] {
+			continue
+		}
+		res.Topics = append(res.Topics, tq)
+		if p != nil && i < len(p.opts) {
+			opts = append(opts, p.opts[i])
+		}
+	}
+	if len(res.Topics) == 0 {
+		return nil
+	}
+	if p == nil {
+		return &res
+	}
+	p5 := *p
+	p5.m = &res
+	p5.opts = opts
+	return &p5
+}
@@ -0,0 +1,155 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestClientRoutes(t *testing.T) {
+	svr := NewServer(nil)
+	d := &pipeDialer{svr: svr}
+	pub := newTestClient(t, svr, "pub")
+
+	conn, _ := d.dial()
+	cc := NewClientConn(conn)
+	got := make(chan string, 10)
+	handler := func(name string) MessageHandler {
+		return func(c *ClientConn, m *proto.Publish) {
+			got <- name + " " + m.TopicName
+		}
+	}
+	cc.DefaultHandler = handler("default")
+	if err := cc.Connect("", ""); err != nil {
+		t.Fatal(err)
+	}
+	cc.SubscribeHandler([]proto.TopicQos{{Topic: "r/+/a", Qos: proto.QosAtMostOnce}}, handler("one"))
+	cc.SubscribeHandler([]proto.TopicQos{{Topic: "s/#", Qos: proto.QosAtMostOnce}}, handler("all"))
+	cc.Subscribe([]proto.TopicQos{{Topic: "other", Qos: proto.QosAtMostOnce}})
+
+	expect := func(topic string, want ...string) {
+		pub.send(&proto.Publish{TopicName: topic, Payload: proto.BytesPayload("x")})
+		seen := make(map[string]bool)
+		for range want {
+			select {
+			case s := <-got:
+				seen[s] = true
+			case <-time.After(time.Second):
+				t.Fatalf("%v: got %v, want %v", topic, seen, want)
+			}
+		}
+		for _, w := range want {
+			if !seen[w] {
+				t.Errorf("%v: got %v, want %v", topic, seen, want)
+			}
+		}
+	}
+	expect("r/x/a", "one r/x/a")
+	expect("s/y", "all s/y")
+	expect("s", "all s")
+	expect("other", "default other")
+
+	if ack := cc.Unsubscribe([]string{"s/#"}); ack == nil {
+		t.Fatal("no UNSUBACK")
+	}
+	expect("r/x/a", "one r/x/a")
+	expect("s/y")
+	select {
+	case s := <-got:
+		t.Errorf("got %v after Unsubscribe", s)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// What is left to subscribe to again on reconnecting.
+	cc.mu.Lock()
+	var topics []string
+	for _, m := range cc.subscribed {
+		for _, tq := range unwrap(m).(*proto.Subscribe).Topics {
+			topics = append(topics, tq.Topic)
+		}
+	}
+	cc.mu.Unlock()
+	if len(topics) != 2 || topics[0] != "r/+/a" || topics[1] != "other" {
+		t.Errorf("still subscribed to %v", topics)
+	}
+
+	cc.Disconnect()
+}
+
+func TestDeliver(t *testing.T) {
+	var got []string
+	handler := func(name string) MessageHandler {
+		return func(c *ClientConn, m *proto.Publish) {
+			got = append(got, name)
+		}
+	}
+	c := &ClientConn{Incoming: make(chan *proto.Publish, 1)}
+	c.route("a/+", handler("plus"))
+	c.route("a/#", handler("hash"))
+	c.route("a/b", handler("old"))
+	c.route("a/b", handler("b"))
+	c.route("$share/g/a/c", handler("shared"))
+
+	tests := []struct {
+		topic string
+		want  []string
+	}{
+		{"a/b", []string{"plus", "hash", "b"}},
+		{"a/c", []string{"plus", "hash", "shared"}},
+		{"a", []string{"hash"}},
+		{"a/b/c", []string{"hash"}},
+		{"b", nil},
+	}
+	for _, test := range tests {
+		got = nil
+		c.deliver(&proto.Publish{TopicName: test.topic})
+		if len(got) != len(test.want) {
+			t.Errorf("%v: got %v, want %v", test.topic, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%v: got %v, want %v", test.topic, got, test.want)
+			}
+		}
+	}
+	if m := <-c.Incoming; m.TopicName != "b" {
+		t.Errorf("got %v on Incoming", m)
+	}
+
+	c.unroute("a/#")
+	got = nil
+	c.DefaultHandler = handler("default")
+	c.deliver(&proto.Publish{TopicName: "a"})
+	if len(got) != 1 || got[0] != "default" {
+		t.Errorf("got %v, want default", got)
+	}
+}
+
+func TestWithout(t *testing.T) {
+	sub := &packet5{
+		m: &proto.Subscribe{Topics: []proto.TopicQos{
+			{Topic: "a", Qos: proto.QosAtMostOnce},
+			{Topic: "b", Qos: proto.QosAtLeastOnce},
+			{Topic: "c", Qos: proto.QosExactlyOnce},
+		}},
+		opts: []byte{0, 1, 2},
+	}
+	p, ok := without(sub, []string{"b"}).(*packet5)
+	if !ok {
+		t.Fatal("not an MQTT 5 packet")
+	}
+	if m := p.m.(*proto.Subscribe); len(m.Topics) != 2 || m.Topics[0].Topic != "a" || m.Topics[1].Topic != "c" {
+		t.Errorf("got %v", m.Topics)
+	}
+	if len(p.opts) != 2 || p.opts[0] != 0 || p.opts[1] != 2 {
+		t.Errorf("got options %v", p.opts)
+	}
+	if len(sub.m.(*proto.Subscribe).Topics) != 3 {
+		t.Error("original changed")
+	}
+	if m := without(sub, []string{"a", "b", "c"}); m != nil {
+		t.Errorf("got %v, want nil", m)
+	}
+}
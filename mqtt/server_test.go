@@ -0,0 +1,693 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A testClient is the client end of a net.Pipe connected to a Server.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+// Connect a new client with the given client id to the server, using
+// a clean session.
+func newTestClient(t *testing.T, svr *Server, id string) *testClient {
+	tc := dialTest(t, svr)
+	tc.connect(id, true)
+	return tc
+}
+
+// Make a new connection to the server, without sending CONNECT.
+func dialTest(t *testing.T, svr *Server) *testClient {
+	cli, srv := net.Pipe()
+	c := svr.newIncomingConn(srv)
+	svr.stats.clientConnect()
+	c.start()
+	return &testClient{t: t, conn: cli}
+}
+
+func (tc *testClient) connect(id string, clean bool) {
+	tc.send(&proto.Connect{
+		ProtocolName:    "MQIsdp",
+		ProtocolVersion: 3,
+		ClientId:        id,
+		CleanSession:    clean,
+	})
+	if ack, ok := tc.recv().(*proto.ConnAck); !ok || ack.ReturnCode != proto.RetCodeAccepted {
+		tc.t.Fatalf("%v: bad connack %v", id, ack)
+	}
+}
+
+// Disconnect politely.
+func (tc *testClient) disconnect() {
+	tc.send(&proto.Disconnect{})
+	tc.conn.Close()
+}
+
+func (tc *testClient) send(m proto.Message) {
+	tc.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if err := m.Encode(tc.conn); err != nil {
+		tc.t.Fatal("send: ", err)
+	}
+}
+
+func (tc *testClient) recv() proto.Message {
+	tc.conn.SetReadDeadline(time.Now().Add(time.Second))
+	m, err := proto.DecodeOneMessage(tc.conn, nil)
+	if err != nil {
+		tc.t.Fatal("recv: ", err)
+	}
+	return m
+}
+
+func (tc *testClient) subscribe(topic string, qos proto.QosLevel) {
+	tc.send(&proto.Subscribe{
+		Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+		MessageId: 1,
+		Topics:    []proto.TopicQos{{Topic: topic, Qos: qos}},
+	})
+	ack, ok := tc.recv().(*proto.SubAck)
+	if !ok || len(ack.TopicsQos) != 1 || ack.TopicsQos[0] != qos {
+		tc.t.Fatalf("bad suback %v", ack)
+	}
+}
+
+func TestQos(t *testing.T) {
+	svr := NewServer(nil)
+	sub1 := newTestClient(t, svr, "sub1")
+	sub1.subscribe("qos/+", proto.QosAtLeastOnce)
+	sub2 := newTestClient(t, svr, "sub2")
+	sub2.subscribe("qos/test", proto.QosExactlyOnce)
+	pub := newTestClient(t, svr, "pub")
+
+	pub.send(&proto.Publish{
+		Header:    header(dupFalse, proto.QosExactlyOnce, retainFalse),
+		TopicName: "qos/test",
+		MessageId: 7,
+		Payload:   proto.BytesPayload("hello"),
+	})
+	if rec, ok := pub.recv().(*proto.PubRec); !ok || rec.MessageId != 7 {
+		t.Fatalf("expected PUBREC, got %v", rec)
+	}
+	// A duplicate must be acked, but not delivered again.
+	pub.send(&proto.Publish{
+		Header:    header(dupTrue, proto.QosExactlyOnce, retainFalse),
+		TopicName: "qos/test",
+		MessageId: 7,
+		Payload:   proto.BytesPayload("hello"),
+	})
+	if rec, ok := pub.recv().(*proto.PubRec); !ok || rec.MessageId != 7 {
+		t.Fatalf("expected PUBREC, got %v", rec)
+	}
+	pub.send(&proto.PubRel{
+		Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+		MessageId: 7,
+	})
+	if comp, ok := pub.recv().(*proto.PubComp); !ok || comp.MessageId != 7 {
+		t.Fatalf("expected PUBCOMP, got %v", comp)
+	}
+
+	// sub1 was granted QoS 1, so the message is downgraded.
+	m, ok := sub1.recv().(*proto.Publish)
+	if !ok || m.Header.QosLevel != proto.QosAtLeastOnce || m.MessageId == 0 {
+		t.Fatalf("sub1: bad publish %v", m)
+	}
+	sub1.send(&proto.PubAck{MessageId: m.MessageId})
+
+	m, ok = sub2.recv().(*proto.Publish)
+	if !ok || m.Header.QosLevel != proto.QosExactlyOnce || m.MessageId == 0 {
+		t.Fatalf("sub2: bad publish %v", m)
+	}
+	sub2.send(&proto.PubRec{MessageId: m.MessageId})
+	if rel, ok := sub2.recv().(*proto.PubRel); !ok || rel.MessageId != m.MessageId {
+		t.Fatalf("sub2: expected PUBREL, got %v", rel)
+	}
+	sub2.send(&proto.PubComp{MessageId: m.MessageId})
+
+	// Exactly one copy was delivered to each subscriber.
+	pub.send(&proto.Publish{
+		TopicName: "qos/test",
+		Payload:   proto.BytesPayload("again"),
+	})
+	for _, sub := range []*testClient{sub1, sub2} {
+		m, ok := sub.recv().(*proto.Publish)
+		if !ok || string(m.Payload.(proto.BytesPayload)) != "again" {
+			t.Fatalf("expected second message, got %v", m)
+		}
+		if m.Header.QosLevel != proto.QosAtMostOnce {
+			t.Fatal("QoS 0 message was upgraded")
+		}
+	}
+}
+
+func TestQosRetry(t *testing.T) {
+	svr := NewServer(nil)
+	svr.RetryInterval = 10 * time.Millisecond
+	sub := newTestClient(t, svr, "sub")
+	sub.subscribe("retry", proto.QosAtLeastOnce)
+	pub := newTestClient(t, svr, "pub")
+
+	pub.send(&proto.Publish{
+		Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+		TopicName: "retry",
+		MessageId: 1,
+		Payload:   proto.BytesPayload("x"),
+	})
+	if _, ok := pub.recv().(*proto.PubAck); !ok {
+		t.Fatal("expected PUBACK")
+	}
+
+	m, ok := sub.recv().(*proto.Publish)
+	if !ok || m.Header.DupFlag {
+		t.Fatalf("bad first delivery %v", m)
+	}
+	// Do not ack it, so it comes back with DUP set.
+	m2, ok := sub.recv().(*proto.Publish)
+	if !ok || !m2.Header.DupFlag || m2.MessageId != m.MessageId {
+		t.Fatalf("bad retry %v", m2)
+	}
+	sub.send(&proto.PubAck{MessageId: m.MessageId})
+}
+
+func TestQosRetryPubRel(t *testing.T) {
+	svr := NewServer(nil)
+	svr.RetryInterval = 10 * time.Millisecond
+	sub := newTestClient(t, svr, "sub")
+	sub.subscribe("retry2", proto.QosExactlyOnce)
+	pub := newTestClient(t, svr, "pub")
+
+	// An unanswered PUBREL comes back too, without a DUP flag, which
+	// it is not allowed to have.
+	pub.send(&proto.Publish{
+		Header:    header(dupFalse, proto.QosExactlyOnce, retainFalse),
+		TopicName: "retry2",
+		MessageId: 2,
+		Payload:   proto.BytesPayload("x"),
+	})
+	pub.recv()
+	pub.send(&proto.PubRel{Header: header(dupFalse, proto.QosAtLeastOnce, retainFalse), MessageId: 2})
+	pub.recv()
+	sub.send(&proto.PubRec{MessageId: sub.recv().(*proto.Publish).MessageId})
+	if _, ok := sub.recv().(*proto.PubRel); !ok {
+		t.Fatal("expected PUBREL")
+	}
+	b := make([]byte, 4)
+	sub.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(sub.conn, b); err != nil {
+		t.Fatal(err)
+	}
+	if b[0] != 0x62 {
+		t.Errorf("resent PUBREL starts with %#x, want 0x62", b[0])
+	}
+
+	// MQTT 5 clients only get messages again when they reconnect.
+	sub5 := dialTest(t, svr)
+	sub5.connect5("sub5", true)
+	sub5.send5(&packet5{m: &proto.Subscribe{
+		Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+		MessageId: 1,
+		Topics:    []proto.TopicQos{{Topic: "retry5", Qos: proto.QosAtLeastOnce}},
+	}})
+	sub5.recv5()
+	pub.send(&proto.Publish{
+		Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+		TopicName: "retry5",
+		MessageId: 3,
+		Payload:   proto.BytesPayload("x"),
+	})
+	pub.recv()
+	if _, ok := sub5.recv5().m.(*proto.Publish); !ok {
+		t.Fatal("expected PUBLISH")
+	}
+	sub5.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if p, err := read5(sub5.conn, maxRemaining); err == nil {
+		t.Errorf("got %v, want nothing", p)
+	}
+}
+
+func TestPersistentSession(t *testing.T) {
+	svr := NewServer(nil)
+	sub := dialTest(t, svr)
+	sub.connect("persist", false)
+	sub.subscribe("ps/+", proto.QosAtLeastOnce)
+	sub.disconnect()
+
+	// Wait for the server to notice the client is gone.
+	for {
+		svr.sessionsMu.Lock()
+		sess := svr.sessions["persist"]
+		svr.sessionsMu.Unlock()
+		sess.mu.Lock()
+		gone := sess.c == nil
+		sess.mu.Unlock()
+		if gone {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	pub := newTestClient(t, svr, "pub")
+	for _, q := range []proto.QosLevel{proto.QosAtMostOnce, proto.QosAtLeastOnce} {
+		pub.send(&proto.Publish{
+			Header:    header(dupFalse, q, retainFalse),
+			TopicName: "ps/a",
+			MessageId: 1,
+			Payload:   proto.BytesPayload{byte('0' + q)},
+		})
+	}
+	if _, ok := pub.recv().(*proto.PubAck); !ok {
+		t.Fatal("expected PUBACK")
+	}
+
+	// Only the QoS 1 message was kept, and it arrives without
+	// subscribing again.
+	sub = dialTest(t, svr)
+	sub.connect("persist", false)
+	m, ok := sub.recv().(*proto.Publish)
+	if !ok || string(m.Payload.(proto.BytesPayload)) != "1" {
+		t.Fatalf("expected queued message, got %v", m)
+	}
+	sub.send(&proto.PubAck{MessageId: m.MessageId})
+
+	// Connecting clean throws the session away.
+	sub.disconnect()
+	sub = newTestClient(t, svr, "persist")
+	pub.send(&proto.Publish{
+		TopicName: "ps/a",
+		Payload:   proto.BytesPayload("lost"),
+	})
+	sub.subscribe("ps/b", proto.QosAtMostOnce)
+	pub.send(&proto.Publish{
+		TopicName: "ps/b",
+		Payload:   proto.BytesPayload("b"),
+	})
+	m, ok = sub.recv().(*proto.Publish)
+	if !ok || m.TopicName != "ps/b" {
+		t.Fatalf("expected message on ps/b, got %v", m)
+	}
+}
+
+// A persistent session can be picked up again after its connection
+// goes in the middle of sending it more than a job queue's worth of
+// messages.
+func TestSessionResendLost(t *testing.T) {
+	svr := NewServer(nil)
+	sub := dialTest(t, svr)
+	sub.connect("persist", false)
+	sub.subscribe("ps", proto.QosAtLeastOnce)
+	sub.disconnect()
+	waitDetached(t, svr, "persist")
+
+	const n = 2*sendingQueueLength + 10
+	pub := newTestClient(t, svr, "pub")
+	for i := 0; i < n; i++ {
+		pub.send(&proto.Publish{
+			Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+			TopicName: "ps",
+			MessageId: uint16(i + 1),
+			Payload:   proto.BytesPayload(fmt.Sprint(i)),
+		})
+		pub.recv()
+	}
+
+	sub = dialTest(t, svr)
+	sub.connect("persist", false)
+	sub.recv()
+	sub.conn.Close()
+	waitDetached(t, svr, "persist")
+
+	sub = dialTest(t, svr)
+	sub.connect("persist", false)
+	seen := make(map[string]bool)
+	for len(seen) < n {
+		m, ok := sub.recv().(*proto.Publish)
+		if !ok {
+			t.Fatalf("expected PUBLISH, got %v", m)
+		}
+		seen[string(m.Payload.(proto.BytesPayload))] = true
+	}
+}
+
+// Wait for the server to notice that a client is gone.
+func waitDetached(t *testing.T, svr *Server, id string) {
+	for i := 0; i < 1000; i++ {
+		svr.sessionsMu.Lock()
+		sess := svr.sessions[id]
+		svr.sessionsMu.Unlock()
+		sess.mu.Lock()
+		gone := sess.c == nil
+		sess.mu.Unlock()
+		if gone {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("%v still attached", id)
+}
+
+func TestWill(t *testing.T) {
+	svr := NewServer(nil)
+	sub := newTestClient(t, svr, "sub")
+	sub.subscribe("will/#", proto.QosAtMostOnce)
+
+	for _, polite := range []bool{true, false} {
+		dev := dialTest(t, svr)
+		dev.send(&proto.Connect{
+			ProtocolName:    "MQIsdp",
+			ProtocolVersion: 3,
+			ClientId:        "dev",
+			CleanSession:    true,
+			WillFlag:        true,
+			WillTopic:       "will/dev",
+			WillMessage:     fmt.Sprint("polite ", polite),
+		})
+		if _, ok := dev.recv().(*proto.ConnAck); !ok {
+			t.Fatal("expected CONNACK")
+		}
+		if polite {
+			dev.disconnect()
+		} else {
+			dev.conn.Close()
+		}
+	}
+
+	// Only the one that did not send DISCONNECT leaves a will.
+	m, ok := sub.recv().(*proto.Publish)
+	if !ok || string(m.Payload.(proto.BytesPayload)) != "polite false" {
+		t.Fatalf("expected will, got %v", m)
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	svr := NewServer(nil)
+	svr.ConnectTimeout = 50 * time.Millisecond
+	tc := dialTest(t, svr)
+
+	// Say nothing, and the server hangs up on us.
+	tc.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := proto.DecodeOneMessage(tc.conn, nil); err != io.EOF {
+		t.Fatal("expected EOF, got ", err)
+	}
+}
+
+func TestMaxPacketSize(t *testing.T) {
+	svr := NewServer(nil)
+	svr.MaxPacketSize = 100
+
+	// Only the fixed header of each packet is sent: the server hangs
+	// up without reading, or making room for, the rest.
+	tooLarge := func(tc *testClient, hdr ...byte) {
+		tc.conn.SetDeadline(time.Now().Add(time.Second))
+		if _, err := tc.conn.Write(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := proto.DecodeOneMessage(tc.conn, nil); err != io.EOF {
+			t.Errorf("% x: expected EOF, got %v", hdr, err)
+		}
+	}
+
+	// A CONNECT claiming to be as large as MQTT allows.
+	tooLarge(dialTest(t, svr), 0x10, 0xff, 0xff, 0xff, 0x7f)
+
+	// A PUBLISH over MaxPacketSize.
+	tooLarge(newTestClient(t, svr, "v3"), 0x30, 101)
+
+	// MQTT 5 clients are told the limit.
+	tc := dialTest(t, svr)
+	ack := tc.connect5("v5", true)
+	if max, ok := ack.props.get(propMaximumPacketSize); !ok || max.n != 100 {
+		t.Fatal("bad maximum packet size: ", ack)
+	}
+	tooLarge(tc, 0x30, 101)
+}
+
+func TestKeepalive(t *testing.T) {
+	svr := NewServer(nil)
+	sub := newTestClient(t, svr, "sub")
+	sub.subscribe("ka", proto.QosAtMostOnce)
+
+	tc := dialTest(t, svr)
+	tc.send(&proto.Connect{
+		ProtocolName:    "MQIsdp",
+		ProtocolVersion: 3,
+		ClientId:        "ka",
+		CleanSession:    true,
+		KeepAliveTimer:  1,
+		WillFlag:        true,
+		WillTopic:       "ka",
+		WillMessage:     "gone",
+	})
+	if _, ok := tc.recv().(*proto.ConnAck); !ok {
+		t.Fatal("expected CONNACK")
+	}
+
+	// Pings keep it alive past the 1.5 second limit...
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		time.Sleep(time.Second)
+		tc.send(&proto.PingReq{})
+		if _, ok := tc.recv().(*proto.PingResp); !ok {
+			t.Fatal("expected PINGRESP")
+		}
+	}
+
+	// ...but silence does not.
+	tc.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := proto.DecodeOneMessage(tc.conn, nil); err != io.EOF {
+		t.Fatal("expected EOF, got ", err)
+	}
+	if elapsed := time.Since(start); elapsed < 3*time.Second {
+		t.Fatal("disconnected too soon: ", elapsed)
+	}
+
+	// A timeout is not a clean disconnect.
+	m, ok := sub.recv().(*proto.Publish)
+	if !ok || string(m.Payload.(proto.BytesPayload)) != "gone" {
+		t.Fatalf("expected will, got %v", m)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	svr := NewServer(nil)
+	svr.WriteTimeout = 50 * time.Millisecond
+	tc := dialTest(t, svr)
+	tc.send(&proto.Connect{
+		ProtocolName:    "MQIsdp",
+		ProtocolVersion: 3,
+		ClientId:        "slow",
+		CleanSession:    true,
+	})
+
+	// Do not read the CONNACK; the server gives up on us.
+	time.Sleep(200 * time.Millisecond)
+	tc.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := proto.DecodeOneMessage(tc.conn, nil); err != io.EOF {
+		t.Fatal("expected EOF, got ", err)
+	}
+}
+
+func TestRetainWildcard(t *testing.T) {
+	svr := NewServer(nil)
+	pub := newTestClient(t, svr, "pub")
+	for _, topic := range []string{"sensors/a/temp", "sensors/b/temp", "other"} {
+		pub.send(&proto.Publish{
+			Header:    header(dupFalse, proto.QosAtLeastOnce, retainTrue),
+			TopicName: topic,
+			MessageId: 1,
+			Payload:   proto.BytesPayload(topic),
+		})
+		if _, ok := pub.recv().(*proto.PubAck); !ok {
+			t.Fatal("expected PUBACK")
+		}
+	}
+
+	// Wait for the workers to store them.
+	for {
+		svr.subs.mu.Lock()
+		n := len(svr.subs.retain.Match("+/+/temp"))
+		svr.subs.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	sub := newTestClient(t, svr, "sub")
+	sub.subscribe("sensors/#", proto.QosAtMostOnce)
+	got := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		m, ok := sub.recv().(*proto.Publish)
+		if !ok || !m.Header.Retain || m.Header.QosLevel != proto.QosAtMostOnce {
+			t.Fatalf("bad retained message %v", m)
+		}
+		got[m.TopicName] = true
+	}
+	if !got["sensors/a/temp"] || !got["sensors/b/temp"] {
+		t.Fatal("missing retained messages: ", got)
+	}
+}
+
+func TestTakeover(t *testing.T) {
+	svr := NewServer(nil)
+	old := dialTest(t, svr)
+	old.connect("dup", false)
+	old.subscribe("to/+", proto.QosAtMostOnce)
+
+	tc := dialTest(t, svr)
+	tc.connect("dup", false)
+
+	// The old connection is closed...
+	old.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := proto.DecodeOneMessage(old.conn, nil); err != io.EOF {
+		t.Fatal("expected EOF, got ", err)
+	}
+
+	// ...and the new one has its session.
+	pub := newTestClient(t, svr, "pub")
+	pub.send(&proto.Publish{
+		TopicName: "to/a",
+		Payload:   proto.BytesPayload("a"),
+	})
+	if m, ok := tc.recv().(*proto.Publish); !ok || m.TopicName != "to/a" {
+		t.Fatalf("expected message on to/a, got %v", m)
+	}
+
+	// MQTT 5 clients are told why they are going (before the new
+	// one gets its CONNACK, since a net.Pipe has no buffer).
+	old = dialTest(t, svr)
+	old.connect5("dup5", true)
+	tc = dialTest(t, svr)
+	tc.send5(&packet5{m: &proto.Connect{
+		ProtocolName:    "MQTT",
+		ProtocolVersion: Version5,
+		ClientId:        "dup5",
+		CleanSession:    true,
+	}})
+	if p := old.recv5(); p.reason != reasonSessionTakenOver {
+		t.Fatalf("expected DISCONNECT, got %v", p)
+	}
+	if p := tc.recv5(); !isConnAck(p) {
+		t.Fatalf("expected CONNACK, got %v", p)
+	}
+}
+
+// Servers share nothing, so the same client ids can be connected to
+// several of them at once.
+func TestServers(t *testing.T) {
+	for i := 0; i < 4; i++ {
+		i := i
+		t.Run(fmt.Sprint("server", i), func(t *testing.T) {
+			t.Parallel()
+			svr := NewServer(nil)
+			sub := newTestClient(t, svr, "sub")
+			sub.subscribe("servers", proto.QosAtMostOnce)
+			pub := newTestClient(t, svr, "pub")
+			for j := 0; j < 10; j++ {
+				want := fmt.Sprint(i, j)
+				pub.send(&proto.Publish{
+					TopicName: "servers",
+					Payload:   proto.BytesPayload(want),
+				})
+				m, ok := sub.recv().(*proto.Publish)
+				if !ok || string(m.Payload.(proto.BytesPayload)) != want {
+					t.Fatalf("expected %v, got %v", want, m)
+				}
+			}
+		})
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr := NewServer(l)
+	svr.Start()
+
+	sub := newTestClient(t, svr, "sub")
+	sub.subscribe("sd", proto.QosAtMostOnce)
+	sub5 := dialTest(t, svr)
+	sub5.connect5("sub5", true)
+	pub := newTestClient(t, svr, "pub")
+	for i := 0; i < 3; i++ {
+		pub.send(&proto.Publish{TopicName: "sd", Payload: proto.BytesPayload{byte('0' + i)}})
+	}
+	// Give the messages time to get queued for sub, which is not
+	// reading yet.
+	time.Sleep(100 * time.Millisecond)
+
+	done := make(chan error)
+	go func() { done <- svr.Shutdown(context.Background()) }()
+
+	// What was queued is sent before the DISCONNECT.
+	for i := 0; i < 3; i++ {
+		m, ok := sub.recv().(*proto.Publish)
+		if !ok || string(m.Payload.(proto.BytesPayload)) != fmt.Sprint(i) {
+			t.Fatalf("expected message %v, got %v", i, m)
+		}
+	}
+	for _, tc := range []*testClient{sub, pub} {
+		if m, ok := tc.recv().(*proto.Disconnect); !ok {
+			t.Fatal("expected DISCONNECT, got ", m)
+		}
+	}
+	if p := sub5.recv5(); p.reason != reasonServerShuttingDown {
+		t.Fatal("expected DISCONNECT, got ", p)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+	<-svr.Done
+	if conn, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		conn.Close()
+		t.Fatal("still accepting connections")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	svr := NewServer(nil)
+	tc := dialTest(t, svr)
+	tc.send(&proto.Connect{
+		ProtocolName:    "MQIsdp",
+		ProtocolVersion: 3,
+		ClientId:        "slow",
+		CleanSession:    true,
+	})
+
+	// The client does not read its CONNACK, so the server cannot
+	// finish shutting down...
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := svr.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatal("expected timeout, got ", err)
+	}
+
+	// ...until it does.
+	done := make(chan error)
+	go func() { done <- svr.Shutdown(context.Background()) }()
+	if _, ok := tc.recv().(*proto.ConnAck); !ok {
+		t.Fatal("expected CONNACK")
+	}
+	if _, ok := tc.recv().(*proto.Disconnect); !ok {
+		t.Fatal("expected DISCONNECT")
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,283 @@
+package mqtt
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// A session holds the state of a client which outlives any one
+// connection: its subscriptions (which refer to the session, not the
+// connection), the QoS 1 and 2 messages in flight in each direction,
+// and the messages which arrived while the client was disconnected.
+//
+// Sessions are kept, keyed by client id, for as long as the client
+// asked for in its CONNECT: in MQTT 3.1 and 3.1.1, a session made with
+// CleanSession set is thrown away when its connection ends, and the
+// others are kept until a client connects with CleanSession set. An
+// MQTT 5 client gives the number of seconds to keep it.
+type session struct {
+	svr *Server
+	id  string
+	out *inflight // outgoing QoS 1 and 2 messages waiting for their acks
+
+	mu      sync.Mutex    // guards access to fields below
+	c       *incomingConn // the connection, or nil if the client is not connected
+	expiry  time.Duration // how long to keep the session once the connection ends
+	expires time.Time     // when a detached session ends; zero while it is in use
+	timer   *time.Timer   // ends the session when it expires
+	queue   []*proto.Publish
+
+	// True while attach is sending the queue to a new connection; new
+	// messages join the queue meanwhile, so that they keep their order.
+	resending bool
+
+	// Message ids of incoming QoS 2 messages which have been passed to
+	// the subscribers, but for which we have not yet seen the PUBREL.
+	in map[uint16]struct{}
+}
+
+// The expiry of a session which is kept until a client connects
+// with a clean start.
+const neverExpires = time.Duration(math.MaxInt64)
+
+// Find the session for a client id, making a new one if necessary, and
+// say whether there already was one. When cleanStart is true, any
+// existing session is discarded first. Either way, the session will
+// now be kept for expiry after its connection ends.
+func (s *Server) session(id string, cleanStart bool, expiry time.Duration) (*session, bool) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	if sess, ok := s.sessions[id]; ok {
+		sess.mu.Lock()
+		// A session which ends with its connection is on its way
+		// out, even if it has not gone yet.
+		if !cleanStart && sess.expiry != 0 {
+			sess.expiry = expiry
+			sess.expires = time.Time{}
+			if sess.timer != nil {
+				sess.timer.Stop()
+				sess.timer = nil
+			}
+			sess.mu.Unlock()
+			return sess, true
+		}
+		sess.mu.Unlock()
+		s.subs.unsubAll(sess)
+	}
+
+	sess := &session{
+		svr:    s,
+		id:     id,
+		expiry: expiry,
+		out:    newInflight(),
+		in:     make(map[uint16]struct{}),
+	}
+	s.sessions[id] = sess
+	return sess, false
+}
+
+// End a session, removing its subscriptions. It is not an error to
+// end a session which has already been replaced.
+func (s *Server) endSession(sess *session) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	if s.sessions[sess.id] == sess {
+		delete(s.sessions, sess.id)
+	}
+	s.subs.unsubAll(sess)
+}
+
+// End a detached session if its time is up. The session may have been
+// picked up again by a new connection before this got the lock.
+func (s *Server) expireSession(sess *session) {
+	s.sessionsMu.Lock()
+	sess.mu.Lock()
+	expired := sess.c == nil && !sess.expires.IsZero() && !time.Now().Before(sess.expires)
+	sess.mu.Unlock()
+	s.sessionsMu.Unlock()
+
+	if expired {
+		s.logger().Printf("session %v: expired", sess.id)
+		s.endSession(sess)
+	}
+}
+
+// Attach a connection to the session. Anything that was in flight when
+// the last connection ended is resent, followed by the messages which
+// were queued in the meantime. This must be called after the CONNACK
+// has been queued on c.
+func (sess *session) attach(c *incomingConn) {
+	sess.mu.Lock()
+	sess.c = c
+	sess.resending = true
+	resend := sess.out.due(time.Now())
+
+	// The lock is not held while sending, since the writer takes it to
+	// requeue what it could not send, if the connection goes; messages
+	// delivered meanwhile are queued, and sent in turn.
+	for {
+		for _, m := range sess.queue {
+			resend = append(resend, m)
+		}
+		sess.queue = nil
+		if len(resend) == 0 {
+			sess.resending = false
+			sess.mu.Unlock()
+			return
+		}
+		sess.mu.Unlock()
+
+		for i, m := range resend {
+			if !c.submitWait(m) {
+				sess.keep(resend[i:])
+				return
+			}
+		}
+		resend = nil
+		sess.mu.Lock()
+	}
+}
+
+// Hang on to what attach could not send, ahead of anything queued
+// meanwhile, but for QoS 0 messages, and those in flight, which will be
+// resent anyway.
+func (sess *session) keep(left []proto.Message) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	var queue []*proto.Publish
+	for _, m := range left {
+		if p, ok := m.(*proto.Publish); ok && p.MessageId == 0 {
+			queue = append(queue, p)
+		}
+	}
+	queue = append(queue, sess.queue...)
+	sess.queue = nil
+	for _, p := range queue {
+		if p.Header.QosLevel != proto.QosAtMostOnce {
+			sess.queue = append(sess.queue, p)
+		}
+	}
+	sess.resending = false
+}
+
+// Detach a connection from the session. Once this returns, no more
+// messages will be delivered to c. A session without an expiry ends
+// here; the others end when they expire, unless a connection picks them
+// up first.
+func (sess *session) detach(c *incomingConn) {
+	sess.mu.Lock()
+	if sess.c != c {
+		sess.mu.Unlock()
+		return
+	}
+	sess.c = nil
+	expiry := sess.expiry
+	if expiry != 0 && expiry != neverExpires {
+		sess.expires = time.Now().Add(expiry)
+		sess.timer = time.AfterFunc(expiry, func() {
+			sess.svr.expireSession(sess)
+		})
+	}
+	sess.mu.Unlock()
+
+	if expiry == 0 {
+		sess.svr.endSession(sess)
+	}
+}
+
+// Change how long the session is kept once its connection ends, as an
+// MQTT 5 client may do in its DISCONNECT.
+func (sess *session) setExpiry(expiry time.Duration) {
+	sess.mu.Lock()
+	sess.expiry = expiry
+	sess.mu.Unlock()
+}
+
+// How many messages are waiting to be sent on the session's
+// connection, or -1 if the client is not connected.
+func (sess *session) load() int {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if sess.c == nil {
+		return -1
+	}
+	return sess.c.queued()
+}
+
+// Deliver a message to the client, or, if it is not connected and the
+// message is QoS 1 or 2, queue it for when the client comes back. While
+// a new connection is being sent the queue, messages of any QoS join it.
+func (sess *session) deliver(m *proto.Publish, qos proto.QosLevel) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if sess.c != nil && !sess.resending {
+		sess.c.deliver(m, qos)
+		return
+	}
+
+	msg := downgrade(m, qos)
+	if msg.Header.QosLevel == proto.QosAtMostOnce && !sess.resending {
+		return
+	}
+	if len(sess.queue) >= sess.svr.MaxQueued {
+		sess.svr.logger().Printf("session %v: queue full, dropping message", sess.id)
+		return
+	}
+	sess.queue = append(sess.queue, msg)
+}
+
+// Take back a message which was queued for connection c, but which
+// was not sent before c went away. QoS 0 messages are dropped, as are
+// messages which are already in flight, since those will be resent
+// anyway.
+func (sess *session) requeue(c *incomingConn, m *proto.Publish) {
+	if m.Header.QosLevel == proto.QosAtMostOnce || m.MessageId != 0 {
+		return
+	}
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if sess.expiry == 0 {
+		return
+	}
+
+	if sess.c != nil && sess.c != c && !sess.resending {
+		sess.c.submit(m)
+		return
+	}
+	if len(sess.queue) >= sess.svr.MaxQueued {
+		sess.svr.logger().Printf("session %v: queue full, dropping message", sess.id)
+		return
+	}
+	sess.queue = append(sess.queue, m)
+}
+
+// Note the arrival of an incoming QoS 2 message. Returns true if this
+// is the first time it has been seen, i.e. if it should be published.
+func (sess *session) received(id uint16) bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if _, ok := sess.in[id]; ok {
+		return false
+	}
+	sess.in[id] = struct{}{}
+	return true
+}
+
+// Forget about an incoming QoS 2 message, because the PUBREL for it
+// has arrived.
+func (sess *session) released(id uint16) {
+	sess.mu.Lock()
+	delete(sess.in, id)
+	sess.mu.Unlock()
+}
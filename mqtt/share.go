@@ -0,0 +1,97 @@
+package mqtt
+
+import "strings"
+
+// A SharePolicy says which member of a shared subscription group gets
+// each message.
+//
+// A shared subscription is one to "$share/group/filter". Of all the
+// sessions subscribed to the same filter with the same group name,
+// only one is sent each message matching the filter, so that the
+// members of the group can share out the work.
+type SharePolicy int
+
+const (
+	ShareRoundRobin  SharePolicy = iota // each connected member in turn
+	ShareLeastLoaded                    // the connected member with the fewest messages waiting to be sent to it
+)
+
+const sharePrefix = "$share/"
+
+// Split a filter into the topic filter to match messages against, and
+// for a shared subscription, the whole "$share/group/filter", which
+// identifies the group. An ordinary filter is returned as it is, with
+// an empty share.
+func splitShare(filter string) (topic, share string) {
+	if !strings.HasPrefix(filter, sharePrefix) {
+		return filter, ""
+	}
+	rest := filter[len(sharePrefix):]
+	i := strings.Index(rest, "/")
+	if i <= 0 {
+		// no group name, or no filter; not valid
+		return "", filter
+	}
+	return rest[i+1:], filter
+}
+
+// Pick one member of each shared subscription group among subs to get
+// a message, leaving the ordinary subscriptions as they are.
+func (s *subscriptions) balance(subs []subscriber) []subscriber {
+	var groups map[string][]subscriber
+	var order []string // the groups, in the order they were found
+	var res []subscriber
+	for _, sub := range subs {
+		if sub.share == "" {
+			res = append(res, sub)
+			continue
+		}
+		if groups == nil {
+			groups = make(map[string][]subscriber)
+		}
+		if _, ok := groups[sub.share]; !ok {
+			order = append(order, sub.share)
+		}
+		groups[sub.share] = append(groups[sub.share], sub)
+	}
+	if groups == nil {
+		return subs
+	}
+
+	for _, share := range order {
+		res = append(res, s.choose(share, groups[share]))
+	}
+	return res
+}
+
+// Choose the member of a shared subscription group to get a message.
+// The members (or with ShareLeastLoaded, the least loaded ones) are
+// taken in turn; those which are not connected are only chosen if none
+// are, since a QoS 0 message sent to them is lost.
+func (s *subscriptions) choose(share string, members []subscriber) subscriber {
+	loads := make([]int, len(members))
+	for i := range members {
+		loads[i] = members[i].sess.load()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	start := s.next[share] % len(members)
+	best, bestLoad := start, -1
+	for i := range members {
+		j := (start + i) % len(members)
+		if loads[j] >= 0 && (bestLoad < 0 || loads[j] < bestLoad) {
+			best, bestLoad = j, loads[j]
+			if s.share != ShareLeastLoaded {
+				break
+			}
+		}
+	}
+	if s.share == ShareLeastLoaded {
+		s.next[share] = start + 1
+	} else {
+		// The turn passes to the one after the member chosen.
+		s.next[share] = best + 1
+	}
+	return members[best]
+}
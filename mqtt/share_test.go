@@ -0,0 +1,162 @@
+package mqtt
+
+import (
+	"testing"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestValidShare(t *testing.T) {
+	tests := []struct {
+		filter string
+		valid  bool
+	}{
+		{"$share/g/a/#", true},
+		{"$share/g/+", true},
+		{"$share/g//", true},
+		{"$share/g", false},
+		{"$share/g/", false},
+		{"$share//a", false},
+		{"$share/g+/a", false},
+		{"$share/#/a", false},
+		{"$share/g/a#", false},
+		{"$shared/g/a", true}, // not a shared subscription, but valid
+	}
+	for _, test := range tests {
+		if got := validFilter(test.filter); got != test.valid {
+			t.Errorf("%q: got %v, want %v", test.filter, got, test.valid)
+		}
+	}
+}
+
+func TestChoose(t *testing.T) {
+	// Make a member with n messages waiting, or a disconnected one
+	// for n < 0.
+	member := func(n int) subscriber {
+		sess := &session{}
+		if n >= 0 {
+			sess.c = &incomingConn{jobs: make(chan job, 10)}
+			for i := 0; i < n; i++ {
+				sess.c.jobs <- job{}
+			}
+		}
+		return subscriber{sess: sess, share: "$share/g/t"}
+	}
+
+	s := newSubscriptions(nil, 0)
+	members := []subscriber{member(2), member(-1), member(1), member(1)}
+	var got []int
+	for i := 0; i < 4; i++ {
+		m := s.choose("$share/g/t", members)
+		for j := range members {
+			if members[j].sess == m.sess {
+				got = append(got, j)
+			}
+		}
+	}
+	// The disconnected one is passed over.
+	if want := []int{0, 2, 3, 0}; !equalInts(got, want) {
+		t.Errorf("round robin: got %v, want %v", got, want)
+	}
+
+	// Ties go to each in turn; the disconnected one is passed over.
+	s.share = ShareLeastLoaded
+	got = nil
+	for i := 0; i < 4; i++ {
+		m := s.choose("$share/g/t", members)
+		for j := range members {
+			if members[j].sess == m.sess {
+				got = append(got, j)
+			}
+		}
+	}
+	if want := []int{2, 2, 3, 2}; !equalInts(got, want) {
+		t.Errorf("least loaded: got %v, want %v", got, want)
+	}
+
+	// If nobody is connected, it is round robin again.
+	got = nil
+	for i := 0; i < 2; i++ {
+		m := s.choose("$share/h/t", members[1:2])
+		if m.sess != members[1].sess {
+			t.Error("did not choose the only member")
+		}
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestShared(t *testing.T) {
+	svr := NewServer(nil)
+	pub := newTestClient(t, svr, "pub")
+	all := newTestClient(t, svr, "all")
+
+	// Shared subscriptions do not get retained messages.
+	pub.send(&proto.Publish{
+		Header:    header(dupFalse, proto.QosAtMostOnce, retainTrue),
+		TopicName: "jobs/old",
+		Payload:   proto.BytesPayload("old"),
+	})
+	all.subscribe("jobs/#", proto.QosAtMostOnce)
+	if m, ok := all.recv().(*proto.Publish); !ok || m.TopicName != "jobs/old" {
+		t.Fatalf("expected retained message, got %v", m)
+	}
+
+	w1 := newTestClient(t, svr, "w1")
+	w1.subscribe("$share/g/jobs/+", proto.QosAtMostOnce)
+	w1.subscribe("done", proto.QosAtMostOnce)
+	w2 := newTestClient(t, svr, "w2")
+	w2.subscribe("$share/g/jobs/+", proto.QosAtMostOnce)
+	w2.subscribe("done", proto.QosAtMostOnce)
+
+	// The group shares the work; everyone else sees it all.
+	for i := 0; i < 4; i++ {
+		pub.send(&proto.Publish{TopicName: "jobs/new", Payload: proto.BytesPayload{byte('0' + i)}})
+	}
+	for i := 0; i < 4; i++ {
+		if m, ok := all.recv().(*proto.Publish); !ok || m.TopicName != "jobs/new" {
+			t.Fatalf("expected message on jobs/new, got %v", m)
+		}
+	}
+	for _, w := range []*testClient{w1, w2} {
+		for i := 0; i < 2; i++ {
+			if m, ok := w.recv().(*proto.Publish); !ok || m.TopicName != "jobs/new" {
+				t.Fatalf("expected message on jobs/new, got %v", m)
+			}
+		}
+	}
+	pub.send(&proto.Publish{TopicName: "done", Payload: proto.BytesPayload("!")})
+	for _, w := range []*testClient{w1, w2} {
+		if m, ok := w.recv().(*proto.Publish); !ok || m.TopicName != "done" {
+			t.Fatalf("expected message on done, got %v", m)
+		}
+	}
+
+	// Once w1 leaves the group, w2 gets everything.
+	w1.send(&proto.Unsubscribe{
+		Header:    header(dupFalse, proto.QosAtLeastOnce, retainFalse),
+		MessageId: 2,
+		Topics:    []string{"$share/g/jobs/+"},
+	})
+	if _, ok := w1.recv().(*proto.UnsubAck); !ok {
+		t.Fatal("expected UNSUBACK")
+	}
+	for i := 0; i < 2; i++ {
+		pub.send(&proto.Publish{TopicName: "jobs/new", Payload: proto.BytesPayload{byte('0' + i)}})
+	}
+	for i := 0; i < 2; i++ {
+		if m, ok := w2.recv().(*proto.Publish); !ok || m.TopicName != "jobs/new" {
+			t.Fatalf("expected message on jobs/new, got %v", m)
+		}
+	}
+}
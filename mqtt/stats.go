@@ -0,0 +1,306 @@
+package mqtt
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync/atomic"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+// The version reported in $SYS/broker/version.
+const version = "jra-go mqtt"
+
+// The stats of a Server, which are published under $SYS, in the same
+// topics as mosquitto uses, so that the same monitoring works for both.
+// The fields are updated using sync/atomic.
+type stats struct {
+	start       time.Time
+	recv        int64
+	sent        int64
+	recvTypes   [16]int64 // packets received, by proto.MessageType
+	sentTypes   [16]int64 // packets sent, by proto.MessageType
+	bytesRecv   int64
+	bytesSent   int64
+	dropped     int64
+	clients     int64
+	clientsMax  int64
+	connections int64 // connections ever made
+
+	// Only touched by the stats goroutine.
+	last     time.Time
+	lastmsgs int64
+	loads    map[string]*loadAvg // by topic, under $SYS/broker/load
+}
+
+func newStats() *stats {
+	now := time.Now()
+	return &stats{start: now, last: now, loads: make(map[string]*loadAvg)}
+}
+
+func (s *stats) messageRecv(m message) {
+	atomic.AddInt64(&s.recv, 1)
+	atomic.AddInt64(&s.recvTypes[messageType(m)], 1)
+}
+func (s *stats) messageSend(m message) {
+	atomic.AddInt64(&s.sent, 1)
+	atomic.AddInt64(&s.sentTypes[messageType(m)], 1)
+}
+func (s *stats) messageDropped() { atomic.AddInt64(&s.dropped, 1) }
+func (s *stats) clientConnect() {
+	atomic.AddInt64(&s.clients, 1)
+	atomic.AddInt64(&s.connections, 1)
+}
+func (s *stats) clientDisconnect() { atomic.AddInt64(&s.clients, -1) }
+
+// The type of a message, which is zero if it is not one we know.
+func messageType(m message) proto.MessageType {
+	switch unwrap(m).(type) {
+	case *proto.Connect:
+		return proto.MsgConnect
+	case *proto.ConnAck, *connAck4:
+		return proto.MsgConnAck
+	case *proto.Publish:
+		return proto.MsgPublish
+	case *proto.PubAck:
+		return proto.MsgPubAck
+	case *proto.PubRec:
+		return proto.MsgPubRec
+	case *proto.PubRel:
+		return proto.MsgPubRel
+	case *proto.PubComp:
+		return proto.MsgPubComp
+	case *proto.Subscribe:
+		return proto.MsgSubscribe
+	case *proto.SubAck:
+		return proto.MsgSubAck
+	case *proto.Unsubscribe:
+		return proto.MsgUnsubscribe
+	case *proto.UnsubAck:
+		return proto.MsgUnsubAck
+	case *proto.PingReq:
+		return proto.MsgPingReq
+	case *proto.PingResp:
+		return proto.MsgPingResp
+	case *proto.Disconnect:
+		return proto.MsgDisconnect
+	}
+	return 0
+}
+
+// The names of the message types, for the $SYS/broker/packets topics.
+var messageTypeNames = [...]string{
+	proto.MsgConnect:     "connect",
+	proto.MsgConnAck:     "connack",
+	proto.MsgPublish:     "publish",
+	proto.MsgPubAck:      "puback",
+	proto.MsgPubRec:      "pubrec",
+	proto.MsgPubRel:      "pubrel",
+	proto.MsgPubComp:     "pubcomp",
+	proto.MsgSubscribe:   "subscribe",
+	proto.MsgSubAck:      "suback",
+	proto.MsgUnsubscribe: "unsubscribe",
+	proto.MsgUnsubAck:    "unsuback",
+	proto.MsgPingReq:     "pingreq",
+	proto.MsgPingResp:    "pingresp",
+	proto.MsgDisconnect:  "disconnect",
+}
+
+// A loadAvg is the rate per minute at which a count goes up, averaged
+// over 1, 5 and 15 minutes, as for the load averages of a Unix system.
+type loadAvg struct {
+	last int64
+	avg  [3]float64
+}
+
+var loadPeriods = [3]struct {
+	name string
+	secs float64
+}{{"1min", 60}, {"5min", 300}, {"15min", 900}}
+
+// Take in the value of the count, dt seconds after the last one.
+func (l *loadAvg) update(count int64, dt float64) {
+	rate := float64(count-l.last) * 60 / dt
+	l.last = count
+	for i, p := range loadPeriods {
+		e := math.Exp(-dt / p.secs)
+		l.avg[i] = l.avg[i]*e + rate*(1-e)
+	}
+}
+
+func statsMessage(topic string, stat int64) *proto.Publish {
+	return &proto.Publish{
+		Header:    header(dupFalse, proto.QosAtMostOnce, retainTrue),
+		TopicName: topic,
+		Payload:   newIntPayload(stat),
+	}
+}
+
+func sysMessage(topic, text string) *proto.Publish {
+	return &proto.Publish{
+		Header:    header(dupFalse, proto.QosAtMostOnce, retainTrue),
+		TopicName: topic,
+		Payload:   proto.BytesPayload(text),
+	}
+}
+
+// Publish the stats, as they are now.
+func (s *Server) publishStats(now time.Time) {
+	st := s.stats
+	sub := s.subs
+	count := func(topic string, stat int64) {
+		sub.submit(nil, statsMessage("$SYS/broker/"+topic, stat))
+	}
+
+	clients := atomic.LoadInt64(&st.clients)
+	clientsMax := atomic.LoadInt64(&st.clientsMax)
+	if clients > clientsMax {
+		clientsMax = clients
+		atomic.StoreInt64(&st.clientsMax, clientsMax)
+	}
+	connected, disconnected := s.countClients()
+	count("clients/active", clients)
+	count("clients/maximum", clientsMax)
+	count("clients/connected", connected)
+	count("clients/disconnected", disconnected)
+	count("clients/total", connected+disconnected)
+
+	// The counters, and the topics of their load averages.
+	recv := atomic.LoadInt64(&st.recv)
+	sent := atomic.LoadInt64(&st.sent)
+	counters := []struct {
+		topic, load string
+		n           int64
+	}{
+		{"messages/received", "messages/received", recv},
+		{"messages/sent", "messages/sent", sent},
+		{"publish/messages/received", "publish/received", atomic.LoadInt64(&st.recvTypes[proto.MsgPublish])},
+		{"publish/messages/sent", "publish/sent", atomic.LoadInt64(&st.sentTypes[proto.MsgPublish])},
+		{"publish/messages/dropped", "publish/dropped", atomic.LoadInt64(&st.dropped)},
+		{"bytes/received", "bytes/received", atomic.LoadInt64(&st.bytesRecv)},
+		{"bytes/sent", "bytes/sent", atomic.LoadInt64(&st.bytesSent)},
+		{"", "connections", atomic.LoadInt64(&st.connections)},
+	}
+	for _, c := range counters {
+		if c.topic != "" {
+			count(c.topic, c.n)
+		}
+	}
+	for i, name := range messageTypeNames {
+		if name == "" {
+			continue
+		}
+		if n := atomic.LoadInt64(&st.recvTypes[i]); n > 0 {
+			count("packets/received/"+name, n)
+		}
+		if n := atomic.LoadInt64(&st.sentTypes[i]); n > 0 {
+			count("packets/sent/"+name, n)
+		}
+	}
+
+	subscriptions, retained := sub.count()
+	count("subscriptions/count", int64(subscriptions))
+	count("retained messages/count", int64(retained))
+
+	sub.submit(nil, sysMessage("$SYS/broker/uptime", fmt.Sprintf("%d seconds", int64(now.Sub(st.start)/time.Second))))
+	sub.submit(nil, sysMessage("$SYS/broker/version", version))
+
+	// The rates are worked out over the time since the last time,
+	// which is not always exactly StatsInterval.
+	dt := now.Sub(st.last).Seconds()
+	if dt <= 0 {
+		return
+	}
+	st.last = now
+
+	msgs := recv + sent
+	count("messages/per-sec", int64(math.Floor(float64(msgs-st.lastmsgs)/dt+0.5)))
+	// no need for atomic because we are the only reader/writer of it
+	st.lastmsgs = msgs
+
+	for _, c := range counters {
+		l := st.loads[c.load]
+		if l == nil {
+			l = &loadAvg{}
+			st.loads[c.load] = l
+		}
+		l.update(c.n, dt)
+		for i, p := range loadPeriods {
+			sub.submit(nil, sysMessage("$SYS/broker/load/"+c.load+"/"+p.name, fmt.Sprintf("%.2f", l.avg[i])))
+		}
+	}
+}
+
+// Count the clients which are connected, and the sessions which are
+// being kept for clients which are not.
+func (s *Server) countClients() (connected, disconnected int64) {
+	s.clientsMu.Lock()
+	connected = int64(len(s.clients))
+	s.clientsMu.Unlock()
+
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	for _, sess := range s.sessions {
+		sess.mu.Lock()
+		if sess.c == nil {
+			disconnected++
+		}
+		sess.mu.Unlock()
+	}
+	return
+}
+
+// Count the subscriptions, and the retained messages.
+func (s *subscriptions) count() (subscriptions, retained int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, topics := range s.topics {
+		subscriptions += len(topics)
+	}
+	return subscriptions, s.retain.Len()
+}
+
+// An intPayload implements proto.Payload, and is an int64 that
+// formats itself and then prints itself into the payload.
+type intPayload string
+
+func newIntPayload(i int64) intPayload {
+	return intPayload(fmt.Sprint(i))
+}
+func (ip intPayload) ReadPayload(r io.Reader) error {
+	// not implemented
+	return nil
+}
+func (ip intPayload) WritePayload(w io.Writer) error {
+	_, err := w.Write([]byte(string(ip)))
+	return err
+}
+func (i intPayload) Size() int {
+	return len(i)
+}
+
+// A meteredReader counts the bytes read through it into n.
+type meteredReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (mr meteredReader) Read(b []byte) (int, error) {
+	n, err := mr.r.Read(b)
+	atomic.AddInt64(mr.n, int64(n))
+	return n, err
+}
+
+// A meteredWriter counts the bytes written through it into n.
+type meteredWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (mw meteredWriter) Write(b []byte) (int, error) {
+	n, err := mw.w.Write(b)
+	atomic.AddInt64(mw.n, int64(n))
+	return n, err
+}
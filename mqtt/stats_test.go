@@ -0,0 +1,76 @@
+package mqtt
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestStats(t *testing.T) {
+	// A Server without the stats goroutine, so that we say when the
+	// stats are published.
+	svr := &Server{
+		stats:    newStats(),
+		subs:     newSubscriptions(nil, 1),
+		clients:  make(map[string]*incomingConn),
+		sessions: make(map[string]*session),
+	}
+	now := time.Now()
+	st := svr.stats
+	st.start = now.Add(-90 * time.Second)
+	st.last = now.Add(-4 * time.Second)
+	st.recv = 30
+	st.sent = 10
+	st.recvTypes[proto.MsgPublish] = 5
+	st.recvTypes[proto.MsgPingReq] = 25
+	st.bytesRecv = 100
+	svr.publishStats(now)
+
+	// The stats are retained, so we can look there, once the last one
+	// is done.
+	retained := func(topic string) string {
+		svr.subs.mu.Lock()
+		defer svr.subs.mu.Unlock()
+		for _, m := range svr.subs.retain.Match(topic) {
+			var buf bytes.Buffer
+			m.Payload.WritePayload(&buf)
+			return buf.String()
+		}
+		return ""
+	}
+	for start := time.Now(); retained("$SYS/broker/load/connections/15min") == ""; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("stats not published")
+		}
+	}
+
+	load := 30 * 60 / 4 * (1 - math.Exp(-4.0/60))
+	tests := []struct {
+		topic, want string
+	}{
+		{"$SYS/broker/messages/received", "30"},
+		{"$SYS/broker/messages/sent", "10"},
+		{"$SYS/broker/messages/per-sec", "10"},
+		{"$SYS/broker/publish/messages/received", "5"},
+		{"$SYS/broker/publish/messages/dropped", "0"},
+		{"$SYS/broker/packets/received/pingreq", "25"},
+		{"$SYS/broker/packets/sent/pingresp", ""},
+		{"$SYS/broker/bytes/received", "100"},
+		{"$SYS/broker/clients/connected", "0"},
+		{"$SYS/broker/subscriptions/count", "0"},
+		{"$SYS/broker/retained messages/count", "0"},
+		{"$SYS/broker/uptime", "90 seconds"},
+		{"$SYS/broker/version", version},
+		{"$SYS/broker/load/messages/received/1min", fmt.Sprintf("%.2f", load)},
+		{"$SYS/broker/load/messages/sent/1min", fmt.Sprintf("%.2f", load/3)},
+	}
+	for _, test := range tests {
+		if got := retained(test.topic); got != test.want {
+			t.Errorf("%v: got %q, want %q", test.topic, got, test.want)
+		}
+	}
+}
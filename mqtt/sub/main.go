@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"time"
 
 	"code.google.com/p/jra-go/mqtt"
 	proto "github.com/huin/mqtt"
@@ -15,6 +16,7 @@ var id = flag.String("id", "", "client id")
 var user = flag.String("user", "", "username")
 var pass = flag.String("pass", "", "password")
 var dump = flag.Bool("dump", false, "dump messages?")
+var keepalive = flag.Duration("keepalive", time.Minute, "how often to ping the broker when idle; 0 for never")
 
 func main() {
 	flag.Parse()
@@ -32,6 +34,12 @@ func main() {
 	cc := mqtt.NewClientConn(conn)
 	cc.Dump = *dump
 	cc.ClientId = *id
+	cc.KeepAlive = *keepalive
+	cc.StateChanged = func(state mqtt.ConnState, err error) {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", state, err)
+		}
+	}
 
 	tq := make([]proto.TopicQos, flag.NArg())
 	for i := 0; i < flag.NArg(); i++ {
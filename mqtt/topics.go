@@ -0,0 +1,110 @@
+package mqtt
+
+import "strings"
+
+// A subTree holds the subscriptions, indexed one topic level at a time.
+// The + and # wildcards are stored as ordinary levels, so that finding
+// the subscribers to a topic only visits the branches which can match
+// it, no matter how many wildcard subscriptions there are.
+//
+// As in MQTT 3.1.1, a wildcard in the first level does not match
+// topics starting with $, so "#" does not match "$SYS/broker/uptime",
+// but "$SYS/#" does.
+type subTree struct {
+	root subNode
+}
+
+type subNode struct {
+	subs []subscriber // the subscriptions which end at this level
+	kids map[string]*subNode
+}
+
+func newSubTree() *subTree {
+	return &subTree{}
+}
+
+// Add a subscription. If the session is already subscribed to exactly
+// this topic (in the same way, shared or not), only its QoS level and
+// options are changed. Returns true if the subscription is a new one.
+func (t *subTree) add(topic string, sub subscriber) bool {
+	n := &t.root
+	for _, part := range strings.Split(topic, "/") {
+		if n.kids == nil {
+			n.kids = make(map[string]*subNode)
+		}
+		kid, ok := n.kids[part]
+		if !ok {
+			kid = &subNode{}
+			n.kids[part] = kid
+		}
+		n = kid
+	}
+	for i := range n.subs {
+		if n.subs[i].same(sub) {
+			n.subs[i] = sub
+			return false
+		}
+	}
+	n.subs = append(n.subs, sub)
+	return true
+}
+
+// Remove the subscription to topic which is the same as sub, if there
+// is one.
+func (t *subTree) remove(topic string, sub subscriber) {
+	t.root.remove(strings.Split(topic, "/"), sub)
+}
+
+// Remove the subscription at the end of the path given by parts, and
+// return true if n is now empty, so that the caller can prune it.
+func (n *subNode) remove(parts []string, sub subscriber) bool {
+	if len(parts) == 0 {
+		for i := range n.subs {
+			if n.subs[i].same(sub) {
+				// Make a new slice, since subscribers() may
+				// have handed the old one out.
+				subs := make([]subscriber, 0, len(n.subs)-1)
+				subs = append(subs, n.subs[:i]...)
+				n.subs = append(subs, n.subs[i+1:]...)
+				break
+			}
+		}
+	} else if kid, ok := n.kids[parts[0]]; ok {
+		if kid.remove(parts[1:], sub) {
+			delete(n.kids, parts[0])
+		}
+	}
+	return len(n.subs) == 0 && len(n.kids) == 0
+}
+
+// Find the subscriptions matching topic, which must not contain
+// wildcards.
+func (t *subTree) match(topic string) []subscriber {
+	parts := strings.Split(topic, "/")
+	if strings.HasPrefix(parts[0], "$") {
+		// skip the wildcards at the first level
+		kid, ok := t.root.kids[parts[0]]
+		if !ok {
+			return nil
+		}
+		return kid.match(parts[1:], nil)
+	}
+	return t.root.match(parts, nil)
+}
+
+func (n *subNode) match(parts []string, res []subscriber) []subscriber {
+	// finance/stock/ibm/# matches finance/stock/ibm too
+	if kid, ok := n.kids["#"]; ok {
+		res = append(res, kid.subs...)
+	}
+	if len(parts) == 0 {
+		return append(res, n.subs...)
+	}
+	if kid, ok := n.kids[parts[0]]; ok {
+		res = kid.match(parts[1:], res)
+	}
+	if kid, ok := n.kids["+"]; ok {
+		res = kid.match(parts[1:], res)
+	}
+	return res
+}
@@ -0,0 +1,154 @@
+package mqtt
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestSubTree(t *testing.T) {
+	// Each session is subscribed to the topic that is its id.
+	topics := []string{
+		"finance/stock/ibm/#",
+		"finance/stock/+/close",
+		"finance/stock/ibm",
+		"+/+/+",
+		"#",
+		"+/#",
+		"$SYS/#",
+		"$SYS/broker/+",
+		"/leading",
+	}
+	st := newSubTree()
+	for _, topic := range topics {
+		st.add(topic, subscriber{sess: &session{id: topic}})
+	}
+
+	var tests = []struct {
+		topic string
+		want  []string
+	}{
+		{"finance/stock/ibm", []string{"finance/stock/ibm/#", "finance/stock/ibm", "+/+/+", "#", "+/#"}},
+		{"finance/stock/ibm/close", []string{"finance/stock/ibm/#", "finance/stock/+/close", "#", "+/#"}},
+		{"finance", []string{"#", "+/#"}},
+		{"a/b/c", []string{"+/+/+", "#", "+/#"}},
+		{"/leading", []string{"/leading", "#", "+/#"}},
+		{"$SYS/broker/uptime", []string{"$SYS/#", "$SYS/broker/+"}},
+		{"$SYS", []string{"$SYS/#"}},
+		{"$other", nil},
+	}
+	for _, x := range tests {
+		var got []string
+		for _, sub := range st.match(x.topic) {
+			got = append(got, sub.sess.id)
+		}
+		sort.Strings(got)
+		sort.Strings(x.want)
+		if strings.Join(got, " ") != strings.Join(x.want, " ") {
+			t.Errorf("%v: got %v, want %v", x.topic, got, x.want)
+		}
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	s := &subscriptions{
+		tree:   newSubTree(),
+		topics: make(map[*session]map[string]bool),
+	}
+	a, b := &session{id: "a"}, &session{id: "b"}
+
+	if !s.add("x/+", subscriber{sess: a, qos: proto.QosAtMostOnce}) {
+		t.Error("new subscription not reported as new")
+	}
+	if s.add("x/+", subscriber{sess: a, qos: proto.QosExactlyOnce}) {
+		t.Error("resubscription reported as new")
+	}
+	s.add("x/y", subscriber{sess: a, qos: proto.QosAtLeastOnce})
+	s.add("x/#", subscriber{sess: b, qos: proto.QosAtLeastOnce})
+	s.add("x/#/bad", subscriber{sess: b, qos: proto.QosAtLeastOnce})
+
+	subs := s.subscribers("x/y")
+	if len(subs) != 3 {
+		t.Fatal("expected 3 subscribers, got ", subs)
+	}
+	for _, sub := range subs {
+		if sub.sess == a && sub.qos == proto.QosAtMostOnce {
+			t.Error("resubscribing did not replace the QoS")
+		}
+	}
+
+	if !s.unsub("x/y", a) || s.unsub("x/y", a) {
+		t.Error("unsub did not report whether there was a subscription")
+	}
+	s.unsubAll(b)
+	subs = s.subscribers("x/y")
+	if len(subs) != 1 || subs[0].sess != a {
+		t.Fatal("expected only a, got ", subs)
+	}
+	s.unsubAll(a)
+	if len(s.tree.root.kids) != 0 || len(s.topics) != 0 {
+		t.Fatal("subscriptions left behind: ", s.tree.root.kids, s.topics)
+	}
+}
+
+// Subscriptions in the style of mqtt/pingtest: a pair of exact
+// subscriptions per pinger, and a crowd of wildcard subscribers.
+func benchSubscriptions(pairs, wsubs int) ([]string, []string) {
+	var exact, wildcards []string
+	for i := 0; i < pairs; i++ {
+		exact = append(exact,
+			fmt.Sprintf("pingtest/%v/request", i),
+			fmt.Sprintf("pingtest/%v/reply", i))
+	}
+	for i := 0; i < wsubs; i++ {
+		wildcards = append(wildcards,
+			fmt.Sprintf("pingtest/%v/#", i%pairs),
+			fmt.Sprintf("pingtest/+/%v", i))
+	}
+	return exact, wildcards
+}
+
+const benchPairs, benchWsubs = 100, 1000
+
+func BenchmarkSubscribersTrie(b *testing.B) {
+	exact, wildcards := benchSubscriptions(benchPairs, benchWsubs)
+	st := newSubTree()
+	for _, t := range append(exact, wildcards...) {
+		st.add(t, subscriber{sess: &session{}})
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = st.match(exact[i%len(exact)])
+	}
+}
+
+// The map of exact topics and list of wildcards that subscriptions
+// used before subTree.
+func BenchmarkSubscribersLinear(b *testing.B) {
+	exact, wildcards := benchSubscriptions(benchPairs, benchWsubs)
+	subs := make(map[string][]subscriber)
+	for _, t := range exact {
+		subs[t] = append(subs[t], subscriber{sess: &session{}})
+	}
+	var ws []wild
+	for _, t := range wildcards {
+		ws = append(ws, newWild(t))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		topic := exact[i%len(exact)]
+		var res []subscriber
+		res = append(res, subs[topic]...)
+		parts := strings.Split(topic, "/")
+		for _, w := range ws {
+			if w.matches(parts) {
+				res = append(res, subscriber{})
+			}
+		}
+	}
+}
@@ -0,0 +1,466 @@
+package mqtt
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MQTT over WebSocket (RFC 6455) sends the MQTT byte stream in binary
+// messages, with subprotocol "mqtt". A WebSocketListener takes WebSocket
+// connections from an HTTP server and hands them out as net.Conns, so
+// that a Server can use it like any other listener, and DialWebSocket
+// does the same for a ClientConn.
+
+// A WebSocketListener is a net.Listener for MQTT over WebSocket. It is an
+// http.Handler, which accepts the WebSocket upgrade requests sent to it;
+// the connections then come out of Accept.
+type WebSocketListener struct {
+	// When set, decides whether a browser on the page with the given
+	// Origin may connect. By default, all origins are allowed.
+	CheckOrigin func(r *http.Request) bool
+
+	addr  net.Addr
+	l     net.Listener // the listener the HTTP requests come from, if ours
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+	svr   atomic.Value // the *Server it was added to, which it logs through; set by AddListener
+}
+
+// The Logger of the Server the listener was added to, if any.
+func (wl *WebSocketListener) logger() Logger {
+	s, _ := wl.svr.Load().(*Server)
+	return s.logger()
+}
+
+var errWSClosed = errors.New("mqtt: WebSocket listener closed")
+
+// NewWebSocketListener makes a WebSocketListener, to be served by an
+// http.Server listening on addr.
+func NewWebSocketListener(addr net.Addr) *WebSocketListener {
+	return &WebSocketListener{
+		addr:  addr,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// ServeWebSocket serves HTTP on l (which may be a TLS listener),
+// upgrading the requests for path to MQTT over WebSocket, and returns
+// the listener the connections come out of. Closing it closes l.
+func ServeWebSocket(l net.Listener, path string) *WebSocketListener {
+	wl := NewWebSocketListener(l.Addr())
+	wl.l = l
+	mux := http.NewServeMux()
+	mux.Handle(path, wl)
+	go func() {
+		err := http.Serve(l, mux)
+		select {
+		case <-wl.done:
+		default:
+			wl.logger().Print("websocket: ", err)
+			wl.Close()
+		}
+	}()
+	return wl
+}
+
+// Accept implements net.Listener.
+func (wl *WebSocketListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-wl.conns:
+		return c, nil
+	case <-wl.done:
+		return nil, errWSClosed
+	}
+}
+
+// Close implements net.Listener. Connections which have already been
+// accepted are not closed.
+func (wl *WebSocketListener) Close() error {
+	var err error
+	wl.once.Do(func() {
+		close(wl.done)
+		if wl.l != nil {
+			err = wl.l.Close()
+		}
+	})
+	return err
+}
+
+// Addr implements net.Listener.
+func (wl *WebSocketListener) Addr() net.Addr {
+	return wl.addr
+}
+
+// The subprotocols we speak, best first. "mqttv3.1" is what clients
+// asked for before MQTT 3.1.1 settled on "mqtt".
+var wsProtocols = []string{"mqtt", "mqttv3.1"}
+
+// The GUID from RFC 6455 which goes into Sec-WebSocket-Accept.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+func wsAccept(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+wsGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Does the comma separated header contain token, ignoring case?
+func headerHas(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ServeHTTP implements http.Handler, by upgrading the request to a
+// WebSocket and passing the connection on to Accept.
+func (wl *WebSocketListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" ||
+		!headerHas(r.Header, "Connection", "upgrade") ||
+		!headerHas(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "WebSocket upgrade required", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+	if wl.CheckOrigin != nil && !wl.CheckOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	protocol := ""
+	for _, p := range wsProtocols {
+		if headerHas(r.Header, "Sec-WebSocket-Protocol", p) {
+			protocol = p
+			break
+		}
+	}
+	if protocol == "" {
+		http.Error(w, "subprotocol mqtt required", http.StatusBadRequest)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "cannot upgrade this connection", http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		wl.logger().Print("websocket: ", err)
+		return
+	}
+	// Forget any timeouts the HTTP server set.
+	conn.SetDeadline(time.Time{})
+
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %v\r\n"+
+		"Sec-WebSocket-Protocol: %v\r\n\r\n", wsAccept(key), protocol)
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+
+	c := newWSConn(conn, brw.Reader, false)
+	select {
+	case wl.conns <- c:
+	case <-wl.done:
+		c.Close()
+	}
+}
+
+// DialWebSocket connects to an MQTT server at a ws:// or wss:// URL. The
+// TLS configuration is used for wss:// URLs, and may be nil. The
+// connection is ready for NewClientConn.
+func DialWebSocket(rawurl string, config *tls.Config) (net.Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		if u.Port() == "" {
+			host = net.JoinHostPort(host, "80")
+		}
+		conn, err = net.Dial("tcp", host)
+	case "wss":
+		if u.Port() == "" {
+			host = net.JoinHostPort(host, "443")
+		}
+		conn, err = tls.Dial("tcp", host, config)
+	default:
+		return nil, fmt.Errorf("mqtt: not a WebSocket URL: %v", rawurl)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Upgrade":                {"websocket"},
+			"Connection":             {"Upgrade"},
+			"Sec-WebSocket-Key":      {key},
+			"Sec-WebSocket-Version":  {"13"},
+			"Sec-WebSocket-Protocol": {"mqtt"},
+		},
+		Host: u.Host,
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) ||
+		resp.Header.Get("Sec-WebSocket-Protocol") != "mqtt" {
+		conn.Close()
+		return nil, fmt.Errorf("mqtt: WebSocket handshake with %v failed: %v", rawurl, resp.Status)
+	}
+	return newWSConn(conn, br, true), nil
+}
+
+// WebSocket opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// How long to spend telling the other end we are closing.
+const wsCloseTimeout = time.Second
+
+// A wsConn is a net.Conn which carries its byte stream in WebSocket
+// binary messages. Each Write sends one message. Pings are answered by
+// Read.
+type wsConn struct {
+	net.Conn               // the connection underneath, for everything but Read, Write and Close
+	br       *bufio.Reader // reads from Conn, and may hold some of what came with the handshake
+	client   bool          // clients mask what they send, servers do not
+
+	// The frame being read; only touched by Read.
+	remaining uint64
+	mask      [4]byte
+	masked    bool
+	maskPos   int
+
+	wmu       sync.Mutex // serializes writing frames, and guards the fields below
+	wbroken   bool       // a write failed, perhaps half way through a frame
+	closeSent bool
+	closeOnce sync.Once
+}
+
+func newWSConn(conn net.Conn, br *bufio.Reader, client bool) *wsConn {
+	return &wsConn{Conn: conn, br: br, client: client}
+}
+
+// Read implements net.Conn.
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.br.Read(p)
+	if c.masked {
+		for i := 0; i < n; i++ {
+			p[i] ^= c.mask[c.maskPos&3]
+			c.maskPos++
+		}
+	}
+	c.remaining -= uint64(n)
+	return n, unexpectedEOF(err)
+}
+
+// Read the header of the next frame of data, dealing with any control
+// frames on the way.
+func (c *wsConn) nextFrame() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		return err
+	}
+	op := hdr[0] & 0x0f
+	c.masked = hdr[1]&0x80 != 0
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return unexpectedEOF(err)
+		}
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return unexpectedEOF(err)
+		}
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	if c.masked {
+		if _, err := io.ReadFull(c.br, c.mask[:]); err != nil {
+			return unexpectedEOF(err)
+		}
+		c.maskPos = 0
+	}
+	// Clients must mask, and servers must not.
+	if c.masked == c.client {
+		return errors.New("mqtt: badly masked WebSocket frame")
+	}
+
+	switch op {
+	case wsBinary, wsContinuation:
+		c.remaining = n
+		return nil
+	case wsClose, wsPing, wsPong:
+		if n > 125 {
+			return errors.New("mqtt: WebSocket control frame too long")
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return unexpectedEOF(err)
+		}
+		if c.masked {
+			for i := range payload {
+				payload[i] ^= c.mask[i&3]
+			}
+		}
+		switch op {
+		case wsPing:
+			c.writeFrame(wsPong, payload)
+		case wsClose:
+			// Echo the status code, and that is the end.
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			c.writeFrame(wsClose, payload)
+			return io.EOF
+		}
+		return nil
+	case wsText:
+		return errors.New("mqtt: text WebSocket message")
+	}
+	return fmt.Errorf("mqtt: unknown WebSocket opcode %#x", op)
+}
+
+// Write implements net.Conn.
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Write one complete frame. Nothing more is sent after a close frame.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return errWSClosed
+	}
+	if op == wsClose {
+		c.closeSent = true
+	}
+
+	buf := make([]byte, 0, 14+len(payload))
+	buf = append(buf, 0x80|op)
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		buf = append(buf, maskBit|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, maskBit|126, byte(n>>8), byte(n))
+	default:
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(n))
+		buf = append(buf, maskBit|127)
+		buf = append(buf, b[:]...)
+	}
+	if c.client {
+		var mask [4]byte
+		rand.Read(mask[:])
+		buf = append(buf, mask[:]...)
+		for i, b := range payload {
+			buf = append(buf, b^mask[i&3])
+		}
+	} else {
+		buf = append(buf, payload...)
+	}
+
+	_, err := c.Conn.Write(buf)
+	if err != nil {
+		c.wbroken = true
+	}
+	return err
+}
+
+// Close implements net.Conn, saying goodbye first if we can.
+func (c *wsConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		// Interrupt a write in progress, so that we get the lock.
+		c.Conn.SetWriteDeadline(time.Now())
+		c.wmu.Lock()
+		broken := c.wbroken
+		c.wmu.Unlock()
+		if !broken {
+			c.Conn.SetWriteDeadline(time.Now().Add(wsCloseTimeout))
+			c.writeFrame(wsClose, []byte{0x03, 0xe8}) // 1000, normal closure
+		}
+		err = c.Conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,97 @@
+package mqtt
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	proto "github.com/huin/mqtt"
+)
+
+func TestWebSocket(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wl := ServeWebSocket(l, "/mqtt")
+	svr := NewServer(wl)
+	logTo := log.New(new(bytes.Buffer), "", 0)
+	svr.SetLogger(logTo)
+	if wl.logger() != logTo {
+		t.Error("not logging through the Server")
+	}
+	svr.Start()
+	defer wl.Close()
+	url := "ws://" + l.Addr().String() + "/mqtt"
+
+	// Plain HTTP gets nowhere.
+	resp, err := http.Get("http://" + l.Addr().String() + "/mqtt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("expected refusal, got ", resp.Status)
+	}
+
+	conn, err := DialWebSocket(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := NewClientConn(conn)
+	if err := cc.Connect("", ""); err != nil {
+		t.Fatal(err)
+	}
+	cc.Subscribe([]proto.TopicQos{{Topic: "ws/#", Qos: proto.QosAtMostOnce}})
+
+	// A packet may be split across WebSocket messages, and messages
+	// may hold more than one packet; pings are answered on the way.
+	raw, err := DialWebSocket(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	(&proto.Connect{
+		ProtocolName:    "MQIsdp",
+		ProtocolVersion: Version31,
+		ClientId:        "raw",
+		CleanSession:    true,
+	}).Encode(&buf)
+	(&proto.Publish{TopicName: "ws/a", Payload: proto.BytesPayload("a")}).Encode(&buf)
+	(&proto.Publish{TopicName: "ws/b", Payload: proto.BytesPayload("b")}).Encode(&buf)
+	b := buf.Bytes()
+	raw.Write(b[:5])
+	raw.(*wsConn).writeFrame(wsPing, []byte("hi"))
+	raw.Write(b[5:])
+
+	for _, want := range []string{"ws/a", "ws/b"} {
+		select {
+		case m := <-cc.Incoming:
+			if m.TopicName != want {
+				t.Fatalf("got %v, want %v", m.TopicName, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("message did not arrive")
+		}
+	}
+
+	// The pong arrives before the CONNACK, and is not seen by the
+	// reader of the stream.
+	raw.SetReadDeadline(time.Now().Add(time.Second))
+	m, err := proto.DecodeOneMessage(raw, nil)
+	if _, ok := m.(*proto.ConnAck); !ok {
+		t.Fatalf("expected CONNACK, got %v %v", m, err)
+	}
+	cc.Disconnect()
+	raw.Close()
+}
+
+func TestWSAccept(t *testing.T) {
+	// The example from RFC 6455.
+	if got := wsAccept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Error("got ", got)
+	}
+}
@@ -33,7 +33,7 @@ func TestWild(t *testing.T) {
 	}
 
 	for _, x := range tests {
-		w := newWild(x.wild, nil)
+		w := newWild(x.wild)
 		if w.valid() != x.valid {
 			t.Fatal("Validation error: ", x.wild)
 		}